@@ -3,6 +3,7 @@ package ast
 import (
 	"bytes"
 	"monkey/src/token"
+	"strconv"
 	"strings"
 )
 
@@ -49,6 +50,41 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+// DestructuringLetStatement binds the elements of an array to names, as in
+// let [a, b, ...rest] = value;
+type DestructuringLetStatement struct {
+	Token token.Token
+	Names []*Identifier
+	Rest  *Identifier // nil without a rest pattern
+	Value Expression
+}
+
+func (ds *DestructuringLetStatement) statementNode() {}
+func (ds *DestructuringLetStatement) TokenLiteral() string {
+	return ds.Token.Literal
+}
+func (ds *DestructuringLetStatement) String() string {
+	var out bytes.Buffer
+
+	names := []string{}
+	for _, n := range ds.Names {
+		names = append(names, n.String())
+	}
+	if ds.Rest != nil {
+		names = append(names, "..."+ds.Rest.String())
+	}
+
+	out.WriteString(ds.TokenLiteral() + " [" + strings.Join(names, ", ") + "] = ")
+
+	if ds.Value != nil {
+		out.WriteString(ds.Value.String())
+	}
+
+	out.WriteString(";")
+
+	return out.String()
+}
+
 type ForStatement struct {
 	Token    token.Token
 	Index    *Identifier
@@ -75,6 +111,112 @@ func (fs *ForStatement) String() string {
 	return out.String()
 }
 
+type WhileStatement struct {
+	Token     token.Token
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (ws *WhileStatement) statementNode()       {}
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ws.TokenLiteral())
+	out.WriteString(" (")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(") {\n")
+	out.WriteString(ws.Body.String())
+	out.WriteString("}")
+
+	return out.String()
+}
+
+// DoWhileStatement runs Body once before checking Condition, as in
+// do { body } while (condition)
+type DoWhileStatement struct {
+	Token     token.Token
+	Body      *BlockStatement
+	Condition Expression
+}
+
+func (ds *DoWhileStatement) statementNode()       {}
+func (ds *DoWhileStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DoWhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ds.TokenLiteral())
+	out.WriteString(" {\n")
+	out.WriteString(ds.Body.String())
+	out.WriteString("} while (")
+	out.WriteString(ds.Condition.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
+// TryExpression evaluates to Body or, if a runtime error occurs in it, to
+// Catch with the error bound to Param:
+// try { body } catch (param) { catch }
+type TryExpression struct {
+	Token token.Token
+	Body  *BlockStatement
+	Param *Identifier // nil when the error is not bound
+	Catch *BlockStatement
+}
+
+func (ts *TryExpression) expressionNode()      {}
+func (ts *TryExpression) TokenLiteral() string { return ts.Token.Literal }
+func (ts *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ts.TokenLiteral())
+	out.WriteString(" {\n")
+	out.WriteString(ts.Body.String())
+	out.WriteString("} catch ")
+	if ts.Param != nil {
+		out.WriteString("(" + ts.Param.String() + ") ")
+	}
+	out.WriteString("{\n")
+	out.WriteString(ts.Catch.String())
+	out.WriteString("}")
+
+	return out.String()
+}
+
+// YieldExpression suspends the generator function it is in, handing Value
+// (null when it is missing) to whoever resumed it. It evaluates to null when
+// the generator is resumed.
+type YieldExpression struct {
+	Token token.Token
+	Value Expression // nil for a bare yield
+}
+
+func (ye *YieldExpression) expressionNode()      {}
+func (ye *YieldExpression) TokenLiteral() string { return ye.Token.Literal }
+func (ye *YieldExpression) String() string {
+	if ye.Value == nil {
+		return ye.TokenLiteral()
+	}
+	return ye.TokenLiteral() + " " + ye.Value.String()
+}
+
+type BreakStatement struct {
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) String() string       { return bs.Token.Literal + ";" }
+
+type ContinueStatement struct {
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) String() string       { return cs.Token.Literal + ";" }
+
 type Identifier struct {
 	Token token.Token
 	Value string
@@ -155,6 +297,28 @@ func (i *IntegerLiteral) String() string {
 	return i.Token.Literal
 }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (f *FloatLiteral) expressionNode()      {}
+func (f *FloatLiteral) TokenLiteral() string { return f.Token.Literal }
+func (f *FloatLiteral) String() string {
+	return f.Token.Literal
+}
+
+type CharLiteral struct {
+	Token token.Token
+	Value rune
+}
+
+func (c *CharLiteral) expressionNode()      {}
+func (c *CharLiteral) TokenLiteral() string { return c.Token.Literal }
+func (c *CharLiteral) String() string {
+	return strconv.QuoteRune(c.Value)
+}
+
 type PrefixExpression struct {
 	Token    token.Token
 	Operator string
@@ -206,6 +370,14 @@ func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
+type NullLiteral struct {
+	Token token.Token
+}
+
+func (n *NullLiteral) expressionNode()      {}
+func (n *NullLiteral) TokenLiteral() string { return n.Token.Literal }
+func (n *NullLiteral) String() string       { return n.Token.Literal }
+
 type IfExpression struct {
 	Token       token.Token
 	Condition   Expression
@@ -230,6 +402,45 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+// TernaryExpression is `Condition ? Consequence : Alternative`.
+type TernaryExpression struct {
+	Token       token.Token // the '?' token
+	Condition   Expression
+	Consequence Expression
+	Alternative Expression
+}
+
+func (te *TernaryExpression) expressionNode()      {}
+func (te *TernaryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TernaryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(te.Condition.String())
+	out.WriteString(" ? ")
+	out.WriteString(te.Consequence.String())
+	out.WriteString(" : ")
+	out.WriteString(te.Alternative.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
+// PostfixExpression is `Target++` or `Target--`. Target is an Identifier or
+// an IndexExpression; the expression evaluates to the updated value, just
+// like an assignment does.
+type PostfixExpression struct {
+	Token    token.Token // the '++' or '--' token
+	Target   Expression
+	Operator string
+}
+
+func (pe *PostfixExpression) expressionNode()      {}
+func (pe *PostfixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PostfixExpression) String() string {
+	return "(" + pe.Target.String() + pe.Operator + ")"
+}
+
 type BlockStatement struct {
 	Token      token.Token
 	Statements []Statement
@@ -251,6 +462,11 @@ type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string // the name it is bound to by let, if any
+	Variadic   bool   // the last parameter collects surplus arguments
+	// Defaults holds the default value of each parameter, nil where the
+	// parameter has none. Only trailing parameters can have defaults.
+	Defaults []Expression
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -259,9 +475,16 @@ func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range fl.Parameters {
+	for i, p := range fl.Parameters {
+		if i < len(fl.Defaults) && fl.Defaults[i] != nil {
+			params = append(params, p.String()+" = "+fl.Defaults[i].String())
+			continue
+		}
 		params = append(params, p.String())
 	}
+	if fl.Variadic {
+		params[len(params)-1] += "..."
+	}
 
 	out.WriteString(fl.TokenLiteral())
 	out.WriteString("(")
@@ -306,6 +529,31 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
+// TemplateLiteral is `text ${expression} text`. Parts holds the text as
+// StringLiterals and the embedded expressions in between.
+type TemplateLiteral struct {
+	Token token.Token
+	Parts []Expression
+}
+
+func (tl *TemplateLiteral) expressionNode()      {}
+func (tl *TemplateLiteral) TokenLiteral() string { return tl.Token.Literal }
+func (tl *TemplateLiteral) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("`")
+	for _, part := range tl.Parts {
+		if text, ok := part.(*StringLiteral); ok {
+			out.WriteString(text.Value)
+		} else {
+			out.WriteString("${" + part.String() + "}")
+		}
+	}
+	out.WriteString("`")
+
+	return out.String()
+}
+
 type ArrayLiteral struct {
 	Token    token.Token // the '[' token
 	Elements []Expression
@@ -351,6 +599,7 @@ func (ie *IndexExpression) String() string {
 type AssignStatement struct {
 	Token    token.Token
 	Variable *Identifier
+	Operator string // "=" or a compound operator such as "+="
 	Value    Expression
 }
 
@@ -360,16 +609,17 @@ func (as *AssignStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(as.Variable.String())
-	out.WriteString(" = ")
+	out.WriteString(" " + assignmentOperator(as.Operator) + " ")
 	out.WriteString(as.Value.String())
 
 	return out.String()
 }
 
 type IndexAssignmentExpression struct {
-	Token token.Token
-	Index *IndexExpression
-	Value Expression
+	Token    token.Token
+	Index    *IndexExpression
+	Operator string // "=" or a compound operator such as "+="
+	Value    Expression
 }
 
 func (is *IndexAssignmentExpression) expressionNode()      {}
@@ -381,15 +631,23 @@ func (is *IndexAssignmentExpression) String() string {
 	out.WriteString("[")
 	out.WriteString(is.Index.Index.String())
 	out.WriteString("]")
-	out.WriteString(" = ")
+	out.WriteString(" " + assignmentOperator(is.Operator) + " ")
 	out.WriteString(is.Value.String())
 
 	return out.String()
 }
 
+func assignmentOperator(op string) string {
+	if op == "" {
+		return "="
+	}
+	return op
+}
+
 type HashLiteral struct {
 	Token token.Token
 	Pairs map[Expression]Expression
+	Keys  []Expression // keys of Pairs, in source order
 }
 
 func (hl *HashLiteral) expressionNode()      {}
@@ -398,8 +656,8 @@ func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, key := range hl.Keys {
+		pairs = append(pairs, key.String()+":"+hl.Pairs[key].String())
 	}
 
 	out.WriteString("{")
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"monkey/src/token"
+	"strings"
 	"testing"
 )
 
@@ -25,3 +26,54 @@ func TestString(t *testing.T) {
 		t.Errorf("program.String() wrong. got=%q", program.String())
 	}
 }
+
+func TestInspect(t *testing.T) {
+	ident := func(name string) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	}
+
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Name:  ident("a"),
+				Value: &InfixExpression{Left: ident("b"), Operator: "+", Right: ident("c")},
+			},
+			&ExpressionStatement{
+				Expression: &IfExpression{
+					Condition: ident("d"),
+					Consequence: &BlockStatement{Statements: []Statement{
+						&ExpressionStatement{Expression: &FunctionLiteral{
+							Parameters: []*Identifier{ident("e")},
+							Body: &BlockStatement{Statements: []Statement{
+								&ExpressionStatement{Expression: ident("f")},
+							}},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	var names []string
+	Inspect(program, func(node Node) bool {
+		if ident, ok := node.(*Identifier); ok {
+			names = append(names, ident.Value)
+		}
+		return true
+	})
+	if strings.Join(names, " ") != "a b c d e f" {
+		t.Errorf("wrong identifiers visited. got=%q", names)
+	}
+
+	names = nil
+	Inspect(program, func(node Node) bool {
+		if ident, ok := node.(*Identifier); ok {
+			names = append(names, ident.Value)
+		}
+		_, isFunction := node.(*FunctionLiteral)
+		return !isFunction
+	})
+	if strings.Join(names, " ") != "a b c d" {
+		t.Errorf("wrong identifiers visited when skipping functions. got=%q", names)
+	}
+}
@@ -0,0 +1,157 @@
+package ast
+
+// Inspect traverses the tree rooted at node depth-first, calling f for node
+// and then for each of its children in source order. If f returns false the
+// children of that node are skipped. Missing optional parts, such as the
+// alternative of an if without else, are not visited.
+func Inspect(node Node, f func(Node) bool) {
+	if !f(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		for _, s := range n.Statements {
+			Inspect(s, f)
+		}
+
+	case *LetStatement:
+		Inspect(n.Name, f)
+		inspectExpression(n.Value, f)
+
+	case *DestructuringLetStatement:
+		for _, name := range n.Names {
+			Inspect(name, f)
+		}
+		if n.Rest != nil {
+			Inspect(n.Rest, f)
+		}
+		inspectExpression(n.Value, f)
+
+	case *ForStatement:
+		if n.Index != nil {
+			Inspect(n.Index, f)
+		}
+		if n.Value != nil {
+			Inspect(n.Value, f)
+		}
+		inspectExpression(n.Iterator, f)
+		if n.Block != nil {
+			Inspect(n.Block, f)
+		}
+
+	case *WhileStatement:
+		inspectExpression(n.Condition, f)
+		if n.Body != nil {
+			Inspect(n.Body, f)
+		}
+
+	case *DoWhileStatement:
+		if n.Body != nil {
+			Inspect(n.Body, f)
+		}
+		inspectExpression(n.Condition, f)
+
+	case *TryExpression:
+		if n.Body != nil {
+			Inspect(n.Body, f)
+		}
+		if n.Param != nil {
+			Inspect(n.Param, f)
+		}
+		if n.Catch != nil {
+			Inspect(n.Catch, f)
+		}
+
+	case *YieldExpression:
+		inspectExpression(n.Value, f)
+
+	case *ReturnStatement:
+		inspectExpression(n.ReturnValue, f)
+
+	case *ExpressionStatement:
+		inspectExpression(n.Expression, f)
+
+	case *PrefixExpression:
+		inspectExpression(n.Right, f)
+
+	case *InfixExpression:
+		inspectExpression(n.Left, f)
+		inspectExpression(n.Right, f)
+
+	case *IfExpression:
+		inspectExpression(n.Condition, f)
+		if n.Consequence != nil {
+			Inspect(n.Consequence, f)
+		}
+		if n.Alternative != nil {
+			Inspect(n.Alternative, f)
+		}
+
+	case *TernaryExpression:
+		inspectExpression(n.Condition, f)
+		inspectExpression(n.Consequence, f)
+		inspectExpression(n.Alternative, f)
+
+	case *PostfixExpression:
+		inspectExpression(n.Target, f)
+
+	case *BlockStatement:
+		for _, s := range n.Statements {
+			Inspect(s, f)
+		}
+
+	case *FunctionLiteral:
+		for i, p := range n.Parameters {
+			Inspect(p, f)
+			if i < len(n.Defaults) {
+				inspectExpression(n.Defaults[i], f)
+			}
+		}
+		if n.Body != nil {
+			Inspect(n.Body, f)
+		}
+
+	case *CallExpression:
+		inspectExpression(n.Function, f)
+		for _, a := range n.Arguments {
+			inspectExpression(a, f)
+		}
+
+	case *TemplateLiteral:
+		for _, p := range n.Parts {
+			inspectExpression(p, f)
+		}
+
+	case *ArrayLiteral:
+		for _, el := range n.Elements {
+			inspectExpression(el, f)
+		}
+
+	case *IndexExpression:
+		inspectExpression(n.Left, f)
+		inspectExpression(n.Index, f)
+
+	case *AssignStatement:
+		Inspect(n.Variable, f)
+		inspectExpression(n.Value, f)
+
+	case *IndexAssignmentExpression:
+		if n.Index != nil {
+			Inspect(n.Index, f)
+		}
+		inspectExpression(n.Value, f)
+
+	case *HashLiteral:
+		for _, key := range n.Keys {
+			inspectExpression(key, f)
+			inspectExpression(n.Pairs[key], f)
+		}
+	}
+}
+
+func inspectExpression(e Expression, f func(Node) bool) {
+	if e != nil {
+		Inspect(e, f)
+	}
+}
@@ -22,6 +22,7 @@ const (
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
+	OpGreaterEqual
 	OpMinus
 	OpBang
 	OpJumpNotTruthy
@@ -40,6 +41,30 @@ const (
 	OpSetLocal
 	OpGetLocal
 	OpGetBuiltin
+	OpTailCall
+	OpDup
+	OpDupTwo
+	OpDestructure
+	OpSetupTry
+	OpPopTry
+	OpLessThan
+	OpLessEqual
+	OpCheckStack
+	OpYield
+	// OpNoOp does nothing. The compiler never emits it; it exists for
+	// hand-built and loaded bytecode, and the peephole pass removes it.
+	OpNoOp
+	// OpClosure wraps the function constant at its first operand, and as
+	// many captured values as its second operand says, in a closure.
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+	OpPow
+	OpIn
+	// OpPopN pops as many values as its operand says at once, like that many
+	// OpPops. The compiler doesn't emit it yet; it is there for hand-built
+	// and loaded bytecode.
+	OpPopN
 )
 
 type Definition struct {
@@ -48,34 +73,52 @@ type Definition struct {
 }
 
 var definitions = map[Opcode]*Definition{
-	OpConstant:      {"OpConstant", []int{2}},
-	OpAdd:           {"OpAdd", []int{}},
-	OpSub:           {"OpSub", []int{}},
-	OpMul:           {"OpMul", []int{}},
-	OpDiv:           {"OpDiv", []int{}},
-	OpPop:           {"OpPop", []int{}},
-	OpTrue:          {"OpTrue", []int{}},
-	OpFalse:         {"OpFalse", []int{}},
-	OpEqual:         {"OpEqual", []int{}},
-	OpNotEqual:      {"OpNotEqual", []int{}},
-	OpGreaterThan:   {"OpGreaterThan", []int{}},
-	OpMinus:         {"OpMinus", []int{}},
-	OpBang:          {"OpBang", []int{}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
-	OpNull:          {"OpNull", []int{}},
-	OpSetGlobal:     {"OpSetGlobal", []int{2}},
-	OpGetGlobal:     {"OpGetGlobal", []int{2}},
-	OpArray:         {"OpArray", []int{2}},
-	OpHash:          {"OpHash", []int{2}},
-	OpIndex:         {"OpIndex", []int{}},
-	OpIndexAssign:   {"OpIndexAssign", []int{}},
-	OpCall:          {"OpCall", []int{1}},
-	OpReturnValue:   {"OpReturnValue", []int{}},
-	OpReturn:        {"OpReturn", []int{}},
-	OpSetLocal:      {"OpSetLocal", []int{1}},
-	OpGetLocal:      {"OpGetLocal", []int{1}},
-	OpGetBuiltin:    {"OpGetBuiltin", []int{1}},
+	OpConstant:       {"OpConstant", []int{2}},
+	OpAdd:            {"OpAdd", []int{}},
+	OpSub:            {"OpSub", []int{}},
+	OpMul:            {"OpMul", []int{}},
+	OpDiv:            {"OpDiv", []int{}},
+	OpPop:            {"OpPop", []int{}},
+	OpTrue:           {"OpTrue", []int{}},
+	OpFalse:          {"OpFalse", []int{}},
+	OpEqual:          {"OpEqual", []int{}},
+	OpNotEqual:       {"OpNotEqual", []int{}},
+	OpGreaterThan:    {"OpGreaterThan", []int{}},
+	OpGreaterEqual:   {"OpGreaterEqual", []int{}},
+	OpMinus:          {"OpMinus", []int{}},
+	OpBang:           {"OpBang", []int{}},
+	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
+	OpJump:           {"OpJump", []int{2}},
+	OpNull:           {"OpNull", []int{}},
+	OpSetGlobal:      {"OpSetGlobal", []int{2}},
+	OpGetGlobal:      {"OpGetGlobal", []int{2}},
+	OpArray:          {"OpArray", []int{2}},
+	OpHash:           {"OpHash", []int{2}},
+	OpIndex:          {"OpIndex", []int{}},
+	OpIndexAssign:    {"OpIndexAssign", []int{}},
+	OpCall:           {"OpCall", []int{1}},
+	OpReturnValue:    {"OpReturnValue", []int{}},
+	OpReturn:         {"OpReturn", []int{}},
+	OpSetLocal:       {"OpSetLocal", []int{1}},
+	OpGetLocal:       {"OpGetLocal", []int{1}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpDup:            {"OpDup", []int{}},
+	OpDupTwo:         {"OpDupTwo", []int{}},
+	OpDestructure:    {"OpDestructure", []int{2, 1}},
+	OpSetupTry:       {"OpSetupTry", []int{2}},
+	OpPopTry:         {"OpPopTry", []int{}},
+	OpLessThan:       {"OpLessThan", []int{}},
+	OpLessEqual:      {"OpLessEqual", []int{}},
+	OpCheckStack:     {"OpCheckStack", []int{}},
+	OpYield:          {"OpYield", []int{}},
+	OpNoOp:           {"OpNoOp", []int{}},
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpPow:            {"OpPow", []int{}},
+	OpIn:             {"OpIn", []int{}},
+	OpPopN:           {"OpPopN", []int{1}},
 }
 
 func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
@@ -90,6 +133,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return def.Name
 	case 1:
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 	}
 
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
@@ -9,6 +9,7 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 65535),
 		Make(OpAdd),
 		Make(OpGetLocal, 1),
+		Make(OpDestructure, 2, 1),
 	}
 
 	expected := `0000 OpConstant 1
@@ -16,6 +17,7 @@ func TestInstructionsString(t *testing.T) {
 0006 OpConstant 65535
 0009 OpAdd
 0010 OpGetLocal 1
+0012 OpDestructure 2 1
 `
 
 	concatted := Instructions{}
@@ -39,6 +41,7 @@ func TestReadOperands(t *testing.T) {
 	}{
 		{OpConstant, []int{65535}, 2},
 		{OpGetLocal, []int{255}, 1},
+		{OpDestructure, []int{65535, 1}, 3},
 	}
 
 	for _, tt := range tests {
@@ -71,6 +74,8 @@ func TestMake(t *testing.T) {
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpAdd, []int{}, []byte{byte(OpAdd)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+		{OpDestructure, []int{2, 1}, []byte{byte(OpDestructure), 0, 2, 1}},
+		{OpPopN, []int{3}, []byte{byte(OpPopN), 3}},
 	}
 
 	for _, tt := range tests {
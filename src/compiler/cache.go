@@ -0,0 +1,68 @@
+package compiler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"monkey/src/lexer"
+	"monkey/src/parser"
+	"strings"
+)
+
+// Cache stores serialized bytecode under a key. Entries are written with
+// Bytecode.Marshal and read back with LoadBytecode.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, data []byte) error
+}
+
+// CacheKey returns the key CompileCached uses for src. It depends only on
+// the source text and BytecodeVersion, never on where the source came from.
+func CacheKey(src string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00", BytecodeVersion)
+	h.Write([]byte(src))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CompileCached returns the bytecode for src, taking it from cache when
+// possible. On a miss src is parsed and compiled and the result is stored.
+// An entry that can no longer be loaded is treated as a miss and replaced.
+// hit reports whether the bytecode came from the cache.
+func CompileCached(src string, cache Cache) (bytecode *Bytecode, hit bool, err error) {
+	key := CacheKey(src)
+
+	if data, ok := cache.Get(key); ok {
+		bytecode, err := LoadBytecode(bytes.NewReader(data))
+		if err == nil {
+			return bytecode, true, nil
+		}
+	}
+
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, false, fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+
+	comp := New()
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, false, err
+	}
+	bytecode = comp.Bytecode()
+
+	var buf bytes.Buffer
+	err = bytecode.Marshal(&buf)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = cache.Put(key, buf.Bytes())
+	if err != nil {
+		return nil, false, fmt.Errorf("caching bytecode: %w", err)
+	}
+
+	return bytecode, false, nil
+}
@@ -0,0 +1,99 @@
+package compiler
+
+import (
+	"bytes"
+	"testing"
+)
+
+type memoryCache struct {
+	entries map[string][]byte
+	puts    int
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	data, ok := c.entries[key]
+	return data, ok
+}
+
+func (c *memoryCache) Put(key string, data []byte) error {
+	c.entries[key] = data
+	c.puts++
+	return nil
+}
+
+func TestCompileCached(t *testing.T) {
+	cache := &memoryCache{entries: map[string][]byte{}}
+	src := `let add = fn(a, b) { a + b }; add(1, 2);`
+
+	first, hit, err := CompileCached(src, cache)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	if hit {
+		t.Fatalf("first compile was served from cache")
+	}
+
+	second, hit, err := CompileCached(src, cache)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	if !hit {
+		t.Fatalf("second compile was not served from cache")
+	}
+	if cache.puts != 1 {
+		t.Fatalf("wrong number of puts. want=1, got=%d", cache.puts)
+	}
+	if !bytes.Equal(first.Instructions, second.Instructions) {
+		t.Fatalf("wrong instructions.\nwant=%q\ngot=%q", first.Instructions, second.Instructions)
+	}
+	if len(first.Constants) != len(second.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(first.Constants), len(second.Constants))
+	}
+
+	_, hit, err = CompileCached(src+" 3;", cache)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	if hit {
+		t.Fatalf("different source was served from cache")
+	}
+}
+
+func TestCompileCachedReplacesBadEntries(t *testing.T) {
+	src := `1 + 2`
+	cache := &memoryCache{entries: map[string][]byte{CacheKey(src): []byte("junk")}}
+
+	_, hit, err := CompileCached(src, cache)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	if hit {
+		t.Fatalf("unloadable entry was used")
+	}
+
+	_, hit, err = CompileCached(src, cache)
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	if !hit {
+		t.Fatalf("replaced entry was not used")
+	}
+}
+
+func TestCompileCachedErrors(t *testing.T) {
+	cache := &memoryCache{entries: map[string][]byte{}}
+
+	_, _, err := CompileCached(`let = 1;`, cache)
+	if err == nil {
+		t.Fatalf("expected a parser error")
+	}
+
+	_, _, err = CompileCached(`undefinedName`, cache)
+	if err == nil || err.Error() != "undefined variable undefinedName" {
+		t.Fatalf("wrong error. got=%v", err)
+	}
+
+	if len(cache.entries) != 0 {
+		t.Fatalf("failed compiles were cached: %d entries", len(cache.entries))
+	}
+}
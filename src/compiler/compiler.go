@@ -5,7 +5,6 @@ import (
 	"monkey/src/ast"
 	"monkey/src/code"
 	"monkey/src/object"
-	"sort"
 )
 
 type Compiler struct {
@@ -15,12 +14,46 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	stackChecks bool // emit OpCheckStack after each top-level statement
+
+	// propagate enables constant propagation: loading a global bound by let
+	// to an integer or string literal loads the literal's constant instead.
+	// Only globals whose name is never assigned to anywhere in the program
+	// qualify.
+	propagate      bool
+	assigned       map[string]bool // names assigned to in the program
+	constantGlobal map[int]int     // global index to constant index
+}
+
+// compoundAssignmentOps maps compound assignment operators to the opcode
+// combining the old value with the right-hand side.
+var compoundAssignmentOps = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
 }
 
 type CompilationScope struct {
 	instuctions         code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	loops []*LoopScope
+
+	tryDepth int // number of try bodies the next instruction is inside of
+
+	generator bool // a yield has been compiled in this scope
+}
+
+// LoopScope holds the labels that break and continue statements inside a
+// loop body jump to.
+type LoopScope struct {
+	breakLabel    *label
+	continueLabel *label
+
+	tryDepth int // tryDepth of the scope when the loop was entered
 }
 
 func New() *Compiler {
@@ -31,18 +64,40 @@ func New() *Compiler {
 		previousInstruction: EmittedInstruction{},
 	}
 
+	symbolTable := NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
 	return &Compiler{
 		constants:   []object.Object{},
-		symbolTable: NewSymbolTable(),
+		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+
+		propagate:      true,
+		constantGlobal: make(map[int]int),
 	}
 }
 
+// NewWithState returns a compiler continuing where the one that produced s
+// and constants left off, as a REPL does. A later program may assign to any
+// global, so constant propagation is off.
 func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	compiler.propagate = false
+	return compiler
+}
+
+// NewWithStackChecks returns a compiler that follows every top-level
+// statement with OpCheckStack, so that the VM reports code leaving values
+// behind on the stack (or taking too many off it) as soon as it happens. It
+// is meant for testing the compiler, not for running programs.
+func NewWithStackChecks() *Compiler {
+	compiler := New()
+	compiler.stackChecks = true
 	return compiler
 }
 
@@ -54,27 +109,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 	switch node := node.(type) {
 
 	case *ast.Program:
+		if c.propagate {
+			c.assigned = assignedNames(node)
+		}
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
 				return err
 			}
+			if c.stackChecks {
+				c.emit(code.OpCheckStack)
+			}
 		}
 
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "??" {
+			return c.compileNullCoalescing(node)
 		}
+
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
@@ -94,23 +146,80 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "**":
+			c.emit(code.OpPow)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterEqual)
+		case "<":
+			c.emit(code.OpLessThan)
+		case "<=":
+			c.emit(code.OpLessEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
+		case "in":
+			c.emit(code.OpIn)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(integer))
+		err := c.emitConstant(integer)
+		if err != nil {
+			return err
+		}
+
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		err := c.emitConstant(float)
+		if err != nil {
+			return err
+		}
+
+	case *ast.CharLiteral:
+		char := &object.Char{Value: node.Value}
+		err := c.emitConstant(char)
+		if err != nil {
+			return err
+		}
 
 	case *ast.StringLiteral:
 		obj := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(obj))
+		err := c.emitConstant(obj)
+		if err != nil {
+			return err
+		}
+
+	case *ast.TemplateLiteral:
+		if len(node.Parts) == 0 {
+			return c.emitConstant(&object.String{Value: ""})
+		}
+
+		// the parts are joined with +, the expressions converted by the str
+		// builtin, which user code shadowing str doesn't affect
+		for i, part := range node.Parts {
+			if _, ok := part.(*ast.StringLiteral); ok {
+				err := c.Compile(part)
+				if err != nil {
+					return err
+				}
+			} else {
+				c.emit(code.OpGetBuiltin, builtinIndex("str"))
+				err := c.Compile(part)
+				if err != nil {
+					return err
+				}
+				c.emit(code.OpCall, 1)
+			}
+
+			if i > 0 {
+				c.emit(code.OpAdd)
+			}
+		}
 
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
@@ -123,16 +232,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpArray, len(node.Elements))
 
 	case *ast.HashLiteral:
-		keys := []ast.Expression{}
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
+		// keys are evaluated, and the hash ordered, as they appear in the
+		// source
+		for _, k := range node.Keys {
 			err := c.Compile(k)
 			if err != nil {
 				return err
@@ -152,6 +254,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 		c.emit(code.OpPop)
+	case *ast.NullLiteral:
+		c.emit(code.OpNull)
+
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -187,71 +292,325 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		alternative, end := c.newLabel(), c.newLabel()
+		c.emitJump(code.OpJumpNotTruthy, alternative)
 
+		c.enterBlock()
 		err = c.Compile(node.Consequence)
 		if err != nil {
 			return err
 		}
+		c.leaveBlock()
 
 		if c.lastInstructionIs(code.OpPop) {
 			c.removeLastPop()
+		} else {
+			// the block ended in a statement, so it left nothing behind
+			c.emit(code.OpNull)
 		}
 
-		jumpPos := c.emit(code.OpJump, 9999)
-
-		afterConsequencePos := len(c.currentInstructions())
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		c.emitJump(code.OpJump, end)
+		c.placeLabel(alternative)
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
+			c.enterBlock()
 			err := c.Compile(node.Alternative)
 			if err != nil {
 				return err
 			}
+			c.leaveBlock()
 
 			if c.lastInstructionIs(code.OpPop) {
 				c.removeLastPop()
+			} else {
+				c.emit(code.OpNull)
+			}
+		}
+
+		c.placeLabel(end)
+
+	case *ast.TryExpression:
+		catch, end := c.newLabel(), c.newLabel()
+		c.emitJump(code.OpSetupTry, catch)
+
+		c.scopes[c.scopeIndex].tryDepth++
+		c.enterBlock()
+		err := c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+		c.leaveBlock()
+		c.scopes[c.scopeIndex].tryDepth--
+
+		if c.lastInstructionIs(code.OpPop) {
+			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
+		}
+
+		c.emit(code.OpPopTry)
+		c.emitJump(code.OpJump, end)
+
+		// the VM continues here with the error on the stack
+		c.placeLabel(catch)
+
+		// the error is bound inside the catch block only
+		c.enterBlock()
+		if node.Param != nil {
+			symbol := c.symbolTable.Define(node.Param.Value)
+			if symbol.Scope == GlobalScope {
+				c.emit(code.OpSetGlobal, symbol.Index)
+			} else {
+				c.emit(code.OpSetLocal, symbol.Index)
+			}
+		} else {
+			c.emit(code.OpPop)
+		}
+		catchPos := len(c.currentInstructions())
+
+		err = c.Compile(node.Catch)
+		if err != nil {
+			return err
+		}
+		c.leaveBlock()
+
+		// the OpPop of an unbound error does not end an expression statement
+		if c.lastInstructionIs(code.OpPop) && c.scopes[c.scopeIndex].lastInstruction.Position >= catchPos {
+			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
+		}
+
+		c.placeLabel(end)
+
+	case *ast.TernaryExpression:
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		alternative, end := c.newLabel(), c.newLabel()
+		c.emitJump(code.OpJumpNotTruthy, alternative)
+
+		c.enterBlock()
+		err = c.Compile(node.Consequence)
+		if err != nil {
+			return err
+		}
+		c.leaveBlock()
+
+		c.emitJump(code.OpJump, end)
+		c.placeLabel(alternative)
+
+		c.enterBlock()
+		err = c.Compile(node.Alternative)
+		if err != nil {
+			return err
+		}
+		c.leaveBlock()
+
+		c.placeLabel(end)
+
+	case *ast.PostfixExpression:
+		op := code.OpAdd
+		if node.Operator == "--" {
+			op = code.OpSub
+		}
+
+		switch target := node.Target.(type) {
+		case *ast.Identifier:
+			symbol, err := c.resolveAssignable(target.Value)
+			if err != nil {
+				return err
+			}
+
+			c.loadSymbol(symbol)
+			err = c.emitConstant(&object.Integer{Value: 1})
+			if err != nil {
+				return err
+			}
+			c.emit(op)
+			c.emit(code.OpDup)
+			if symbol.Scope == GlobalScope {
+				c.emit(code.OpSetGlobal, symbol.Index)
+			} else {
+				c.emit(code.OpSetLocal, symbol.Index)
+			}
+
+		case *ast.IndexExpression:
+			err := c.Compile(target.Left)
+			if err != nil {
+				return err
 			}
+			err = c.Compile(target.Index)
+			if err != nil {
+				return err
+			}
+
+			// as in a compound index assignment, the container and index
+			// are evaluated once and read through copies
+			c.emit(code.OpDupTwo)
+			c.emit(code.OpIndex)
+			err = c.emitConstant(&object.Integer{Value: 1})
+			if err != nil {
+				return err
+			}
+			c.emit(op)
+			c.emit(code.OpIndexAssign)
+
+		default:
+			return fmt.Errorf("cannot apply %s to %s", node.Operator, node.Target.String())
+		}
+
+	case *ast.WhileStatement:
+		start, end := c.newLabel(), c.newLabel()
+		c.placeLabel(start)
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		c.emitJump(code.OpJumpNotTruthy, end)
+
+		c.enterLoop(start, end)
+		c.enterBlock()
+
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		c.leaveBlock()
+		c.leaveLoop()
+
+		c.emitJump(code.OpJump, start)
+		c.placeLabel(end)
+
+	case *ast.DoWhileStatement:
+		body, condition, end := c.newLabel(), c.newLabel(), c.newLabel()
+		c.placeLabel(body)
+
+		c.enterLoop(condition, end)
+		c.enterBlock()
+
+		err := c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		c.leaveBlock()
+		c.leaveLoop()
+
+		c.placeLabel(condition)
+
+		err = c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// jump back while the condition holds
+		c.emit(code.OpBang)
+		c.emitJump(code.OpJumpNotTruthy, body)
+
+		c.placeLabel(end)
+
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("break outside of loop")
 		}
+		c.leaveTryBodies(loop)
+		c.emitJump(code.OpJump, loop.breakLabel)
 
-		afterAlternativePos := len(c.currentInstructions())
-		c.changeOperand(jumpPos, afterAlternativePos)
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("continue outside of loop")
+		}
+		c.leaveTryBodies(loop)
+		c.emitJump(code.OpJump, loop.continueLabel)
 
 	case *ast.LetStatement:
+		// a function literal is bound to its name first so that it can call
+		// itself; any other value still sees a binding it shadows
+		_, isFunction := node.Value.(*ast.FunctionLiteral)
+		var symbol Symbol
+		if isFunction {
+			symbol = c.symbolTable.Define(node.Name.Value)
+		}
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
-		symbol := c.symbolTable.Define(node.Name.Value)
+		if !isFunction {
+			symbol = c.symbolTable.Define(node.Name.Value)
+		}
+		if c.isPropagated(symbol, node.Value) {
+			c.constantGlobal[symbol.Index] = len(c.constants) - 1
+		}
 		if symbol.Scope == GlobalScope {
 			c.emit(code.OpSetGlobal, symbol.Index)
 		} else {
 			c.emit(code.OpSetLocal, symbol.Index)
 		}
 
+	case *ast.DestructuringLetStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		names := node.Names
+		hasRest := 0
+		if node.Rest != nil {
+			names = append(names[:len(names):len(names)], node.Rest)
+			hasRest = 1
+		}
+
+		// OpDestructure leaves the elements on the stack with the first one
+		// on top, so they are set in order
+		c.emit(code.OpDestructure, len(node.Names), hasRest)
+		for _, name := range names {
+			symbol := c.symbolTable.Define(name.Value)
+			if symbol.Scope == GlobalScope {
+				c.emit(code.OpSetGlobal, symbol.Index)
+			} else {
+				c.emit(code.OpSetLocal, symbol.Index)
+			}
+		}
+
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
 			return fmt.Errorf("undefined variable %s", node.Value)
 		}
-		if symbol.Scope == GlobalScope {
-
-			c.emit(code.OpGetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpGetLocal, symbol.Index)
+		if index, ok := c.constantGlobal[symbol.Index]; ok && symbol.Scope == GlobalScope {
+			c.emit(code.OpConstant, index)
+			break
 		}
+		c.loadSymbol(symbol)
 
 	case *ast.AssignStatement:
-		err := c.Compile(node.Value)
+		symbol, err := c.resolveAssignable(node.Variable.Value)
 		if err != nil {
 			return err
 		}
-		symbol, ok := c.symbolTable.Resolve(node.Variable.Value)
-		if !ok {
-			return fmt.Errorf("variable not intialized with let %s", node.Variable.Value)
+
+		op, compound := compoundAssignmentOps[node.Operator]
+		if compound {
+			c.loadSymbol(symbol)
+		}
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
 		}
+		if compound {
+			c.emit(op)
+		}
+
 		if symbol.Scope == GlobalScope {
 			c.emit(code.OpSetGlobal, symbol.Index)
 		} else {
@@ -267,10 +626,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
+
+		// a compound assignment reads the element through copies of the
+		// container and index, so both are evaluated only once
+		op, compound := compoundAssignmentOps[node.Operator]
+		if compound {
+			c.emit(code.OpDupTwo)
+			c.emit(code.OpIndex)
+		}
 		err = c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
+		if compound {
+			c.emit(op)
+		}
 		c.emit(code.OpIndexAssign)
 
 	case *ast.IndexExpression:
@@ -285,38 +655,115 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpIndex)
 
 	case *ast.FunctionLiteral:
+		// a function defined at the top level finds itself as a global; a
+		// nested one can't, as it is only stored after it has been created
+		nested := c.scopeIndex > 0
 		c.enterScope()
 
+		if nested && node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+
 		for _, p := range node.Parameters {
 			c.symbolTable.Define(p.Value)
 		}
 
-		err := c.Compile(node.Body)
+		defaultEntries, err := c.compileDefaults(node)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
 
 		if c.lastInstructionIs(code.OpPop) {
 			c.replaceLastPopWithReturn()
+			c.markTailCall()
 		}
 
 		if !c.lastInstructionIs(code.OpReturnValue) {
 			c.emit(code.OpReturn)
 		}
 		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		freeSymbols := c.symbolTable.FreeSymbols
+		generator := c.scopes[c.scopeIndex].generator
+		instructions, defaultEntries := peephole(c.leaveScope(), defaultEntries)
+
+		compiledFn := &object.CompiledFunction{
+			Instructions:   instructions,
+			NumLocals:      numLocals,
+			NumParameters:  len(node.Parameters),
+			Name:           node.Name,
+			Variadic:       node.Variadic,
+			DefaultEntries: defaultEntries,
+			Generator:      generator,
+		}
 
-		compiledFn := &object.CompiledFunction{Instructions: instructions, NumLocals: numLocals, NumParameters: len(node.Parameters)}
-		c.emit(code.OpConstant, c.addConstant(compiledFn))
+		if len(freeSymbols) == 0 {
+			err = c.emitConstant(compiledFn)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if len(freeSymbols) > 255 {
+			return fmt.Errorf("too many captured variables: %d", len(freeSymbols))
+		}
+		if len(c.constants) >= MaxConstants {
+			return fmt.Errorf("too many constants: the limit is %d", MaxConstants)
+		}
+		for _, s := range freeSymbols {
+			c.loadSymbol(s)
+		}
+		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
+
+	case *ast.YieldExpression:
+		if c.scopeIndex == 0 {
+			return fmt.Errorf("yield outside of function")
+		}
+		// a try handler can't outlive the frame it was set up in, and a
+		// yield takes the frame away
+		if c.scopes[c.scopeIndex].tryDepth > 0 {
+			return fmt.Errorf("yield inside try")
+		}
+
+		if node.Value != nil {
+			err := c.Compile(node.Value)
+			if err != nil {
+				return err
+			}
+		} else {
+			c.emit(code.OpNull)
+		}
+		c.emit(code.OpYield)
+		c.scopes[c.scopeIndex].generator = true
 
 	case *ast.ReturnStatement:
+		// the main scope has no frame to return from
+		if c.scopeIndex == 0 {
+			return fmt.Errorf("return outside of function")
+		}
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpReturnValue)
+		c.markTailCall()
 
 	case *ast.CallExpression:
+		if name, ok := c.definedCallName(node); ok {
+			_, defined := c.symbolTable.Resolve(name)
+			if defined {
+				c.emit(code.OpTrue)
+			} else {
+				c.emit(code.OpFalse)
+			}
+			return nil
+		}
+
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
@@ -335,6 +782,150 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// definedCallName returns the name asked about when node is a call of the
+// defined builtin with a string literal. Names are resolved at compile time,
+// so such calls are answered by the compiler; the builtin itself only reports
+// the misuse of other arguments.
+func (c *Compiler) definedCallName(node *ast.CallExpression) (string, bool) {
+	fn, ok := node.Function.(*ast.Identifier)
+	if !ok || fn.Value != "defined" || len(node.Arguments) != 1 {
+		return "", false
+	}
+
+	symbol, ok := c.symbolTable.Resolve(fn.Value)
+	if !ok || symbol.Scope != BuiltinScope {
+		return "", false
+	}
+
+	name, ok := node.Arguments[0].(*ast.StringLiteral)
+	if !ok {
+		return "", false
+	}
+
+	return name.Value, true
+}
+
+// compileNullCoalescing compiles `a ?? b` to keep a unless it is null, in
+// which case it is dropped and b is evaluated instead.
+func (c *Compiler) compileNullCoalescing(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpDup)
+	c.emit(code.OpNull)
+	c.emit(code.OpEqual)
+	end := c.newLabel()
+	c.emitJump(code.OpJumpNotTruthy, end)
+
+	c.emit(code.OpPop)
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	c.placeLabel(end)
+
+	return nil
+}
+
+// compileDefaults emits the code assigning the default values of node's
+// parameters and returns the entry points into it, see
+// object.CompiledFunction.DefaultEntries.
+func (c *Compiler) compileDefaults(node *ast.FunctionLiteral) ([]int, error) {
+	var entries []int
+
+	for i, def := range node.Defaults {
+		if def == nil {
+			continue
+		}
+
+		entries = append(entries, len(c.currentInstructions()))
+
+		err := c.Compile(def)
+		if err != nil {
+			return nil, err
+		}
+
+		symbol, _ := c.symbolTable.Resolve(node.Parameters[i].Value)
+		c.emit(code.OpSetLocal, symbol.Index)
+	}
+
+	if entries == nil {
+		return nil, nil
+	}
+
+	return append(entries, len(c.currentInstructions())), nil
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+// isPropagated reports whether loads of the variable symbol, just bound to
+// value by let, can be replaced with value's constant.
+func (c *Compiler) isPropagated(symbol Symbol, value ast.Expression) bool {
+	if !c.propagate || symbol.Scope != GlobalScope || c.assigned[symbol.Name] {
+		return false
+	}
+
+	switch value.(type) {
+	case *ast.IntegerLiteral, *ast.StringLiteral:
+		return true
+	}
+	return false
+}
+
+// assignedNames returns the names of all variables program assigns to,
+// whichever scope they are in.
+func assignedNames(program *ast.Program) map[string]bool {
+	names := make(map[string]bool)
+
+	ast.Inspect(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStatement:
+			names[node.Variable.Value] = true
+		case *ast.PostfixExpression:
+			if target, ok := node.Target.(*ast.Identifier); ok {
+				names[target.Value] = true
+			}
+		}
+		return true
+	})
+
+	return names
+}
+
+// resolveAssignable resolves the target of an assignment. A closure gets
+// copies of the variables it captures, so assigning to one is an error
+// rather than a change nobody else would see.
+func (c *Compiler) resolveAssignable(name string) (Symbol, error) {
+	symbol, ok := c.symbolTable.Resolve(name)
+	if !ok {
+		return symbol, fmt.Errorf("undefined variable %s", name)
+	}
+
+	switch symbol.Scope {
+	case BuiltinScope:
+		return symbol, fmt.Errorf("cannot assign to builtin %s", name)
+	case FreeScope, FunctionScope:
+		return symbol, fmt.Errorf("cannot assign to captured variable %s", name)
+	}
+	return symbol, nil
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
@@ -342,6 +933,18 @@ func (c *Compiler) replaceLastPopWithReturn() {
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// markTailCall turns a call whose result is returned right away, by the
+// OpReturnValue that was just emitted, into a tail call.
+func (c *Compiler) markTailCall() {
+	previous := c.scopes[c.scopeIndex].previousInstruction
+	if previous.Opcode != code.OpCall {
+		return
+	}
+
+	c.currentInstructions()[previous.Position] = byte(code.OpTailCall)
+	c.scopes[c.scopeIndex].previousInstruction.Opcode = code.OpTailCall
+}
+
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	ins := c.currentInstructions()
 	for i := 0; i < len(newInstruction); i++ {
@@ -349,6 +952,39 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// label is a position in the current scope's instructions for jumps to
+// target. Jumps to a label that hasn't been placed yet are emitted with a
+// placeholder operand and patched by placeLabel.
+type label struct {
+	pos     int   // -1 until placed
+	pending []int // positions of the jumps waiting for pos
+}
+
+func (c *Compiler) newLabel() *label {
+	return &label{pos: -1}
+}
+
+// emitJump emits op, a jump or OpSetupTry, targeting l.
+func (c *Compiler) emitJump(op code.Opcode, l *label) int {
+	if l.pos >= 0 {
+		return c.emit(op, l.pos)
+	}
+
+	pos := c.emit(op, 9999)
+	l.pending = append(l.pending, pos)
+	return pos
+}
+
+// placeLabel puts l at the end of the current instructions, so that it
+// targets whatever is emitted next.
+func (c *Compiler) placeLabel(l *label) {
+	l.pos = len(c.currentInstructions())
+	for _, pos := range l.pending {
+		c.changeOperand(pos, l.pos)
+	}
+	l.pending = nil
+}
+
 func (c *Compiler) changeOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
 	newInstruction := code.Make(op, operand)
@@ -374,11 +1010,25 @@ func (c *Compiler) removeLastPop() {
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 
+// MaxConstants is the number of constants OpConstant's operand can index.
+const MaxConstants = 1 << 16
+
 func (c *Compiler) addConstant(obj object.Object) int {
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
 }
 
+// emitConstant adds obj to the constant pool and emits the instruction
+// loading it. It fails once the pool is full, as the index would not fit the
+// operand.
+func (c *Compiler) emitConstant(obj object.Object) error {
+	if len(c.constants) >= MaxConstants {
+		return fmt.Errorf("too many constants: the limit is %d", MaxConstants)
+	}
+	c.emit(code.OpConstant, c.addConstant(obj))
+	return nil
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
@@ -426,9 +1076,59 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+// enterBlock gives the block about to be compiled a symbol table of its own,
+// so that the names it defines are gone after leaveBlock.
+func (c *Compiler) enterBlock() {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveBlock() {
+	c.symbolTable = c.symbolTable.Outer
+}
+
+// enterLoop starts a loop body in which continue jumps to continueLabel and
+// break to breakLabel.
+func (c *Compiler) enterLoop(continueLabel, breakLabel *label) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, &LoopScope{
+		breakLabel:    breakLabel,
+		continueLabel: continueLabel,
+		tryDepth:      scope.tryDepth,
+	})
+}
+
+func (c *Compiler) leaveLoop() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+// leaveTryBodies removes the handlers of the try bodies a break or continue
+// jumps out of.
+func (c *Compiler) leaveTryBodies(loop *LoopScope) {
+	for i := loop.tryDepth; i < c.scopes[c.scopeIndex].tryDepth; i++ {
+		c.emit(code.OpPopTry)
+	}
+}
+
+func (c *Compiler) currentLoop() *LoopScope {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// SymbolTable returns the table the compiler resolves names with. After
+// compiling a program it holds the program's globals.
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions, _ := peephole(c.currentInstructions(), nil)
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
 	}
 }
@@ -438,7 +1138,30 @@ type Bytecode struct {
 	Constants    []object.Object
 }
 
+// Functions returns the compiled functions among the constants, in the
+// order they are in the constant pool. Every function of the program is
+// there, including the ones nested inside other functions.
+func (b *Bytecode) Functions() []*object.CompiledFunction {
+	var fns []*object.CompiledFunction
+	for _, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			fns = append(fns, fn)
+		}
+	}
+	return fns
+}
+
 type EmittedInstruction struct {
 	Opcode   code.Opcode
 	Position int
 }
+
+// builtinIndex returns the index of the builtin name in object.Builtins.
+func builtinIndex(name string) int {
+	for i, b := range object.Builtins {
+		if b.Name == name {
+			return i
+		}
+	}
+	panic("unknown builtin " + name)
+}
@@ -7,6 +7,7 @@ import (
 	"monkey/src/lexer"
 	"monkey/src/object"
 	"monkey/src/parser"
+	"strings"
 	"testing"
 )
 
@@ -96,6 +97,27 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "2 ** 3",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 in [1]",
+			expectedConstants: []interface{}{1, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpIn),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "1; 2",
 			expectedConstants: []interface{}{1, 2},
@@ -120,6 +142,23 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 * 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -151,11 +190,31 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -268,48 +327,27 @@ func TestConditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestGlobalLetStatements(t *testing.T) {
+func TestTernaryExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: `
-			let one = 1;
-			let two = 2;
-			`,
-			expectedConstants: []interface{}{1, 2},
+			input:             `true ? 10 : 20; 3333`,
+			expectedConstants: []interface{}{10, 20, 3333},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				// 0007
+				code.Make(code.OpJump, 13),
+				// 0010
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
-			},
-		},
-		{
-
-			input: `
-			let one = 1;
-			one;
-			`,
-			expectedConstants: []interface{}{1},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
+				// 0013
 				code.Make(code.OpPop),
-			},
-		},
-		{
-			input: `
-			let one = 1;
-			let two = one;
-			two;
-			`,
-			expectedConstants: []interface{}{1},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 1),
+				// 0014
+				code.Make(code.OpConstant, 2),
+				// 0017
 				code.Make(code.OpPop),
 			},
 		},
@@ -318,70 +356,71 @@ func TestGlobalLetStatements(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestLetStatementsScope(t *testing.T) {
+func TestNullCoalescing(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: `
-			let num = 10;
-			fn() { num }`,
-			expectedConstants: []interface{}{
-				10,
-				[]code.Instructions{
-					code.Make(code.OpGetGlobal, 0),
-					code.Make(code.OpReturnValue),
-				},
-			},
+			input:             `1 ?? 2`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
+				// 0000
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				// 0003
+				code.Make(code.OpDup),
+				// 0004
+				code.Make(code.OpNull),
+				// 0005
+				code.Make(code.OpEqual),
+				// 0006
+				code.Make(code.OpJumpNotTruthy, 13),
+				// 0009
+				code.Make(code.OpPop),
+				// 0010
 				code.Make(code.OpConstant, 1),
+				// 0013
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileStatements(t *testing.T) {
+	tests := []compilerTestCase{
 		{
 			input: `
-			fn() {
-			  let num = 10;
-			  num;
-			}`,
-			expectedConstants: []interface{}{
-				10,
-				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpReturnValue),
-				},
-			},
+			while (true) { 10 } 3333;
+			`,
+			expectedConstants: []interface{}{10, 3333},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
 				code.Make(code.OpConstant, 1),
+				// 0014
 				code.Make(code.OpPop),
 			},
 		},
 		{
 			input: `
-			fn() {
-			  let a = 10;
-			  let b = 15;
-			  a + b;
-			}`,
-			expectedConstants: []interface{}{
-				10,
-				15,
-				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetLocal, 1),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
-				},
-			},
+			while (true) { break; continue; }
+			`,
+			expectedConstants: []interface{}{},
+			// the continue and the jump back are unreachable after the
+			// break, which then only jumps to the next instruction
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpPop),
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 4),
 			},
 		},
 	}
@@ -389,68 +428,65 @@ func TestLetStatementsScope(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestAssignStatements(t *testing.T) {
+func TestDoWhileStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input: `
-			let one = 1;
-			one = 9;
+			do { 10 } while (false); 3333;
 			`,
-			expectedConstants: []interface{}{1, 9},
+			expectedConstants: []interface{}{10, 3333},
 			expectedInstructions: []code.Instructions{
+				// 0000
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
+				// 0003
+				code.Make(code.OpPop),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpBang),
+				// 0006
+				code.Make(code.OpJumpNotTruthy, 0),
+				// 0009
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 0),
+				// 0012
+				code.Make(code.OpPop),
 			},
 		},
-		{
+	}
 
-			input: `
-			let one = 1;
-			let two = 2;
-			one = two;
-			`,
-			expectedConstants: []interface{}{1, 2},
+	runCompilerTests(t, tests)
+}
+
+func TestPostfixExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let i = 0; i++;`,
+			expectedConstants: []interface{}{0, 1},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpDup),
 				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `
-			let one = 1;
-			fn() {
-			  let two = 2;
-			  two = 3;
-			  one = 2;
-			  one
-			}
-			`,
-			expectedConstants: []interface{}{
-				1,
-				2,
-				3,
-				2,
-				[]code.Instructions{
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpConstant, 2),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpConstant, 3),
-					code.Make(code.OpSetGlobal, 0),
-					code.Make(code.OpGetGlobal, 0),
-					code.Make(code.OpReturnValue),
-				},
-			},
+			input:             `let a = [5]; a[0]--;`,
+			expectedConstants: []interface{}{5, 0, 1},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDupTwo),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSub),
+				code.Make(code.OpIndexAssign),
 				code.Make(code.OpPop),
 			},
 		},
@@ -459,23 +495,56 @@ func TestAssignStatements(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestStringExpressions(t *testing.T) {
+func TestLabels(t *testing.T) {
+	compiler := New()
+
+	// a backward jump to a placed label and forward jumps patched later
+	start, end := compiler.newLabel(), compiler.newLabel()
+	compiler.placeLabel(start)
+	compiler.emit(code.OpTrue)
+	compiler.emitJump(code.OpJumpNotTruthy, end)
+	compiler.emitJump(code.OpJump, start)
+	compiler.emitJump(code.OpJump, end)
+	compiler.placeLabel(end)
+	compiler.emit(code.OpNull)
+
+	expected := []code.Instructions{
+		code.Make(code.OpTrue),
+		code.Make(code.OpJumpNotTruthy, 10),
+		code.Make(code.OpJump, 0),
+		code.Make(code.OpJump, 10),
+		code.Make(code.OpNull),
+	}
+
+	err := testInstructions(expected, compiler.currentInstructions())
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestTemplateLiterals(t *testing.T) {
+	str := builtinIndex("str")
+
 	tests := []compilerTestCase{
 		{
-			input:             `"monkey"`,
-			expectedConstants: []interface{}{"monkey"},
+			input:             "`a ${1} b`",
+			expectedConstants: []interface{}{"a ", 1, " b"},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGetBuiltin, str),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             `"mon" + "key"`,
-			expectedConstants: []interface{}{"mon", "key"},
+			input:             "``",
+			expectedConstants: []interface{}{""},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
 		},
@@ -484,42 +553,122 @@ func TestStringExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestArrayLiterals(t *testing.T) {
+func TestYieldExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             `[]`,
-			expectedConstants: []interface{}{},
+			input: `fn() { yield 1; 2 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpYield),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 2),
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGeneratorFunctions(t *testing.T) {
+	tests := []struct {
+		input     string
+		generator []bool // for each function constant, in order
+	}{
+		{`fn() { yield; }`, []bool{true}},
+		{`fn() { 1 }`, []bool{false}},
+		// a yield makes only the function it is directly in a generator
+		{`fn() { fn() { yield 1; } }`, []bool{true, false}},
+		{`fn() { if (true) { while (false) { yield 1; } } }`, []bool{true}},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		fns := compiler.Bytecode().Functions()
+		if len(fns) != len(tt.generator) {
+			t.Fatalf("wrong number of functions for %q. want=%d, got=%d", tt.input, len(tt.generator), len(fns))
+		}
+		for i, want := range tt.generator {
+			if fns[i].Generator != want {
+				t.Errorf("function %d of %q has wrong generator flag. want=%t, got=%t", i, tt.input, want, fns[i].Generator)
+			}
+		}
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`yield 1;`, "yield outside of function"},
+		{`fn() { try { yield 1 } catch { 2 } }`, "yield inside try"},
+	}
+
+	for _, tt := range errorTests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []compilerTestCase{
 		{
-			input:             `[1, 2, 3]`,
-			expectedConstants: []interface{}{1, 2, 3},
+			input:             `try { 1 } catch (e) { 2 }`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpSetupTry, 10),
+				// 0003
 				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpPopTry),
+				// 0007
+				code.Make(code.OpJump, 16),
+				// 0010
+				code.Make(code.OpSetGlobal, 0),
+				// 0013
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
+				// 0016
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "[1 + 2, 4 - 3, 4 * 5]",
-			expectedConstants: []interface{}{1, 2, 4, 3, 4, 5},
+			input:             `while (true) { try { break; } catch { } }`,
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpArray, 3),
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 17),
+				// 0004
+				code.Make(code.OpSetupTry, 11),
+				// 0007
+				code.Make(code.OpPopTry),
+				// 0008
+				code.Make(code.OpJump, 17),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpNull),
+				// 0013
 				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpJump, 0),
 			},
 		},
 	}
@@ -527,43 +676,146 @@ func TestArrayLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestHashLiterals(t *testing.T) {
+func TestLoopControlOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "break outside of loop"},
+		{"continue;", "continue outside of loop"},
+		{"if (true) { break; }", "break outside of loop"},
+		{"while (true) { fn() { continue; } }", "continue outside of loop"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but got none", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "{}",
-			expectedConstants: []interface{}{},
+			input: `
+			let one = 1;
+			let two = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpHash, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+
+			input: `
+			let one = 1;
+			one;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				// one is never assigned to, so its constant is propagated
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2, 3: 4, 5: 6}",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			input: `
+			let one = 1;
+			let two = one;
+			two;
+			`,
+			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpHash, 6),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
 				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLetStatementsScope(t *testing.T) {
+	tests := []compilerTestCase{
 		{
-			input:             "{1: 2 + 3, 4: 5 * 6}",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			input: `
+			let num = 10;
+			fn() { num }`,
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn() {
+			  let num = 10;
+			  num;
+			}`,
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn() {
+			  let a = 10;
+			  let b = 15;
+			  a + b;
+			}`,
+			expectedConstants: []interface{}{
+				10,
+				15,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpHash, 4),
 				code.Make(code.OpPop),
 			},
 		},
@@ -572,45 +824,866 @@ func TestHashLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestIndexExpressions(t *testing.T) {
+func TestAssignStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "let arr = []; arr[0] = 1;",
-			expectedConstants: []interface{}{0, 1},
+			input: `
+			let one = 1;
+			one = 9;
+			`,
+			expectedConstants: []interface{}{1, 9},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+
+			input: `
+			let one = 1;
+			let two = 2;
+			one = two;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpIndexAssign),
-				code.Make(code.OpPop),
+				code.Make(code.OpSetGlobal, 1),
+				// only one is assigned to, two is propagated
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `
+			let one = 1;
+			fn() {
+			  let two = 2;
+			  two = 3;
+			  one = 2;
+			  one
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetGlobal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompoundAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let x = 1;
+			x += 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `
+			let a = [1];
+			a[0] *= 3;
+			`,
+			expectedConstants: []interface{}{1, 0, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDupTwo),
+				code.Make(code.OpIndex),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpMul),
+				code.Make(code.OpIndexAssign),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let [a, b] = [1, 2];`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpDestructure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `fn(arr) { let [a, ...rest] = arr; }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpDestructure, 1, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignUndefinedVariable(t *testing.T) {
+	program := parse("x = 5;")
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but got none")
+	}
+
+	if err.Error() != "undefined variable x" {
+		t.Errorf("wrong compiler error. want=%q, got=%q", "undefined variable x", err)
+	}
+}
+
+func TestDefinedIsResolvedAtCompileTime(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 1; defined("x"); defined("y")`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestReturnOutsideFunction(t *testing.T) {
+	inputs := []string{
+		"return 5;",
+		"if (true) { return 1; }",
+		"while (true) { return 1; }",
+		"let f = fn() { 1 }; return f();",
+	}
+
+	for _, input := range inputs {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q but got none", input)
+		}
+		if err.Error() != "return outside of function" {
+			t.Errorf("wrong compiler error for %q. got=%q", input, err)
+		}
+	}
+
+	compiler := New()
+	err := compiler.Compile(parse("let f = fn() { if (true) { return 1; } 2 }; f();"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+}
+
+func TestStackChecks(t *testing.T) {
+	compiler := NewWithStackChecks()
+	err := compiler.Compile(parse("let x = 1; if (x) { 2; 3 }"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpCheckStack),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpJumpNotTruthy, 23),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpJump, 24),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+		code.Make(code.OpCheckStack),
+	}
+
+	err = testInstructions(expected, compiler.Bytecode().Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
+
+func TestBytecodeFunctions(t *testing.T) {
+	input := `
+	let add = fn(a, b) { let sum = a + b; sum };
+	let greet = fn(name) { let suffix = fn() { "!" }; name + suffix() };
+	add(1, 2);
+	`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []struct {
+		name          string
+		numParameters int
+		numLocals     int
+	}{
+		{"add", 2, 3},
+		{"suffix", 0, 0},
+		{"greet", 1, 2},
+	}
+
+	fns := compiler.Bytecode().Functions()
+	if len(fns) != len(expected) {
+		t.Fatalf("wrong number of functions. want=%d, got=%d", len(expected), len(fns))
+	}
+
+	for i, want := range expected {
+		fn := fns[i]
+		if fn.Name != want.name || fn.NumParameters != want.numParameters || fn.NumLocals != want.numLocals {
+			t.Errorf("function %d wrong. want=%+v, got name=%q params=%d locals=%d",
+				i, want, fn.Name, fn.NumParameters, fn.NumLocals)
+		}
+	}
+}
+
+func TestTooManyConstants(t *testing.T) {
+	constants := func(n int) string {
+		var out strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&out, "%d;", i)
+		}
+		return out.String()
+	}
+
+	compiler := New()
+	err := compiler.Compile(parse(constants(MaxConstants)))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	compiler = New()
+	err = compiler.Compile(parse(constants(70000)))
+	if err == nil {
+		t.Fatalf("expected compiler error but got none")
+	}
+
+	expected := "too many constants: the limit is 65536"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, err)
+	}
+}
+
+func TestStringExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"monkey"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `[]`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `[1, 2, 3]`,
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1 + 2, 4 - 3, 4 * 5]",
+			expectedConstants: []interface{}{1, 2, 4, 3, 4, 5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "{}",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2, 3: 4, 5: 6}",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpHash, 6),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2 + 3, 4: 5 * 6}",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpHash, 4),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let arr = []; arr[0] = 1;",
+			expectedConstants: []interface{}{0, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpIndexAssign),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2, 3][0] = 4",
+			expectedConstants: []interface{}{1, 2, 3, 0, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpIndexAssign),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2}[2] = 4",
+			expectedConstants: []interface{}{1, 2, 2, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpIndexAssign),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestIndexAssignmentExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 2, 3][1 + 1]",
+			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpAdd),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2}[2 - 1]",
+			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { return 5 + 10 }`,
+			expectedConstants: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { 5 + 10 }`,
+			expectedConstants: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { 1; 2 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCompilerScopes(t *testing.T) {
+	compiler := New()
+	if compiler.scopeIndex != 0 {
+		t.Errorf("scopeIndex wrong, want=%d, got=%d", 0, compiler.scopeIndex)
+	}
+
+	globalSymboleTable := compiler.symbolTable
+
+	compiler.emit(code.OpMul)
+
+	compiler.enterScope()
+	if compiler.scopeIndex != 1 {
+		t.Errorf("scopeIndex wrong, want=%d, got=%d", 1, compiler.scopeIndex)
+	}
+
+	compiler.emit(code.OpSub)
+
+	if len(compiler.scopes[compiler.scopeIndex].instuctions) != 1 {
+		t.Errorf("instructions length wrong. want=%d got=%d", 1, len(compiler.scopes[compiler.scopeIndex].instuctions))
+	}
+
+	last := compiler.scopes[compiler.scopeIndex].lastInstruction
+	if last.Opcode != code.OpSub {
+		t.Errorf("wrong last instruction want=%d, got=%d", code.OpSub, last.Opcode)
+	}
+
+	if compiler.symbolTable.Outer != globalSymboleTable {
+		t.Errorf("compiler did not enclose symbolTable")
+	}
+
+	compiler.leaveScope()
+	if compiler.scopeIndex != 0 {
+		t.Errorf("scopeIndex wrong, want=%d, got=%d", 0, compiler.scopeIndex)
+	}
+
+	if compiler.symbolTable != globalSymboleTable {
+		t.Errorf("compiler did not restore global symbole table")
+	}
+
+	if compiler.symbolTable.Outer != nil {
+		t.Errorf("compiler modified global symbol table incorrectly")
+	}
+
+	compiler.emit(code.OpAdd)
+
+	if len(compiler.scopes[compiler.scopeIndex].instuctions) != 2 {
+		t.Errorf("instructions length wrong. want=%d got=%d", 2, len(compiler.scopes[compiler.scopeIndex].instuctions))
+	}
+
+	last = compiler.scopes[compiler.scopeIndex].lastInstruction
+	if last.Opcode != code.OpAdd {
+		t.Errorf("wrong last instruction want=%d, got=%d", code.OpAdd, last.Opcode)
+	}
+
+	previous := compiler.scopes[compiler.scopeIndex].previousInstruction
+	if previous.Opcode != code.OpMul {
+		t.Errorf("wrong previous instruction want=%d, got=%d", code.OpMul, previous.Opcode)
+	}
+
+}
+
+func TestFunctionCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { 24 }();",
+			expectedConstants: []interface{}{24, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let noArg = fn() { 24 };
+			noArg();`,
+			expectedConstants: []interface{}{24, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let fnOneArg = fn(x) { x };
+			fnOneArg(24)`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				24,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let manyArgs = fn(a, b, c) { a; b; c; };
+			manyArgs(20, 21, 22);`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+				20,
+				21,
+				22,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let withDefault = fn(a, b = 10) { b };
+			withDefault(1);`,
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let f = fn(n) { return f(n); };`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `
+			let f = fn(n) { f(n) + 1 };`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `
+			let f = fn(n) { if (n) { f(n) } else { f(n) } };`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 15),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(a) { fn(b) { a + b } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a) { fn(b) { fn(c) { a + b + c } } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
 			},
-		},
-		{
-			input:             "[1, 2, 3][0] = 4",
-			expectedConstants: []interface{}{1, 2, 3, 0, 4},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpIndexAssign),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2}[2] = 4",
-			expectedConstants: []interface{}{1, 2, 2, 4},
+			// a nested function refers to itself through OpCurrentClosure
+			input: `fn() { let f = fn(n) { f(n) }; }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturn),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpIndexAssign),
 				code.Make(code.OpPop),
 			},
 		},
@@ -619,250 +1692,229 @@ func TestIndexExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestIndexAssignmentExpressions(t *testing.T) {
+func TestBlockScopes(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			input:             `if (true) { let x = 1; x }; let y = 2;`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0004
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
-				code.Make(code.OpIndex),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpConstant, 0),
+				// 0013
+				code.Make(code.OpJump, 17),
+				// 0016
+				code.Make(code.OpNull),
+				// 0017
 				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpConstant, 1),
+				// 0021
+				code.Make(code.OpSetGlobal, 1),
 			},
 		},
 		{
-			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			input: `fn() { while (true) { let a = 1; break; } let b = 2; b }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTrue),
+					// 0001
+					code.Make(code.OpJumpNotTruthy, 9),
+					// 0004
+					code.Make(code.OpConstant, 0),
+					// 0007
+					code.Make(code.OpSetLocal, 0),
+					// 0009, where the break jumped to
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 2),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
 	}
 
 	runCompilerTests(t, tests)
+
+	inputs := []string{
+		`if (true) { let x = 1 }; x`,
+		`if (false) { 1 } else { let x = 2 }; x`,
+		`while (false) { let x = 1 } x`,
+		`do { let x = 1 } while (false); x`,
+		`fn() { if (true) { let x = 1 } x }`,
+		`try { 1 / 0 } catch (x) { 0 }; x`,
+		`try { let x = 1 } catch (e) { 0 }; x`,
+		`try { 1 } catch (e) { let x = 2 }; x`,
+		`true ? if (true) { let x = 1; x } : 0; x`,
+		`false ? 0 : if (true) { let x = 1; x }; x`,
+		`true ? try { 1 / 0 } catch (x) { x } : 0; x`,
+		`false ? 0 : try { 1 / 0 } catch (x) { x }; x`,
+	}
+
+	for _, input := range inputs {
+		err := New().Compile(parse(input))
+		if err == nil || err.Error() != "undefined variable x" {
+			t.Errorf("wrong error for %q. got=%v", input, err)
+		}
+	}
 }
 
-func TestFunctions(t *testing.T) {
+func TestConstantPropagation(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: `fn() { return 5 + 10 }`,
+			input: `let limit = 10; let name = "a"; fn(x) { x + limit }; name;`,
 			expectedConstants: []interface{}{
-				5,
 				10,
+				"a",
 				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
 					code.Make(code.OpAdd),
 					code.Make(code.OpReturnValue),
-				}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpPop),
+				},
 			},
-		},
-		{
-			input: `fn() { 5 + 10 }`,
-			expectedConstants: []interface{}{
-				5,
-				10,
-				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
-				}},
 			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `fn() { 1; 2 }`,
+			// an assignment anywhere, even after the use, disqualifies n
+			input: `let n = 1; n; fn() { n = 2 };`,
 			expectedConstants: []interface{}{
 				1,
 				2,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpPop),
 					code.Make(code.OpConstant, 1),
-					code.Make(code.OpReturnValue),
-				}},
+					code.Make(code.OpSetGlobal, 0),
+					code.Make(code.OpReturn),
+				},
+			},
 			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `fn() { }`,
+			// so does one to a local of the same name
+			input: `let n = 1; fn() { let n = 0; n++ }; n;`,
 			expectedConstants: []interface{}{
+				1,
+				0,
+				1,
 				[]code.Instructions{
-					code.Make(code.OpReturn),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpAdd),
+					code.Make(code.OpDup),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpPop),
 			},
 		},
 	}
 
 	runCompilerTests(t, tests)
-}
-
-func TestCompilerScopes(t *testing.T) {
-	compiler := New()
-	if compiler.scopeIndex != 0 {
-		t.Errorf("scopeIndex wrong, want=%d, got=%d", 0, compiler.scopeIndex)
-	}
-
-	globalSymboleTable := compiler.symbolTable
-
-	compiler.emit(code.OpMul)
-
-	compiler.enterScope()
-	if compiler.scopeIndex != 1 {
-		t.Errorf("scopeIndex wrong, want=%d, got=%d", 1, compiler.scopeIndex)
-	}
-
-	compiler.emit(code.OpSub)
-
-	if len(compiler.scopes[compiler.scopeIndex].instuctions) != 1 {
-		t.Errorf("instructions length wrong. want=%d got=%d", 1, len(compiler.scopes[compiler.scopeIndex].instuctions))
-	}
-
-	last := compiler.scopes[compiler.scopeIndex].lastInstruction
-	if last.Opcode != code.OpSub {
-		t.Errorf("wrong last instruction want=%d, got=%d", code.OpSub, last.Opcode)
-	}
 
-	if compiler.symbolTable.Outer != globalSymboleTable {
-		t.Errorf("compiler did not enclose symbolTable")
-	}
-
-	compiler.leaveScope()
-	if compiler.scopeIndex != 0 {
-		t.Errorf("scopeIndex wrong, want=%d, got=%d", 0, compiler.scopeIndex)
-	}
-
-	if compiler.symbolTable != globalSymboleTable {
-		t.Errorf("compiler did not restore global symbole table")
+	// a later program compiled with the same state may assign to n
+	symbolTable := NewSymbolTable()
+	compiler := NewWithState(symbolTable, []object.Object{})
+	err := compiler.Compile(parse(`let n = 1; n;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
 	}
-
-	if compiler.symbolTable.Outer != nil {
-		t.Errorf("compiler modified global symbol table incorrectly")
+	expected := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpPop),
 	}
-
-	compiler.emit(code.OpAdd)
-
-	if len(compiler.scopes[compiler.scopeIndex].instuctions) != 2 {
-		t.Errorf("instructions length wrong. want=%d got=%d", 2, len(compiler.scopes[compiler.scopeIndex].instuctions))
+	err = testInstructions(expected, compiler.Bytecode().Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
 	}
+}
 
-	last = compiler.scopes[compiler.scopeIndex].lastInstruction
-	if last.Opcode != code.OpAdd {
-		t.Errorf("wrong last instruction want=%d, got=%d", code.OpAdd, last.Opcode)
+func TestAssignCapturedVariable(t *testing.T) {
+	inputs := []string{
+		`fn() { let a = 1; fn() { a = 2 } }`,
+		`fn() { let a = 1; fn() { a += 2 } }`,
+		`fn() { let a = 1; fn() { a++ } }`,
 	}
 
-	previous := compiler.scopes[compiler.scopeIndex].previousInstruction
-	if previous.Opcode != code.OpMul {
-		t.Errorf("wrong previous instruction want=%d, got=%d", code.OpMul, previous.Opcode)
+	for _, input := range inputs {
+		err := New().Compile(parse(input))
+		if err == nil || err.Error() != "cannot assign to captured variable a" {
+			t.Errorf("wrong error for %q. got=%v", input, err)
+		}
 	}
-
 }
 
-func TestFunctionCalls(t *testing.T) {
+func TestShadowingBuiltins(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input: "fn() { 24 }();",
-			expectedConstants: []interface{}{24, []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpReturnValue),
-			}},
+			input:             `let len = [5]; len;`,
+			expectedConstants: []interface{}{5},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 0),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input: `
-			let noArg = fn() { 24 };
-			noArg();`,
-			expectedConstants: []interface{}{24, []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `
-			let fnOneArg = fn(x) { x };
-			fnOneArg(24)`,
-			expectedConstants: []interface{}{
-				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpReturnValue),
-				},
-				24,
-			},
+			input:             `let len = 5; len = 6;`,
+			expectedConstants: []interface{}{5, 6},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input: `
-			let manyArgs = fn(a, b, c) { a; b; c; };
-			manyArgs(20, 21, 22);`,
-			expectedConstants: []interface{}{
-				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 1),
-					code.Make(code.OpPop),
-					code.Make(code.OpGetLocal, 2),
-					code.Make(code.OpReturnValue),
-				},
-				20,
-				21,
-				22,
-			},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpCall, 3),
-				code.Make(code.OpPop),
 			},
 		},
 	}
+
 	runCompilerTests(t, tests)
+
+	err := New().Compile(parse(`len = 5`))
+	if err == nil || err.Error() != "cannot assign to builtin len" {
+		t.Errorf("wrong error for assigning to a builtin. got=%v", err)
+	}
 }
 
 func TestBuiltins(t *testing.T) {
@@ -894,8 +1946,8 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpPop),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
@@ -947,6 +1999,11 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			f, ok := actual[i].(*object.Float)
+			if !ok || f.Value != constant {
+				return fmt.Errorf("constant %d - not Float %g: %T (%+v)", i, constant, actual[i], actual[i])
+			}
 		case string:
 			err := testStringObject(string(constant), actual[i])
 			if err != nil {
@@ -0,0 +1,41 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/src/object"
+)
+
+// InstructionsString renders the main instructions, one per line, without
+// those of the compiled functions in the constant pool.
+func (b *Bytecode) InstructionsString() string {
+	return b.Instructions.String()
+}
+
+// Disassemble renders the main instructions followed by the instructions of
+// every compiled function in the constant pool. Functions nested inside other
+// functions live in the same pool, so they get their own section as well.
+func (b *Bytecode) Disassemble() string {
+	var out bytes.Buffer
+
+	out.WriteString("== main ==\n")
+	out.WriteString(b.Instructions.String())
+
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+
+		fmt.Fprintf(&out, "\n== constant %d: fn %s (params=%d, locals=%d) ==\n",
+			i, name, fn.NumParameters, fn.NumLocals)
+		out.WriteString(fn.Instructions.String())
+	}
+
+	return out.String()
+}
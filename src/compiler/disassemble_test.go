@@ -0,0 +1,66 @@
+package compiler
+
+import (
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `
+	let outer = fn(a) {
+		let inner = fn() { 2 };
+		a + inner()
+	};
+	outer(1);
+	`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `== main ==
+0000 OpConstant 2
+0003 OpSetGlobal 0
+0006 OpGetGlobal 0
+0009 OpConstant 3
+0012 OpCall 1
+0014 OpPop
+
+== constant 1: fn inner (params=0, locals=0) ==
+0000 OpConstant 0
+0003 OpReturnValue
+
+== constant 2: fn outer (params=1, locals=2) ==
+0000 OpConstant 1
+0003 OpSetLocal 1
+0005 OpGetLocal 0
+0007 OpGetLocal 1
+0009 OpCall 0
+0011 OpAdd
+0012 OpReturnValue
+`
+
+	actual := compiler.Bytecode().Disassemble()
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot=%q", expected, actual)
+	}
+}
+
+func TestInstructionsString(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("1 + 2"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `0000 OpConstant 0
+0003 OpConstant 1
+0006 OpAdd
+0007 OpPop
+`
+
+	if got := compiler.Bytecode().InstructionsString(); got != expected {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected, got)
+	}
+}
@@ -0,0 +1,161 @@
+package compiler
+
+import "monkey/src/code"
+
+// decodedInstruction is one instruction of a code.Instructions stream.
+type decodedInstruction struct {
+	pos      int
+	op       code.Opcode
+	operands []int
+	width    int // of the operands
+}
+
+func decodeInstructions(ins code.Instructions) ([]decodedInstruction, bool) {
+	decoded := []decodedInstruction{}
+
+	for pos := 0; pos < len(ins); {
+		def, err := code.Lookup(ins[pos])
+		if err != nil {
+			return nil, false
+		}
+
+		operands, width := code.ReadOperands(def, ins[pos+1:])
+		decoded = append(decoded, decodedInstruction{
+			pos:      pos,
+			op:       code.Opcode(ins[pos]),
+			operands: operands,
+			width:    width,
+		})
+		pos += 1 + width
+	}
+
+	return decoded, true
+}
+
+// isJump reports whether op's operand is an offset into the instructions.
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpJumpNotTruthy || op == code.OpSetupTry
+}
+
+// peephole removes instructions that can never run or have no effect:
+//
+//   - anything following an OpJump, OpReturnValue or OpReturn up to the next
+//     instruction something jumps to
+//   - an OpJump to the instruction right after it
+//   - OpNoOp
+//
+// The operands of the remaining jumps are rewritten to match. entries are
+// offsets into ins that execution may start at, such as the entry points of
+// default parameters; they are never removed and are returned updated.
+func peephole(ins code.Instructions, entries []int) (code.Instructions, []int) {
+	decoded, ok := decodeInstructions(ins)
+	if !ok {
+		return ins, entries
+	}
+
+	keep := make([]bool, len(decoded))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	// removing one instruction can make another removable, e.g. a jump over
+	// dead code becomes a jump to the next instruction
+	for changed := true; changed; {
+		changed = false
+
+		targets := make(map[int]bool)
+		for _, e := range entries {
+			targets[e] = true
+		}
+		for i, d := range decoded {
+			if keep[i] && isJump(d.op) {
+				targets[d.operands[0]] = true
+			}
+		}
+
+		reachable := true
+		for i, d := range decoded {
+			if !keep[i] {
+				continue
+			}
+			if targets[d.pos] {
+				reachable = true
+			}
+			if !reachable {
+				keep[i] = false
+				changed = true
+				continue
+			}
+
+			switch d.op {
+			case code.OpNoOp:
+				keep[i] = false
+				changed = true
+				continue
+
+			case code.OpJump:
+				target := d.operands[0]
+				if target >= d.pos+1+d.width && target <= nextKeptPos(decoded, keep, i, len(ins)) {
+					keep[i] = false
+					changed = true
+					continue
+				}
+				reachable = false
+
+			case code.OpReturnValue, code.OpReturn:
+				reachable = false
+			}
+		}
+	}
+
+	// newPos maps every old offset to the new offset of the first kept
+	// instruction at or after it
+	newPos := make([]int, len(ins)+1)
+	size := 0
+	for i, d := range decoded {
+		if keep[i] {
+			size += 1 + d.width
+		}
+	}
+	newPos[len(ins)] = size
+	next := size
+	for i := len(decoded) - 1; i >= 0; i-- {
+		d := decoded[i]
+		if keep[i] {
+			next -= 1 + d.width
+		}
+		for p := d.pos; p < d.pos+1+d.width; p++ {
+			newPos[p] = next
+		}
+	}
+
+	optimized := make(code.Instructions, 0, size)
+	for i, d := range decoded {
+		if !keep[i] {
+			continue
+		}
+		if isJump(d.op) {
+			optimized = append(optimized, code.Make(d.op, newPos[d.operands[0]])...)
+			continue
+		}
+		optimized = append(optimized, ins[d.pos:d.pos+1+d.width]...)
+	}
+
+	var newEntries []int
+	for _, e := range entries {
+		newEntries = append(newEntries, newPos[e])
+	}
+
+	return optimized, newEntries
+}
+
+// nextKeptPos returns the offset of the first kept instruction after the i-th
+// one, or end if there is none.
+func nextKeptPos(decoded []decodedInstruction, keep []bool, i, end int) int {
+	for j := i + 1; j < len(decoded); j++ {
+		if keep[j] {
+			return decoded[j].pos
+		}
+	}
+	return end
+}
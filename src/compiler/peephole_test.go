@@ -0,0 +1,170 @@
+package compiler
+
+import (
+	"testing"
+
+	"monkey/src/code"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name            string
+		input           []code.Instructions
+		entries         []int
+		expected        []code.Instructions
+		expectedEntries []int
+	}{
+		{
+			name: "jump to next instruction",
+			input: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJump, 4),
+				// 0004
+				code.Make(code.OpPop),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			name: "no-ops are removed",
+			input: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 6),
+				// 0004
+				code.Make(code.OpNoOp),
+				// 0005
+				code.Make(code.OpNoOp),
+				// 0006
+				code.Make(code.OpNull),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 4),
+				code.Make(code.OpNull),
+			},
+		},
+		{
+			name: "unreachable code after return",
+			input: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpReturnValue),
+				// 0004
+				code.Make(code.OpConstant, 1),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpReturn),
+			},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			},
+		},
+		{
+			name: "jump targets are shifted",
+			input: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0004
+				code.Make(code.OpJump, 7),
+				// 0007
+				code.Make(code.OpConstant, 0),
+				// 0010
+				code.Make(code.OpPop),
+				// 0011
+				code.Make(code.OpJump, 0),
+				// 0014
+				code.Make(code.OpNull),
+			},
+			expected: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpNull),
+			},
+		},
+		{
+			name: "entries are kept and shifted",
+			input: []code.Instructions{
+				// 0000
+				code.Make(code.OpJump, 3),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpReturnValue),
+				// 0007
+				code.Make(code.OpConstant, 1),
+				// 0010
+				code.Make(code.OpReturnValue),
+			},
+			entries: []int{3, 7},
+			expected: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpReturnValue),
+			},
+			expectedEntries: []int{0, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		got, entries := peephole(concatInstructions(tt.input), tt.entries)
+
+		err := testInstructions(tt.expected, got)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+
+		if len(entries) != len(tt.expectedEntries) {
+			t.Errorf("%s: wrong entries. want=%v, got=%v", tt.name, tt.expectedEntries, entries)
+			continue
+		}
+		for i, e := range tt.expectedEntries {
+			if entries[i] != e {
+				t.Errorf("%s: wrong entries. want=%v, got=%v", tt.name, tt.expectedEntries, entries)
+				break
+			}
+		}
+	}
+}
+
+func TestPeepholeShrinksFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { return 1; 2 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
@@ -0,0 +1,253 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"monkey/src/code"
+	"monkey/src/object"
+)
+
+// BytecodeVersion is bumped whenever the serialized layout changes.
+const BytecodeVersion uint16 = 5
+
+var bytecodeMagic = [4]byte{'M', 'N', 'K', 'Y'}
+
+// constant tags used in the serialized constant pool
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagBoolean
+	tagCompiledFunction
+	tagFloat
+	tagChar
+)
+
+// Marshal writes b to w as:
+//
+//	magic "MNKY" | version uint16 | instructions | constants
+//
+// Instructions are a uint32 length followed by the raw bytes; constants are a
+// uint32 count followed by one tagged entry per constant. All integers are
+// big endian.
+func (b *Bytecode) Marshal(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	e.write(bytecodeMagic)
+	e.write(BytecodeVersion)
+	e.writeBytes(b.Instructions)
+
+	e.write(uint32(len(b.Constants)))
+	for _, c := range b.Constants {
+		e.writeConstant(c)
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+
+	return e.w.Flush()
+}
+
+// LoadBytecode reads bytecode previously written by Marshal.
+func LoadBytecode(r io.Reader) (*Bytecode, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	var magic [4]byte
+	d.read(&magic)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if magic != bytecodeMagic {
+		return nil, fmt.Errorf("invalid bytecode: bad magic %q", magic[:])
+	}
+
+	var version uint16
+	d.read(&version)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version: got=%d, want=%d", version, BytecodeVersion)
+	}
+
+	instructions := d.readBytes()
+
+	var count uint32
+	d.read(&count)
+
+	constants := []object.Object{}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		constants = append(constants, d.readConstant())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return &Bytecode{Instructions: instructions, Constants: constants}, nil
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) write(v interface{}) {
+	if e.err != nil {
+		return
+	}
+	e.err = binary.Write(e.w, binary.BigEndian, v)
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.write(uint32(len(b)))
+	e.write(b)
+}
+
+func (e *encoder) writeConstant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.write(tagInteger)
+		e.write(obj.Value)
+
+	case *object.Float:
+		e.write(tagFloat)
+		e.write(obj.Value)
+
+	case *object.Char:
+		e.write(tagChar)
+		e.write(obj.Value)
+
+	case *object.String:
+		e.write(tagString)
+		e.writeBytes([]byte(obj.Value))
+
+	case *object.Boolean:
+		e.write(tagBoolean)
+		e.write(obj.Value)
+
+	case *object.CompiledFunction:
+		e.write(tagCompiledFunction)
+		e.write(uint32(obj.NumLocals))
+		e.write(uint32(obj.NumParameters))
+		e.write(obj.Variadic)
+		e.write(obj.Generator)
+		e.write(uint32(len(obj.DefaultEntries)))
+		for _, entry := range obj.DefaultEntries {
+			e.write(uint32(entry))
+		}
+		e.writeBytes([]byte(obj.Name))
+		e.writeBytes(obj.Instructions)
+
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("cannot serialize constant of type %s", obj.Type())
+		}
+	}
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) read(v interface{}) {
+	if d.err != nil {
+		return
+	}
+	err := binary.Read(d.r, binary.BigEndian, v)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = err
+}
+
+// readBytes reads a length followed by that many bytes. The length is not
+// trusted: the buffer only grows as the bytes actually arrive.
+func (d *decoder) readBytes() []byte {
+	var n uint32
+	d.read(&n)
+	if d.err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, d.r, int64(n))
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+func (d *decoder) readConstant() object.Object {
+	var tag byte
+	d.read(&tag)
+	if d.err != nil {
+		return nil
+	}
+
+	switch tag {
+	case tagInteger:
+		var v int64
+		d.read(&v)
+		return &object.Integer{Value: v}
+
+	case tagFloat:
+		var v float64
+		d.read(&v)
+		return &object.Float{Value: v}
+
+	case tagChar:
+		var v rune
+		d.read(&v)
+		return &object.Char{Value: v}
+
+	case tagString:
+		return &object.String{Value: string(d.readBytes())}
+
+	case tagBoolean:
+		var v bool
+		d.read(&v)
+		return object.NativeBoolToBooleanObject(v)
+
+	case tagCompiledFunction:
+		var numLocals, numParameters uint32
+		d.read(&numLocals)
+		d.read(&numParameters)
+		var variadic, generator bool
+		d.read(&variadic)
+		d.read(&generator)
+		var numEntries uint32
+		d.read(&numEntries)
+		// there is an entry per number of arguments that may be passed
+		if d.err == nil && uint64(numEntries) > uint64(numParameters)+1 {
+			d.err = fmt.Errorf("invalid bytecode: %d default entries for %d parameters", numEntries, numParameters)
+		}
+		var defaultEntries []int
+		for i := uint32(0); i < numEntries && d.err == nil; i++ {
+			var entry uint32
+			d.read(&entry)
+			defaultEntries = append(defaultEntries, int(entry))
+		}
+		name := d.readBytes()
+		instructions := d.readBytes()
+		return &object.CompiledFunction{
+			Instructions:   code.Instructions(instructions),
+			NumLocals:      int(numLocals),
+			NumParameters:  int(numParameters),
+			Variadic:       variadic,
+			Name:           string(name),
+			DefaultEntries: defaultEntries,
+			Generator:      generator,
+		}
+
+	default:
+		d.err = fmt.Errorf("invalid bytecode: unknown constant tag %d", tag)
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"monkey/src/code"
+	"monkey/src/object"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBytecodeMarshalRoundTrip(t *testing.T) {
+	input := `
+	let greeting = "hello";
+	let add = fn(a, b) { let c = a + b; c };
+	let all = fn(rest...) { rest };
+	let inc = fn(x, by = 1) { x + by };
+	let gen = fn() { yield 1; };
+	add(1, 2) + 30000000000;
+	2.5 * 4;
+	'x';
+	`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+	bytecode.Constants = append(bytecode.Constants, &object.Boolean{Value: true})
+
+	var buf bytes.Buffer
+	err = bytecode.Marshal(&buf)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	loaded, err := LoadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("load error: %s", err)
+	}
+
+	if !bytes.Equal(loaded.Instructions, bytecode.Instructions) {
+		t.Fatalf("wrong instructions.\nwant=%q\ngot=%q", bytecode.Instructions, loaded.Instructions)
+	}
+
+	if len(loaded.Constants) != len(bytecode.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(bytecode.Constants), len(loaded.Constants))
+	}
+
+	for i, want := range bytecode.Constants {
+		got := loaded.Constants[i]
+		if got.Type() != want.Type() {
+			t.Fatalf("constant %d has wrong type. want=%s, got=%s", i, want.Type(), got.Type())
+		}
+
+		switch want := want.(type) {
+		case *object.CompiledFunction:
+			fn := got.(*object.CompiledFunction)
+			if fn.Variadic != want.Variadic {
+				t.Errorf("constant %d has wrong variadic flag. want=%t, got=%t", i, want.Variadic, fn.Variadic)
+			}
+			if fn.Generator != want.Generator {
+				t.Errorf("constant %d has wrong generator flag. want=%t, got=%t", i, want.Generator, fn.Generator)
+			}
+			if fmt.Sprint(fn.DefaultEntries) != fmt.Sprint(want.DefaultEntries) {
+				t.Errorf("constant %d has wrong default entries. want=%v, got=%v", i, want.DefaultEntries, fn.DefaultEntries)
+			}
+			if fn.Name != want.Name {
+				t.Errorf("constant %d has wrong name. want=%q, got=%q", i, want.Name, fn.Name)
+			}
+			if fn.NumLocals != want.NumLocals || fn.NumParameters != want.NumParameters {
+				t.Errorf("constant %d has wrong locals/parameters. want=%d/%d, got=%d/%d",
+					i, want.NumLocals, want.NumParameters, fn.NumLocals, fn.NumParameters)
+			}
+			err := testInstructions([]code.Instructions{want.Instructions}, fn.Instructions)
+			if err != nil {
+				t.Errorf("constant %d: %s", i, err)
+			}
+		default:
+			if got.Inspect() != want.Inspect() {
+				t.Errorf("constant %d has wrong value. want=%s, got=%s", i, want.Inspect(), got.Inspect())
+			}
+		}
+	}
+}
+
+func TestLoadBytecodeRejectsVersionMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(bytecodeMagic[:])
+	binary.Write(&buf, binary.BigEndian, BytecodeVersion+1)
+
+	_, err := LoadBytecode(&buf)
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+
+	if !strings.Contains(err.Error(), "unsupported bytecode version") {
+		t.Errorf("wrong error. got=%q", err)
+	}
+}
+
+func TestLoadBytecodeRejectsInvalidInput(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte("JUNK\x00\x01"), "invalid bytecode: bad magic"},
+		{[]byte("MNKY"), "unexpected EOF"},
+		{withHeader("\x00\x00\x00\x05\x00"), "unexpected EOF"},
+		{withHeader("\x00\x00\x00\x00\x00\x00\x00\x01\x09"), "unknown constant tag 9"},
+		{withHeader("\xff\xff\xff\xff"), "unexpected EOF"},
+		// a function of one parameter with three default entries
+		{withHeader("\x00\x00\x00\x00\x00\x00\x00\x01\x04\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00\x00\x00\x03"),
+			"3 default entries for 1 parameters"},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadBytecode(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Fatalf("expected error for %q but got none", tt.input)
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestLoadBytecodeDoesNotTrustLengths(t *testing.T) {
+	// claims 4 GiB of instructions, but ends right there
+	input := withHeader("\xff\xff\xff\xff")
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := LoadBytecode(bytes.NewReader(input))
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d byte input", allocated, len(input))
+	}
+}
+
+// withHeader prefixes body with the magic and the current bytecode version.
+func withHeader(body string) []byte {
+	var buf bytes.Buffer
+	buf.Write(bytecodeMagic[:])
+	binary.Write(&buf, binary.BigEndian, BytecodeVersion)
+	buf.WriteString(body)
+	return buf.Bytes()
+}
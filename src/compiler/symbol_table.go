@@ -6,6 +6,11 @@ const (
 	GlobalScope  SymbolScope = "GLOBAL"
 	LocalScope   SymbolScope = "LOCAL"
 	BuiltinScope SymbolScope = "BUILTIN"
+	// FreeScope symbols are locals of an enclosing function, captured by
+	// the closure being compiled.
+	FreeScope SymbolScope = "FREE"
+	// FunctionScope is the scope of a function's own name inside its body.
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
@@ -19,6 +24,16 @@ type SymbolTable struct {
 	numDefinitions int
 
 	Outer *SymbolTable
+
+	// FreeSymbols are the outer symbols captured by this table's function,
+	// as resolved in the outer table, in the order of their FreeScope
+	// indexes.
+	FreeSymbols []Symbol
+
+	// block tables hold the names defined in a block, such as the body of
+	// an if or a loop. Their variables take slots from the enclosing
+	// function, or the globals, but are only visible inside the block.
+	block bool
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -32,26 +47,76 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// NewBlockSymbolTable returns a table for a block inside outer's scope.
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+// Define adds name to st. A name defined by the program always wins over a
+// builtin of the same name: the builtin is shadowed in st and, through
+// Resolve, in every table enclosed by it, while outer tables are unaffected.
+// Assigning to a builtin that has not been shadowed is an error.
 func (st *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Scope: GlobalScope, Index: st.numDefinitions}
-	if st.Outer != nil {
+	owner := st
+	for owner.block {
+		owner = owner.Outer
+	}
+
+	symbol := Symbol{Name: name, Scope: GlobalScope, Index: owner.numDefinitions}
+	if owner.Outer != nil {
 		symbol.Scope = LocalScope
 	}
 	st.store[name] = symbol
-	st.numDefinitions++
+	owner.numDefinitions++
 	return symbol
 }
 
+// DefineBuiltin makes name refer to the builtin at index. It never replaces
+// a name already defined by the program, so shadowing does not depend on
+// whether the builtins were defined before or after it.
 func (st *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
+	if existing, ok := st.store[name]; ok && existing.Scope != BuiltinScope {
+		return existing
+	}
 	st.store[name] = symbol
 	return symbol
 }
 
+// DefineFunctionName makes name refer to the function whose body st is the
+// table of, so that the function can call itself.
+func (st *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Scope: FunctionScope, Index: 0}
+	st.store[name] = symbol
+	return symbol
+}
+
+func (st *SymbolTable) defineFree(original Symbol) Symbol {
+	st.FreeSymbols = append(st.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(st.FreeSymbols) - 1}
+	st.store[original.Name] = symbol
+	return symbol
+}
+
+// Resolve looks name up in st and its outer tables. A local of an enclosing
+// function is captured: it is added to FreeSymbols and resolves to a
+// FreeScope symbol from then on.
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	symbol, ok := st.store[name]
-	if !ok && st.Outer != nil {
+	if ok || st.Outer == nil {
+		return symbol, ok
+	}
+	// a block is part of the function it is in, so nothing is captured
+	if st.block {
 		return st.Outer.Resolve(name)
 	}
-	return symbol, ok
+
+	symbol, ok = st.Outer.Resolve(name)
+	if !ok || symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol, ok
+	}
+	return st.defineFree(symbol), true
 }
@@ -147,6 +147,74 @@ func TestResolveNestedLocal(t *testing.T) {
 	}
 }
 
+func TestResolveFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+	local.Define("c")
+
+	secondLocal := NewEnclosedSymbolTable(local)
+	secondLocal.Define("d")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "c", Scope: FreeScope, Index: 0},
+		{Name: "b", Scope: FreeScope, Index: 1},
+		{Name: "d", Scope: LocalScope, Index: 0},
+		{Name: "c", Scope: FreeScope, Index: 0},
+	}
+
+	for _, sym := range expected {
+		result, ok := secondLocal.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	wantFree := []Symbol{
+		{Name: "c", Scope: LocalScope, Index: 1},
+		{Name: "b", Scope: LocalScope, Index: 0},
+	}
+	if len(secondLocal.FreeSymbols) != len(wantFree) {
+		t.Fatalf("wrong number of free symbols. want=%d, got=%d", len(wantFree), len(secondLocal.FreeSymbols))
+	}
+	for i, sym := range wantFree {
+		if secondLocal.FreeSymbols[i] != sym {
+			t.Errorf("wrong free symbol %d. want=%+v, got=%+v", i, sym, secondLocal.FreeSymbols[i])
+		}
+	}
+
+	if _, ok := secondLocal.Resolve("e"); ok {
+		t.Errorf("undefined name e resolved")
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+	local.DefineFunctionName("f")
+
+	want := Symbol{Name: "f", Scope: FunctionScope, Index: 0}
+	result, ok := local.Resolve("f")
+	if !ok || result != want {
+		t.Errorf("expected f to resolve to %+v, got=%+v", want, result)
+	}
+
+	// a parameter of the same name shadows the function
+	local.Define("f")
+	want = Symbol{Name: "f", Scope: LocalScope, Index: 0}
+	result, _ = local.Resolve("f")
+	if result != want {
+		t.Errorf("expected f to resolve to %+v, got=%+v", want, result)
+	}
+}
+
 func TestDefineResolveBuiltins(t *testing.T) {
 	global := NewSymbolTable()
 
@@ -178,3 +246,87 @@ func TestDefineResolveBuiltins(t *testing.T) {
 		}
 	}
 }
+
+func TestDefineShadowsBuiltin(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	localLen := local.Define("len")
+
+	shadowed := global.Define("len")
+	expected := Symbol{Name: "len", Scope: GlobalScope, Index: 1}
+	if shadowed != expected {
+		t.Fatalf("expected len to be defined as %+v, got=%+v", expected, shadowed)
+	}
+
+	// Defining the builtins again, as a fresh session would, must not undo
+	// the program's definition.
+	global.DefineBuiltin(0, "len")
+
+	tests := []struct {
+		table    *SymbolTable
+		expected Symbol
+	}{
+		{global, expected},
+		{NewEnclosedSymbolTable(global), expected},
+		{local, localLen},
+	}
+
+	for _, tt := range tests {
+		result, ok := tt.table.Resolve("len")
+		if !ok {
+			t.Fatalf("name len not resolvable")
+		}
+		if result != tt.expected {
+			t.Errorf("expected len to resolve to %+v, got=%+v", tt.expected, result)
+		}
+	}
+}
+
+func TestBlockSymbolTables(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	block := NewBlockSymbolTable(global)
+	b := block.Define("b")
+	want := Symbol{Name: "b", Scope: GlobalScope, Index: 1}
+	if b != want {
+		t.Errorf("expected b to be %+v, got=%+v", want, b)
+	}
+
+	// the block's slot is not reused by the enclosing scope
+	c := global.Define("c")
+	want = Symbol{Name: "c", Scope: GlobalScope, Index: 2}
+	if c != want {
+		t.Errorf("expected c to be %+v, got=%+v", want, c)
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("name b resolvable outside of its block")
+	}
+	if _, ok := block.Resolve("a"); !ok {
+		t.Errorf("name a not resolvable inside a block")
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("d")
+	localBlock := NewBlockSymbolTable(NewBlockSymbolTable(local))
+	e := localBlock.Define("e")
+	want = Symbol{Name: "e", Scope: LocalScope, Index: 1}
+	if e != want {
+		t.Errorf("expected e to be %+v, got=%+v", want, e)
+	}
+	if local.numDefinitions != 2 {
+		t.Errorf("wrong number of locals. want=2, got=%d", local.numDefinitions)
+	}
+
+	// a block's locals belong to its function, so using one in the block
+	// captures nothing
+	d, _ := localBlock.Resolve("d")
+	want = Symbol{Name: "d", Scope: LocalScope, Index: 0}
+	if d != want || len(local.FreeSymbols) != 0 {
+		t.Errorf("expected d to resolve to %+v without capture, got=%+v", want, d)
+	}
+}
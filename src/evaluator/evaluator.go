@@ -9,9 +9,9 @@ import (
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.Object {
@@ -20,9 +20,30 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 
 		return &object.Integer{Value: node.Value}
 
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+
+	case *ast.CharLiteral:
+		return &object.Char{Value: node.Value}
+
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
+	case *ast.TemplateLiteral:
+		var out strings.Builder
+		for _, part := range node.Parts {
+			value := Eval(part, env, buffer)
+			if isError(value) {
+				return value
+			}
+			if s, ok := value.(*object.String); ok {
+				out.WriteString(s.Value)
+			} else {
+				out.WriteString(value.Inspect())
+			}
+		}
+		return &object.String{Value: out.String()}
+
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 
@@ -33,11 +54,20 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 		}
 		return evalPrefixExpression(node.Operator, right)
 
+	case *ast.NullLiteral:
+		return NULL
+
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env, buffer)
 		if isError(left) {
 			return left
 		}
+		if node.Operator == "??" {
+			if left != NULL {
+				return left
+			}
+			return Eval(node.Right, env, buffer)
+		}
 		right := Eval(node.Right, env, buffer)
 		if isError(right) {
 			return right
@@ -59,10 +89,22 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 
 	case *ast.IfExpression:
 		return evalIfExpression(node, env, buffer)
+	case *ast.TernaryExpression:
+		condition := Eval(node.Condition, env, buffer)
+		if isError(condition) {
+			return condition
+		}
+		if isTruthy(condition) {
+			return Eval(node.Consequence, env, buffer)
+		}
+		return Eval(node.Alternative, env, buffer)
 
 	case *ast.ExpressionStatement:
 		return Eval(node.Expression, env, buffer)
 
+	case *ast.PostfixExpression:
+		return evalPostfixExpression(node, env, buffer)
+
 	case *ast.LetStatement:
 		val := Eval(node.Value, env, buffer)
 		if isError(val) {
@@ -70,6 +112,13 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 		}
 		env.Set(node.Name.Value, val)
 
+	case *ast.DestructuringLetStatement:
+		val := Eval(node.Value, env, buffer)
+		if isError(val) {
+			return val
+		}
+		return evalDestructuring(node, val, env)
+
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 
@@ -117,6 +166,17 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 			return val
 		}
 
+		if op := compoundOperator(node.Operator); op != "" {
+			current, ok := env.Get(node.Variable.Value)
+			if !ok {
+				return newError("identifier not found: " + node.Variable.Value)
+			}
+			val = evalInfixExpression(op, current, val)
+			if isError(val) {
+				return val
+			}
+		}
+
 		ok := env.UpdateValue(node.Variable.Value, val)
 		if !ok {
 			return newError("invalid assignment to non declared identifier %s", node.Variable.Value)
@@ -135,6 +195,17 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 
 		left := Eval(node.Index.Left, env, buffer)
 
+		if op := compoundOperator(node.Operator); op != "" {
+			current := evalIndexExpression(left, index)
+			if isError(current) {
+				return current
+			}
+			val = evalInfixExpression(op, current, val)
+			if isError(val) {
+				return val
+			}
+		}
+
 		return evalIndexAssignmentExpression(left, index, val)
 
 	case *ast.ForStatement:
@@ -167,7 +238,7 @@ func Eval(node ast.Node, env *object.Environment, buffer *bytes.Buffer) object.O
 
 		case iterator.Type() == object.HASH_OBJ:
 			pairs := iterator.(*object.Hash)
-			for _, v := range pairs.Pairs {
+			for _, v := range pairs.OrderedPairs() {
 				forEnv.Set(node.Index.Value, v.Key)
 				forEnv.Set(node.Value.Value, v.Value)
 
@@ -195,7 +266,7 @@ func applyFunction(fn object.Object, args []object.Object, buffer *bytes.Buffer)
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
 		if fn.Name == "puts" {
-			var put object.BuiltinFunction = func(args ...object.Object) object.Object {
+			put := func(args ...object.Object) object.Object {
 				values := []string{}
 				for _, arg := range args {
 					values = append(values, arg.Inspect())
@@ -210,10 +281,27 @@ func applyFunction(fn object.Object, args []object.Object, buffer *bytes.Buffer)
 			}
 			return NULL
 		}
-		if result := fn.Fn(args...); result != nil {
+		host := object.NewHost()
+		host.Out = buffer
+		host.Call = func(fn object.Object, args ...object.Object) (object.Object, error) {
+			return applyFunction(fn, args, buffer), nil
+		}
+		if result := fn.Fn(host, args...); result != nil {
 			return result
 		}
 		return NULL
+	case *object.Memoized:
+		key := fn.CacheKey(args)
+		if result, ok := fn.Cache[key]; ok {
+			return result
+		}
+		result := applyFunction(fn.Fn, args, buffer)
+		if !isError(result) {
+			fn.Cache[key] = result
+		}
+		return result
+	case *object.Partial:
+		return applyFunction(fn.Fn, append(fn.Args[:len(fn.Args):len(fn.Args)], args...), buffer)
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
@@ -388,6 +476,10 @@ func evalIntegerInfixExpression(operator string, left object.Object, right objec
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -407,6 +499,10 @@ func evalStringInfixExpression(operator string, left object.Object, right object
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -438,6 +534,15 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	}
 }
 
+// compoundOperator returns the infix operator of a compound assignment such
+// as "+=", or "" for a plain assignment.
+func compoundOperator(assignment string) string {
+	if len(assignment) == 2 && assignment[1] == '=' {
+		return assignment[:1]
+	}
+	return ""
+}
+
 func evalIndexAssignmentExpression(left, index, value object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
@@ -468,30 +573,29 @@ func evalArrayIndexAssignmentExpression(left, index, value object.Object) object
 }
 
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment, buffer *bytes.Buffer) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
+	hash := object.NewHash(len(node.Keys))
 
-	for keyNode, valueNode := range node.Pairs {
+	for _, keyNode := range node.Keys {
 		key := Eval(keyNode, env, buffer)
 		if isError(key) {
 			return key
 		}
 
-		hashKey, ok := key.(object.Hashable)
+		hashKey, ok := object.KeyFor(key)
 		if !ok {
 			return newError("unusable as hask key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env, buffer)
+		value := Eval(node.Pairs[keyNode], env, buffer)
 		if isError(value) {
 			return value
 		}
 
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashKey, object.HashPair{Key: key, Value: value})
 
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
 
 func evalArrayIndexExpression(array, index object.Object) object.Object {
@@ -509,11 +613,11 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 
 func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
-	key, ok := index.(object.Hashable)
+	key, ok := object.KeyFor(index)
 	if !ok {
 		return newError("unusable as hash key: %s", index.Type())
 	}
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
 		return NULL
 	}
@@ -523,18 +627,39 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 
 func evalHashIndexAssignmnetExpression(hash, index, val object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
-	key, ok := index.(object.Hashable)
+	key, ok := object.KeyFor(index)
 	if !ok {
 		return newError("unusable as hash key: %s", index.Type())
 	}
-	hashObject.Pairs[key.HashKey()] = object.HashPair{
+	hashObject.Set(key, object.HashPair{
 		Key:   index,
 		Value: val,
-	}
+	})
 
 	return NULL
 }
 
+func evalDestructuring(node *ast.DestructuringLetStatement, val object.Object, env *object.Environment) object.Object {
+	array, ok := val.(*object.Array)
+	if !ok {
+		return newError("cannot destructure %s", val.Type())
+	}
+	if len(array.Elements) < len(node.Names) {
+		return newError("not enough elements to destructure: want at least %d got %d", len(node.Names), len(array.Elements))
+	}
+
+	for i, name := range node.Names {
+		env.Set(name.Value, array.Elements[i])
+	}
+	if node.Rest != nil {
+		rest := make([]object.Object, len(array.Elements)-len(node.Names))
+		copy(rest, array.Elements[len(node.Names):])
+		env.Set(node.Rest.Value, &object.Array{Elements: rest})
+	}
+
+	return nil
+}
+
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
@@ -546,3 +671,43 @@ func isError(obj object.Object) bool {
 
 	return false
 }
+
+func evalPostfixExpression(node *ast.PostfixExpression, env *object.Environment, buffer *bytes.Buffer) object.Object {
+	op := node.Operator[:1]
+	one := &object.Integer{Value: 1}
+
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		current, ok := env.Get(target.Value)
+		if !ok {
+			return newError("identifier not found: " + target.Value)
+		}
+		val := evalInfixExpression(op, current, one)
+		if isError(val) {
+			return val
+		}
+		env.UpdateValue(target.Value, val)
+		return val
+
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env, buffer)
+		if isError(left) {
+			return left
+		}
+		index := Eval(target.Index, env, buffer)
+		if isError(index) {
+			return index
+		}
+		current := evalIndexExpression(left, index)
+		if isError(current) {
+			return current
+		}
+		val := evalInfixExpression(op, current, one)
+		if isError(val) {
+			return val
+		}
+		return evalIndexAssignmentExpression(left, index, val)
+	}
+
+	return newError("cannot apply %s to %s", node.Operator, node.Target.String())
+}
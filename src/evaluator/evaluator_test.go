@@ -64,6 +64,8 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"1 < 10", true},
 		{"-1 < 0", true},
 		{"-10 < -2", true},
+		{"2 <= 2", true},
+		{"3 >= 4", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"34 == 35", false},
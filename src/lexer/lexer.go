@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"monkey/src/token"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 )
 
 type Lexer struct {
@@ -21,7 +23,9 @@ func New(input string) *Lexer {
 }
 
 func (l *Lexer) trimComments() {
-	regex := regexp.MustCompile(`//.*|/\*[\s\S]*?\*/|("(\\.|[^"])*")`)
+	// strings, chars and templates are matched as a whole so that comment
+	// markers inside them are kept
+	regex := regexp.MustCompile(`//.*|/\*[\s\S]*?\*/|("(\\.|[^"])*"|'(\\.|[^'\\])*'|` + "`(\\\\.|[^`\\\\])*`)")
 	l.input = regex.ReplaceAllString(l.input, "$1")
 }
 
@@ -51,11 +55,21 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '-' {
+			l.readChar()
+			tok = token.Token{Type: token.DECREMENT, Literal: "--"}
+		} else {
+			tok = l.newOperatorToken(token.MINUS, token.MINUS_ASSIGN)
+		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			l.readChar()
+			tok = token.Token{Type: token.POWER, Literal: "**"}
+		} else {
+			tok = l.newOperatorToken(token.ASTERISK, token.ASTERISK_ASSIGN)
+		}
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.newOperatorToken(token.SLASH, token.SLASH_ASSIGN)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -65,9 +79,21 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case '(':
@@ -77,7 +103,12 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == '+' {
+			l.readChar()
+			tok = token.Token{Type: token.INCREMENT, Literal: "++"}
+		} else {
+			tok = l.newOperatorToken(token.PLUS, token.PLUS_ASSIGN)
+		}
 	case '{':
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
@@ -85,23 +116,57 @@ func (l *Lexer) NextToken() token.Token {
 	case '"':
 		tok.Type = token.STRING
 		tok.Literal = l.readString()
+	case '`':
+		tok = l.readTemplate()
+	case '\'':
+		tok = l.readCharLiteral()
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
 		tok = newToken(token.RBRACKET, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '?':
+		if l.peekChar() == '?' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.NULLISH, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.QUESTION, l.ch)
+		}
+	case '.':
+		if l.peekChar() == '.' && l.peekCharAt(1) == '.' {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
-		if isLetter(l.ch) {
+		if l.ch == '_' && isDigit(l.peekChar()) {
+			// a digit separator can't lead a number
+			position := l.position
+			l.readChar()
+			l.readNumber()
+			tok.Literal = l.input[position:l.position]
+			tok.Type = token.ILLEGAL
+			return tok
+		} else if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Literal = l.readNumber()
 			tok.Type = token.INT
+			if strings.Contains(tok.Literal, ".") {
+				tok.Type = token.FLOAT
+			}
+			if !validDigitSeparators(tok.Literal) {
+				tok.Type = token.ILLEGAL
+			}
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -112,6 +177,18 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
+// newOperatorToken returns a token of type assign when the current character
+// is followed by "=", as in "+=", and of type op otherwise.
+func (l *Lexer) newOperatorToken(op, assign token.TokenType) token.Token {
+	if l.peekChar() != '=' {
+		return newToken(op, l.ch)
+	}
+
+	ch := l.ch
+	l.readChar()
+	return token.Token{Type: assign, Literal: string(ch) + string(l.ch)}
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{
 		Type:    tokenType,
@@ -121,7 +198,8 @@ func newToken(tokenType token.TokenType, ch byte) token.Token {
 
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) {
+	// digits may follow the first letter, as in add5
+	for isLetter(l.ch) || isDigit(l.ch) {
 		l.readChar()
 	}
 	return l.input[position:l.position]
@@ -129,12 +207,51 @@ func (l *Lexer) readIdentifier() string {
 
 func (l *Lexer) readNumber() string {
 	position := l.position
-	for isDigit(l.ch) {
+
+	if l.ch == '0' && isBasePrefix(l.peekChar()) {
+		// read every letter and digit, so that malformed literals like 0xZZ
+		// end up in a single token the parser can reject
+		l.readChar()
+		l.readChar()
+		for isLetter(l.ch) || isDigit(l.ch) {
+			l.readChar()
+		}
+		return l.input[position:l.position]
+	}
+
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+
+	// a fraction needs a digit after the dot, so "1..." stays an integer
+	// followed by an ellipsis
+	if l.ch == '.' && isDigit(l.peekChar()) {
 		l.readChar()
+		for isDigit(l.ch) || l.ch == '_' {
+			l.readChar()
+		}
 	}
+
 	return l.input[position:l.position]
 }
 
+// validDigitSeparators reports whether every underscore in the number literal
+// sits between two digits.
+func validDigitSeparators(literal string) bool {
+	return !strings.HasSuffix(literal, "_") && !strings.Contains(literal, "__") &&
+		!strings.Contains(literal, "_.")
+}
+
+// isBasePrefix reports whether ch, following a leading 0, starts a
+// hexadecimal, octal or binary literal.
+func isBasePrefix(ch byte) bool {
+	switch ch {
+	case 'x', 'X', 'o', 'O', 'b', 'B':
+		return true
+	}
+	return false
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
@@ -149,6 +266,14 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
+// peekCharAt looks n characters past the one peekChar returns.
+func (l *Lexer) peekCharAt(n int) byte {
+	if l.readPosition+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.readPosition+n]
+}
+
 func (l *Lexer) readString() string {
 	position := l.position + 1
 	for {
@@ -179,7 +304,7 @@ func (l *Lexer) readString() string {
 			out.WriteByte(byte('"'))
 			skipNext = true
 		} else {
-			out.WriteByte(byte(ch))
+			out.WriteRune(ch)
 		}
 	}
 
@@ -187,6 +312,89 @@ func (l *Lexer) readString() string {
 
 }
 
+// readTemplate reads a template literal up to its closing backtick. The
+// contents are kept raw, escapes and ${...} included, for the parser to split
+// into text and expressions.
+func (l *Lexer) readTemplate() token.Token {
+	start := l.position
+	depth := 0 // of braces inside ${...}
+
+	for {
+		l.readChar()
+		switch {
+		case l.ch == 0:
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start:]}
+		case l.ch == '\\':
+			l.readChar()
+			if l.ch == 0 {
+				return token.Token{Type: token.ILLEGAL, Literal: l.input[start:]}
+			}
+		case l.ch == '$' && l.peekChar() == '{':
+			l.readChar()
+			depth++
+		case l.ch == '{' && depth > 0:
+			depth++
+		case l.ch == '}' && depth > 0:
+			depth--
+		case l.ch == '"' && depth > 0:
+			// a string in an embedded expression may hold braces
+			l.readString()
+		case l.ch == '`' && depth == 0:
+			return token.Token{Type: token.TEMPLATE, Literal: l.input[start+1 : l.position]}
+		}
+	}
+}
+
+var charEscapes = map[byte]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'\\': '\\',
+	'\'': '\'',
+}
+
+// readCharLiteral reads a character literal such as 'a' or '\n'. The token's
+// literal is the character itself; anything but a single, possibly escaped,
+// character between the quotes makes an ILLEGAL token.
+func (l *Lexer) readCharLiteral() token.Token {
+	position := l.position
+	l.readChar()
+
+	illegal := func() token.Token {
+		end := l.readPosition
+		if end > len(l.input) {
+			end = len(l.input)
+		}
+		return token.Token{Type: token.ILLEGAL, Literal: l.input[position:end]}
+	}
+
+	var value []byte
+	for l.ch != '\'' {
+		if l.ch == 0 || l.ch == '\n' {
+			return illegal()
+		}
+
+		if l.ch == '\\' {
+			l.readChar()
+			escaped, ok := charEscapes[l.ch]
+			if !ok {
+				return illegal()
+			}
+			value = utf8.AppendRune(value, escaped)
+		} else {
+			value = append(value, l.ch)
+		}
+		l.readChar()
+	}
+
+	if utf8.RuneCount(value) != 1 || !utf8.Valid(value) {
+		return illegal()
+	}
+
+	return token.Token{Type: token.CHAR, Literal: string(value)}
+}
+
 func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
@@ -33,6 +33,20 @@ if (5 < 10) {
 [1, 2];
 {"foo": "bar"}
 for i, v in arr
+while (x) {}
+1 <= 2 >= 3
+rest...
+0x1F 0o17 0b1010 0xZZ
+1_000 _1 100_ 1__0
+a ?? b ? null : c
++= -= *= /=
+3.75 1_000.5 1...
+"héllo ☃"
+'a' '\n' 'é' 'ab' '"' // 'x'
+add5 x_1
+i++ i--
+2 ** 3 *= 4
+` + "`a ${b + \"}\"} \\` c`" + `
 `
 
 	tests := []struct {
@@ -132,6 +146,60 @@ for i, v in arr
 		{token.IDENT, "v"},
 		{token.IN, "in"},
 		{token.IDENT, "arr"},
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.INT, "1"},
+		{token.LT_EQ, "<="},
+		{token.INT, "2"},
+		{token.GT_EQ, ">="},
+		{token.INT, "3"},
+		{token.IDENT, "rest"},
+		{token.ELLIPSIS, "..."},
+		{token.INT, "0x1F"},
+		{token.INT, "0o17"},
+		{token.INT, "0b1010"},
+		{token.INT, "0xZZ"},
+		{token.INT, "1_000"},
+		{token.ILLEGAL, "_1"},
+		{token.ILLEGAL, "100_"},
+		{token.ILLEGAL, "1__0"},
+		{token.IDENT, "a"},
+		{token.NULLISH, "??"},
+		{token.IDENT, "b"},
+		{token.QUESTION, "?"},
+		{token.NULL, "null"},
+		{token.COLON, ":"},
+		{token.IDENT, "c"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.MINUS_ASSIGN, "-="},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.SLASH_ASSIGN, "/="},
+		{token.FLOAT, "3.75"},
+		{token.FLOAT, "1_000.5"},
+		{token.INT, "1"},
+		{token.ELLIPSIS, "..."},
+		{token.STRING, "héllo ☃"},
+		{token.CHAR, "a"},
+		{token.CHAR, "\n"},
+		{token.CHAR, "é"},
+		{token.ILLEGAL, "'ab'"},
+		{token.CHAR, "\""},
+		{token.IDENT, "add5"},
+		{token.IDENT, "x_1"},
+		{token.IDENT, "i"},
+		{token.INCREMENT, "++"},
+		{token.IDENT, "i"},
+		{token.DECREMENT, "--"},
+		{token.INT, "2"},
+		{token.POWER, "**"},
+		{token.INT, "3"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "4"},
+		{token.TEMPLATE, "a ${b + \"}\"} \\` c"},
 		{token.EOF, ""},
 	}
 
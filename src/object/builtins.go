@@ -1,6 +1,13 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
 
 var Builtins = []struct {
 	Name    string
@@ -10,34 +17,46 @@ var Builtins = []struct {
 		"len",
 		&Builtin{
 			Name: "len",
-			Fn: func(args ...Object) Object {
+			Fn: func(h *Host, args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments to `len`. got=%d, want=1", len(args))
+					return newError(ArgumentError, "wrong number of arguments to `len`. got=%d, want=1", len(args))
 				}
 
 				switch arg := args[0].(type) {
 				case *String:
-					return &Integer{Value: int64(len(arg.Value))}
+					return NewInteger(int64(len(arg.Value)))
 				case *Array:
-					return &Integer{Value: int64(len(arg.Elements))}
+					return NewInteger(int64(len(arg.Elements)))
 				case *Hash:
-					return &Integer{Value: int64(len(arg.Pairs))}
+					return NewInteger(int64(len(arg.Pairs)))
 				default:
-					return newError("argument to `len` not supported, got=%s", args[0].Type())
+					return newError(TypeError, "argument to `len` not supported, got=%s", args[0].Type())
 				}
 			},
 		},
 	},
+	{
+		"puts",
+		&Builtin{
+			Name: "puts",
+			Fn: func(h *Host, args ...Object) Object {
+				for _, arg := range args {
+					fmt.Fprintln(h.Out, arg.Inspect())
+				}
+
+				return nil
+			},
+		}},
 	{"first",
 		&Builtin{
 			Name: "first",
-			Fn: func(args ...Object) Object {
+			Fn: func(h *Host, args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments to `len`. got=%d, want=1", len(args))
+					return newError(ArgumentError, "wrong number of arguments to `len`. got=%d, want=1", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJ {
-					return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
+					return newError(TypeError, "argument to `first` must be ARRAY, got %s", args[0].Type())
 				}
 
 				arr := args[0].(*Array)
@@ -52,13 +71,13 @@ var Builtins = []struct {
 		"last",
 		&Builtin{
 			Name: "last",
-			Fn: func(args ...Object) Object {
+			Fn: func(h *Host, args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments to `len`. got=%d, want=1", len(args))
+					return newError(ArgumentError, "wrong number of arguments to `len`. got=%d, want=1", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJ {
-					return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+					return newError(TypeError, "argument to `last` must be ARRAY, got %s", args[0].Type())
 				}
 
 				arr := args[0].(*Array)
@@ -73,13 +92,13 @@ var Builtins = []struct {
 		"rest",
 		&Builtin{
 			Name: "rest",
-			Fn: func(args ...Object) Object {
+			Fn: func(h *Host, args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments to `len`. got=%d, want=1", len(args))
+					return newError(ArgumentError, "wrong number of arguments to `len`. got=%d, want=1", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJ {
-					return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+					return newError(TypeError, "argument to `rest` must be ARRAY, got %s", args[0].Type())
 				}
 
 				arr := args[0].(*Array)
@@ -96,53 +115,65 @@ var Builtins = []struct {
 		"push",
 		&Builtin{
 			Name: "push",
-			Fn: func(args ...Object) Object {
+			Fn: func(h *Host, args ...Object) Object {
 				if len(args) != 2 {
-					return newError("wrong number of arguments to `len`. got=%d, want=2", len(args))
+					return newError(ArgumentError, "wrong number of arguments to `push`. got=%d, want=2", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJ {
-					return newError("first argument to `push` must be ARRAY, got %s", args[0].Type())
+					return newError(TypeError, "first argument to `push` must be ARRAY, got %s", args[0].Type())
 				}
 
+				// copy rather than append, so the result never shares its
+				// backing array with arr or with other pushes onto arr
 				arr := args[0].(*Array)
-				return &Array{
-					Elements: append(arr.Elements, args[1]),
+				if err := h.CheckArrayLength(int64(len(arr.Elements)) + 1); err != nil {
+					return err
 				}
+				elements := make([]Object, len(arr.Elements)+1)
+				copy(elements, arr.Elements)
+				elements[len(arr.Elements)] = args[1]
 
-			},
-		}}, {
-		"puts",
-		&Builtin{
-			Name: "puts",
-			Fn: func(args ...Object) Object {
-				for _, arg := range args {
-					fmt.Println(arg.Inspect())
+				return &Array{
+					Elements: elements,
 				}
 
-				return nil
 			},
 		}},
 	{
 		"range",
 		&Builtin{
 			Name: "range",
-			Fn: func(args ...Object) Object {
-				if len(args) != 2 {
-					return newError("wrong number of arguments to `range`. got=%d, want=2", len(args))
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 && len(args) != 3 {
+					return newError(ArgumentError, "wrong number of arguments to `range`. got=%d, want=2 or 3", len(args))
 				}
 
-				if args[0].Type() != INTEGER_OBJ || args[1].Type() != INTEGER_OBJ {
-					return newError("arg must be INTEGERS")
+				for _, arg := range args {
+					if arg.Type() != INTEGER_OBJ {
+						return newError(TypeError, "arg must be INTEGERS")
+					}
 				}
 
 				start := args[0].(*Integer).Value
 				end := args[1].(*Integer).Value
+				step := int64(1)
+				if len(args) == 3 {
+					step = args[2].(*Integer).Value
+				}
+				if step == 0 {
+					return newError(ArgumentError, "step of `range` must not be zero")
+				}
+
+				length := rangeLength(start, end, step)
+				if err := h.CheckArrayLength(length); err != nil {
+					return err
+				}
 
-				arr := make([]Object, end-start)
+				arr := make([]Object, length)
 
 				for i := range arr {
-					arr[i] = &Integer{Value: start + int64(i)}
+					arr[i] = NewInteger(start + int64(i)*step)
 				}
 
 				return &Array{
@@ -151,10 +182,1506 @@ var Builtins = []struct {
 			},
 		},
 	},
+	{
+		"parse_json",
+		&Builtin{
+			Name: "parse_json",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `parse_json`. got=%d, want=1", len(args))
+				}
+
+				str, ok := args[0].(*String)
+				if !ok {
+					return newError(TypeError, "argument to `parse_json` must be STRING, got %s", args[0].Type())
+				}
+
+				obj, err := FromJSON([]byte(str.Value))
+				if err != nil {
+					return newError(ArgumentError, "invalid JSON: %s", err)
+				}
+
+				return obj
+			},
+		},
+	},
+	{
+		"sum",
+		&Builtin{
+			Name: "sum",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `sum`. got=%d, want=1", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "argument to `sum` must be ARRAY, got %s", args[0].Type())
+				}
+
+				// the total stays an integer until the first float
+				var total int64
+				var floatTotal float64
+				isFloat := false
+				for i, el := range arr.Elements {
+					switch el := el.(type) {
+					case *Integer:
+						if isFloat {
+							floatTotal += float64(el.Value)
+							break
+						}
+						var ok bool
+						total, ok = checkedAdd(total, el.Value)
+						if !ok {
+							return newError(RuntimeError, "integer overflow: `sum` at index %d", i)
+						}
+					case *Float:
+						if !isFloat {
+							floatTotal = float64(total)
+							isFloat = true
+						}
+						floatTotal += el.Value
+					default:
+						return newError(TypeError, "`sum` cannot add %s", el.Type())
+					}
+				}
+
+				if isFloat {
+					return &Float{Value: floatTotal}
+				}
+				return NewInteger(total)
+			},
+		},
+	},
+	{
+		"index_of",
+		&Builtin{
+			Name: "index_of",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `index_of`. got=%d, want=2", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "first argument to `index_of` must be ARRAY, got %s", args[0].Type())
+				}
+
+				for i, el := range arr.Elements {
+					if Equal(el, args[1]) {
+						return NewInteger(int64(i))
+					}
+				}
+
+				return NewInteger(-1)
+			},
+		},
+	},
+	{
+		"slice",
+		&Builtin{
+			Name: "slice",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 3 {
+					return newError(ArgumentError, "wrong number of arguments to `slice`. got=%d, want=3", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "first argument to `slice` must be ARRAY, got %s", args[0].Type())
+				}
+
+				start, ok := args[1].(*Integer)
+				if !ok {
+					return newError(TypeError, "start of `slice` must be INTEGER, got %s", args[1].Type())
+				}
+				end, ok := args[2].(*Integer)
+				if !ok {
+					return newError(TypeError, "end of `slice` must be INTEGER, got %s", args[2].Type())
+				}
+
+				length := len(arr.Elements)
+				from := clampIndex(start.Value, length)
+				to := clampIndex(end.Value, length)
+				if to < from {
+					to = from
+				}
+
+				elements := make([]Object, to-from)
+				copy(elements, arr.Elements[from:to])
+
+				return &Array{Elements: elements}
+			},
+		},
+	},
+	{
+		"clone",
+		&Builtin{
+			Name: "clone",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `clone`. got=%d, want=1", len(args))
+				}
+
+				return deepClone(args[0])
+			},
+		},
+	},
+	{
+		"input",
+		&Builtin{
+			Name: "input",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) > 1 {
+					return newError(ArgumentError, "wrong number of arguments to `input`. got=%d, want=0 or 1", len(args))
+				}
+
+				if len(args) == 1 {
+					prompt, ok := args[0].(*String)
+					if !ok {
+						return newError(TypeError, "argument to `input` must be STRING, got %s", args[0].Type())
+					}
+					fmt.Fprint(h.Out, prompt.Value)
+				}
+
+				line, err := readLine(h.In)
+				if err != nil {
+					return NULL
+				}
+
+				return &String{Value: line}
+			},
+		},
+	},
+	{
+		"now",
+		&Builtin{
+			Name: "now",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 0 {
+					return newError(ArgumentError, "wrong number of arguments to `now`. got=%d, want=0", len(args))
+				}
+
+				return NewInteger(h.Now().UnixMilli())
+			},
+		},
+	},
+	{
+		"rand",
+		&Builtin{
+			Name: "rand",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `rand`. got=%d, want=1", len(args))
+				}
+
+				n, ok := args[0].(*Integer)
+				if !ok {
+					return newError(TypeError, "argument to `rand` must be INTEGER, got %s", args[0].Type())
+				}
+				if n.Value <= 0 {
+					return newError(ArgumentError, "argument to `rand` must be positive, got %d", n.Value)
+				}
+
+				return NewInteger(h.Rand.Int63n(n.Value))
+			},
+		},
+	},
+	{
+		"seed",
+		&Builtin{
+			Name: "seed",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `seed`. got=%d, want=1", len(args))
+				}
+
+				s, ok := args[0].(*Integer)
+				if !ok {
+					return newError(TypeError, "argument to `seed` must be INTEGER, got %s", args[0].Type())
+				}
+
+				h.Rand.Seed(s.Value)
+				return nil
+			},
+		},
+	},
+	{
+		"assert",
+		&Builtin{
+			Name: "assert",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 && len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `assert`. got=%d, want=1 or 2", len(args))
+				}
+
+				message := "assertion failed"
+				if len(args) == 2 {
+					msg, ok := args[1].(*String)
+					if !ok {
+						return newError(TypeError, "message of `assert` must be STRING, got %s", args[1].Type())
+					}
+					message += ": " + msg.Value
+				}
+
+				if IsTruthy(args[0]) {
+					return nil
+				}
+
+				err := newError(AssertionError, "%s", message)
+				err.Fatal = true
+				return err
+			},
+		},
+	},
+	{
+		"hash_each",
+		&Builtin{
+			Name: "hash_each",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `hash_each`. got=%d, want=2", len(args))
+				}
+
+				hash, ok := args[0].(*Hash)
+				if !ok {
+					return newError(TypeError, "first argument to `hash_each` must be HASH, got %s", args[0].Type())
+				}
+				if !isCallable(args[1]) {
+					return newError(TypeError, "second argument to `hash_each` must be a function, got %s", args[1].Type())
+				}
+
+				for _, pair := range hash.OrderedPairs() {
+					result := call(h, args[1], pair.Key, pair.Value)
+					if _, ok := result.(*Error); ok {
+						return result
+					}
+				}
+
+				return nil
+			},
+		},
+	},
+	{
+		"each",
+		&Builtin{
+			Name: "each",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `each`. got=%d, want=2", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "first argument to `each` must be ARRAY, got %s", args[0].Type())
+				}
+				if !isCallable(args[1]) {
+					return newError(TypeError, "second argument to `each` must be a function, got %s", args[1].Type())
+				}
+
+				for _, el := range arr.Elements {
+					result := call(h, args[1], el)
+					if _, ok := result.(*Error); ok {
+						return result
+					}
+				}
+
+				return nil
+			},
+		},
+	},
+	{
+		"pow",
+		&Builtin{
+			Name: "pow",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `pow`. got=%d, want=2", len(args))
+				}
+
+				base, ok := args[0].(*Integer)
+				if !ok {
+					return newError(TypeError, "first argument to `pow` must be INTEGER, got %s", args[0].Type())
+				}
+				exp, ok := args[1].(*Integer)
+				if !ok {
+					return newError(TypeError, "second argument to `pow` must be INTEGER, got %s", args[1].Type())
+				}
+
+				if exp.Value < 0 {
+					return &Float{Value: math.Pow(float64(base.Value), float64(exp.Value))}
+				}
+
+				result, ok := CheckedPow(base.Value, exp.Value)
+				if !ok {
+					return newError(RuntimeError, "integer overflow: %d ** %d", base.Value, exp.Value)
+				}
+				return NewInteger(result)
+			},
+		},
+	},
+	{
+		"sqrt",
+		&Builtin{
+			Name: "sqrt",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `sqrt`. got=%d, want=1", len(args))
+				}
+
+				x, ok := ToFloat(args[0])
+				if !ok {
+					return newError(TypeError, "argument to `sqrt` must be INTEGER or FLOAT, got %s", args[0].Type())
+				}
+				if x < 0 {
+					return newError(ArgumentError, "argument to `sqrt` must not be negative, got %s", args[0].Inspect())
+				}
+
+				return &Float{Value: math.Sqrt(x)}
+			},
+		},
+	},
+	{
+		"floor",
+		&Builtin{
+			Name: "floor",
+			Fn:   roundingBuiltin("floor", math.Floor),
+		},
+	},
+	{
+		"ceil",
+		&Builtin{
+			Name: "ceil",
+			Fn:   roundingBuiltin("ceil", math.Ceil),
+		},
+	},
+	{
+		"round",
+		&Builtin{
+			Name: "round",
+			Fn:   roundingBuiltin("round", math.Round),
+		},
+	},
+	{
+		"ord",
+		&Builtin{
+			Name: "ord",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `ord`. got=%d, want=1", len(args))
+				}
+
+				if c, ok := args[0].(*Char); ok {
+					return NewInteger(int64(c.Value))
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError(TypeError, "argument to `ord` must be STRING or CHAR, got %s", args[0].Type())
+				}
+
+				// only a single character is accepted, so that ord never
+				// silently ignores the rest of its input
+				if utf8.RuneCountInString(s.Value) != 1 {
+					return newError(ArgumentError, "argument to `ord` must be a single character, got %q", s.Value)
+				}
+
+				r, _ := utf8.DecodeRuneInString(s.Value)
+				return NewInteger(int64(r))
+			},
+		},
+	},
+	{
+		"chr",
+		&Builtin{
+			Name: "chr",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `chr`. got=%d, want=1", len(args))
+				}
+
+				n, ok := args[0].(*Integer)
+				if !ok {
+					return newError(TypeError, "argument to `chr` must be INTEGER, got %s", args[0].Type())
+				}
+
+				if n.Value < 0 || n.Value > utf8.MaxRune || !utf8.ValidRune(rune(n.Value)) {
+					return newError(ArgumentError, "argument to `chr` is not a valid code point: %d", n.Value)
+				}
+
+				return &String{Value: string(rune(n.Value))}
+			},
+		},
+	},
+	{
+		"starts_with",
+		&Builtin{
+			Name: "starts_with",
+			Fn:   stringPredicateBuiltin("starts_with", strings.HasPrefix),
+		},
+	},
+	{
+		"ends_with",
+		&Builtin{
+			Name: "ends_with",
+			Fn:   stringPredicateBuiltin("ends_with", strings.HasSuffix),
+		},
+	},
+	{
+		"contains_str",
+		&Builtin{
+			Name: "contains_str",
+			Fn:   stringPredicateBuiltin("contains_str", strings.Contains),
+		},
+	},
+	{
+		"zip",
+		&Builtin{
+			Name: "zip",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `zip`. got=%d, want=2", len(args))
+				}
+
+				a, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "first argument to `zip` must be ARRAY, got %s", args[0].Type())
+				}
+				b, ok := args[1].(*Array)
+				if !ok {
+					return newError(TypeError, "second argument to `zip` must be ARRAY, got %s", args[1].Type())
+				}
+
+				length := len(a.Elements)
+				if len(b.Elements) < length {
+					length = len(b.Elements)
+				}
+
+				pairs := make([]Object, length)
+				for i := range pairs {
+					pairs[i] = &Array{Elements: []Object{a.Elements[i], b.Elements[i]}}
+				}
+
+				return &Array{Elements: pairs}
+			},
+		},
+	},
+	{
+		"unique",
+		&Builtin{
+			Name: "unique",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `unique`. got=%d, want=1", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "argument to `unique` must be ARRAY, got %s", args[0].Type())
+				}
+
+				// hashable elements are looked up by key, the others are
+				// compared with everything kept so far. A hashable element
+				// can still equal an unhashable one kept earlier, as 1
+				// equals 1.0, so those are checked too.
+				seen := make(map[HashKey]bool)
+				unkeyed := []Object{}
+				result := []Object{}
+				for _, el := range arr.Elements {
+					if key, ok := KeyFor(el); ok {
+						if !seen[key] && !containsEqual(unkeyed, el) {
+							seen[key] = true
+							result = append(result, el)
+						}
+						continue
+					}
+
+					if !containsEqual(result, el) {
+						unkeyed = append(unkeyed, el)
+						result = append(result, el)
+					}
+				}
+
+				return &Array{Elements: result}
+			},
+		},
+	},
+	{
+		"merge",
+		&Builtin{
+			Name: "merge",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `merge`. got=%d, want=2", len(args))
+				}
+
+				a, ok := args[0].(*Hash)
+				if !ok {
+					return newError(TypeError, "first argument to `merge` must be HASH, got %s", args[0].Type())
+				}
+				b, ok := args[1].(*Hash)
+				if !ok {
+					return newError(TypeError, "second argument to `merge` must be HASH, got %s", args[1].Type())
+				}
+
+				// keys of b that a already has keep their place in a
+				merged := NewHash(len(a.Pairs) + len(b.Pairs))
+				for _, k := range a.Order {
+					merged.Set(k, a.Pairs[k])
+				}
+				for _, k := range b.Order {
+					merged.Set(k, b.Pairs[k])
+				}
+
+				return merged
+			},
+		},
+	},
+	{
+		"next",
+		&Builtin{
+			Name: "next",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `next`. got=%d, want=1", len(args))
+				}
+
+				gen, ok := args[0].(*Generator)
+				if !ok {
+					return newError(TypeError, "argument to `next` must be GENERATOR, got %s", args[0].Type())
+				}
+				if h.Resume == nil {
+					return newError(RuntimeError, "generators are not supported here")
+				}
+
+				result, err := h.Resume(gen)
+				if err != nil {
+					return fatal(err)
+				}
+				return result
+			},
+		},
+	},
+	{
+		"str",
+		&Builtin{
+			Name: "str",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `str`. got=%d, want=1", len(args))
+				}
+
+				if s, ok := args[0].(*String); ok {
+					return s
+				}
+				return &String{Value: args[0].Inspect()}
+			},
+		},
+	},
+	{
+		"count",
+		&Builtin{
+			Name: "count",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `count`. got=%d, want=2", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "first argument to `count` must be ARRAY, got %s", args[0].Type())
+				}
+
+				// a function is always used as a predicate, never compared
+				// with the elements
+				n := 0
+				for _, el := range arr.Elements {
+					if !isCallable(args[1]) {
+						if Equal(el, args[1]) {
+							n++
+						}
+						continue
+					}
+
+					match, err := callPredicate(h, args[1], el)
+					if err != nil {
+						return err
+					}
+					if match {
+						n++
+					}
+				}
+
+				return NewInteger(int64(n))
+			},
+		},
+	},
+	{
+		"take",
+		&Builtin{
+			Name: "take",
+			Fn: func(h *Host, args ...Object) Object {
+				arr, n, err := arrayAndCount("take", args)
+				if err != nil {
+					return err
+				}
+
+				taken := make([]Object, n)
+				copy(taken, arr.Elements)
+				return &Array{Elements: taken}
+			},
+		},
+	},
+	{
+		"drop",
+		&Builtin{
+			Name: "drop",
+			Fn: func(h *Host, args ...Object) Object {
+				arr, n, err := arrayAndCount("drop", args)
+				if err != nil {
+					return err
+				}
+
+				rest := make([]Object, len(arr.Elements)-n)
+				copy(rest, arr.Elements[n:])
+				return &Array{Elements: rest}
+			},
+		},
+	},
+	{
+		"defined",
+		&Builtin{
+			Name: "defined",
+			Fn: func(h *Host, args ...Object) Object {
+				// calls with a string literal never get here, the compiler
+				// answers them
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `defined`. got=%d, want=1", len(args))
+				}
+				return newError(ArgumentError, "argument to `defined` must be a string literal")
+			},
+		},
+	},
+	{
+		"memoize",
+		&Builtin{
+			Name: "memoize",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `memoize`. got=%d, want=1", len(args))
+				}
+				if !isCallable(args[0]) {
+					return newError(TypeError, "argument to `memoize` must be a function, got %s", args[0].Type())
+				}
+
+				return &Memoized{Fn: args[0], Cache: map[string]Object{}}
+			},
+		},
+	},
+	{
+		"bind",
+		&Builtin{
+			Name: "bind",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) < 1 {
+					return newError(ArgumentError, "wrong number of arguments to `bind`. got=%d, want at least 1", len(args))
+				}
+				if !isCallable(args[0]) {
+					return newError(TypeError, "first argument to `bind` must be a function, got %s", args[0].Type())
+				}
+
+				bound := make([]Object, len(args)-1)
+				copy(bound, args[1:])
+				return &Partial{Fn: args[0], Args: bound}
+			},
+		},
+	},
+	{
+		"print",
+		&Builtin{
+			Name: "print",
+			Fn: func(h *Host, args ...Object) Object {
+				// unlike puts, print leaves line breaks to the caller
+				values := make([]string, len(args))
+				for i, arg := range args {
+					values[i] = arg.Inspect()
+				}
+				fmt.Fprint(h.Out, strings.Join(values, " "))
+
+				return nil
+			},
+		},
+	},
+	{
+		"entries",
+		&Builtin{
+			Name: "entries",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `entries`. got=%d, want=1", len(args))
+				}
+
+				hash, ok := args[0].(*Hash)
+				if !ok {
+					return newError(TypeError, "argument to `entries` must be HASH, got %s", args[0].Type())
+				}
+
+				entries := make([]Object, len(hash.Order))
+				for i, pair := range hash.OrderedPairs() {
+					entries[i] = &Array{Elements: []Object{pair.Key, pair.Value}}
+				}
+
+				return &Array{Elements: entries}
+			},
+		},
+	},
+	{
+		"from_entries",
+		&Builtin{
+			Name: "from_entries",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `from_entries`. got=%d, want=1", len(args))
+				}
+
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "argument to `from_entries` must be ARRAY, got %s", args[0].Type())
+				}
+
+				// later entries overwrite earlier ones with the same key
+				hash := NewHash(len(arr.Elements))
+				for i, el := range arr.Elements {
+					entry, ok := el.(*Array)
+					if !ok || len(entry.Elements) != 2 {
+						return newError(TypeError, "element %d of `from_entries` must be a [key, value] ARRAY, got %s", i, el.Inspect())
+					}
+
+					key := entry.Elements[0]
+					hashKey, ok := KeyFor(key)
+					if !ok {
+						return newError(TypeError, "%w: %s", ErrUnhashable, key.Type())
+					}
+					hash.Set(hashKey, HashPair{Key: key, Value: entry.Elements[1]})
+				}
+
+				return hash
+			},
+		},
+	},
+	{
+		"any",
+		&Builtin{
+			Name: "any",
+			Fn:   quantifierBuiltin("any", true),
+		},
+	},
+	{
+		"all",
+		&Builtin{
+			Name: "all",
+			Fn:   quantifierBuiltin("all", false),
+		},
+	},
+	{
+		"pp",
+		&Builtin{
+			Name: "pp",
+			Fn: func(h *Host, args ...Object) Object {
+				for _, arg := range args {
+					fmt.Fprintln(h.Out, InspectPretty(arg, "  "))
+				}
+
+				return nil
+			},
+		},
+	},
+	{
+		"heap",
+		&Builtin{
+			Name: "heap",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) > 1 {
+					return newError(ArgumentError, "wrong number of arguments to `heap`. got=%d, want=0 or 1", len(args))
+				}
+
+				if len(args) == 0 {
+					return &Heap{}
+				}
+				if !isCallable(args[0]) {
+					return newError(TypeError, "argument to `heap` must be a function, got %s", args[0].Type())
+				}
+				return &Heap{Less: args[0]}
+			},
+		},
+	},
+	{
+		"heap_push",
+		&Builtin{
+			Name: "heap_push",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `heap_push`. got=%d, want=2", len(args))
+				}
+
+				hp, ok := args[0].(*Heap)
+				if !ok {
+					return newError(TypeError, "first argument to `heap_push` must be HEAP, got %s", args[0].Type())
+				}
+				if err := hp.Push(h, args[1]); err != nil {
+					return err
+				}
+
+				return nil
+			},
+		},
+	},
+	{
+		"heap_pop",
+		&Builtin{
+			Name: "heap_pop",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `heap_pop`. got=%d, want=1", len(args))
+				}
+
+				hp, ok := args[0].(*Heap)
+				if !ok {
+					return newError(TypeError, "argument to `heap_pop` must be HEAP, got %s", args[0].Type())
+				}
+				top, err := hp.Pop(h)
+				if err != nil {
+					return err
+				}
+
+				return top
+			},
+		},
+	},
+	{
+		"heap_len",
+		&Builtin{
+			Name: "heap_len",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `heap_len`. got=%d, want=1", len(args))
+				}
+
+				hp, ok := args[0].(*Heap)
+				if !ok {
+					return newError(TypeError, "argument to `heap_len` must be HEAP, got %s", args[0].Type())
+				}
+
+				return NewInteger(int64(len(hp.Elements)))
+			},
+		},
+	},
+	{
+		"set",
+		&Builtin{
+			Name: "set",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) > 1 {
+					return newError(ArgumentError, "wrong number of arguments to `set`. got=%d, want=0 or 1", len(args))
+				}
+
+				if len(args) == 0 {
+					return NewSet(0)
+				}
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError(TypeError, "argument to `set` must be ARRAY, got %s", args[0].Type())
+				}
+
+				s := NewSet(len(arr.Elements))
+				for _, el := range arr.Elements {
+					if err := s.Add(el); err != nil {
+						return err
+					}
+				}
+				return s
+			},
+		},
+	},
+	{
+		"set_add",
+		&Builtin{
+			Name: "set_add",
+			Fn: func(h *Host, args ...Object) Object {
+				s, el, err := setAndElement("set_add", args)
+				if err != nil {
+					return err
+				}
+				if err := s.Add(el); err != nil {
+					return err
+				}
+
+				return nil
+			},
+		},
+	},
+	{
+		"set_has",
+		&Builtin{
+			Name: "set_has",
+			Fn: func(h *Host, args ...Object) Object {
+				s, el, err := setAndElement("set_has", args)
+				if err != nil {
+					return err
+				}
+
+				return NativeBoolToBooleanObject(s.Has(el))
+			},
+		},
+	},
+	{
+		"set_remove",
+		&Builtin{
+			Name: "set_remove",
+			Fn: func(h *Host, args ...Object) Object {
+				s, el, err := setAndElement("set_remove", args)
+				if err != nil {
+					return err
+				}
+
+				return NativeBoolToBooleanObject(s.Remove(el))
+			},
+		},
+	},
+	{
+		"set_len",
+		&Builtin{
+			Name: "set_len",
+			Fn: func(h *Host, args ...Object) Object {
+				s, err := setArgument("set_len", args)
+				if err != nil {
+					return err
+				}
+
+				return NewInteger(int64(len(s.Order)))
+			},
+		},
+	},
+	{
+		"set_to_array",
+		&Builtin{
+			Name: "set_to_array",
+			Fn: func(h *Host, args ...Object) Object {
+				s, err := setArgument("set_to_array", args)
+				if err != nil {
+					return err
+				}
+
+				return &Array{Elements: s.Ordered()}
+			},
+		},
+	},
+	{
+		"size",
+		&Builtin{
+			Name: "size",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 1 {
+					return newError(ArgumentError, "wrong number of arguments to `size`. got=%d, want=1", len(args))
+				}
+
+				// like len for what len takes; otherwise the number of
+				// elements, digits or parameters
+				switch arg := args[0].(type) {
+				case *String:
+					return NewInteger(int64(len(arg.Value)))
+				case *Array:
+					return NewInteger(int64(len(arg.Elements)))
+				case *Hash:
+					return NewInteger(int64(len(arg.Pairs)))
+				case *Set:
+					return NewInteger(int64(len(arg.Order)))
+				case *Heap:
+					return NewInteger(int64(len(arg.Elements)))
+				case *Integer:
+					return NewInteger(int64(len(strconv.FormatUint(absInt64(arg.Value), 10))))
+				case *CompiledFunction:
+					return NewInteger(int64(arg.NumParameters))
+				case *Closure:
+					return NewInteger(int64(arg.Fn.NumParameters))
+				default:
+					return newError(TypeError, "argument to `size` not supported, got=%s", args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		"to_base",
+		&Builtin{
+			Name: "to_base",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `to_base`. got=%d, want=2", len(args))
+				}
+
+				n, ok := args[0].(*Integer)
+				if !ok {
+					return newError(TypeError, "first argument to `to_base` must be INTEGER, got %s", args[0].Type())
+				}
+				base, err := baseArgument("to_base", args[1])
+				if err != nil {
+					return err
+				}
+
+				return &String{Value: strconv.FormatInt(n.Value, base)}
+			},
+		},
+	},
+	{
+		"from_base",
+		&Builtin{
+			Name: "from_base",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `from_base`. got=%d, want=2", len(args))
+				}
+
+				s, ok := args[0].(*String)
+				if !ok {
+					return newError(TypeError, "first argument to `from_base` must be STRING, got %s", args[0].Type())
+				}
+				base, err := baseArgument("from_base", args[1])
+				if err != nil {
+					return err
+				}
+
+				n, parseErr := strconv.ParseInt(s.Value, base, 64)
+				if parseErr != nil {
+					return newError(ArgumentError, "invalid base %d integer %q", base, s.Value)
+				}
+
+				return NewInteger(n)
+			},
+		},
+	},
+	{
+		"builtins",
+		&Builtin{
+			Name: "builtins",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 0 {
+					return newError(ArgumentError, "wrong number of arguments to `builtins`. got=%d, want=0", len(args))
+				}
+
+				names := make([]Object, len(builtinNames))
+				for i, name := range builtinNames {
+					names[i] = &String{Value: name}
+				}
+				return &Array{Elements: names}
+			},
+		},
+	},
+	{
+		"equals",
+		&Builtin{
+			Name: "equals",
+			Fn: func(h *Host, args ...Object) Object {
+				if len(args) != 2 {
+					return newError(ArgumentError, "wrong number of arguments to `equals`. got=%d, want=2", len(args))
+				}
+
+				return NativeBoolToBooleanObject(Equal(args[0], args[1]))
+			},
+		},
+	},
+}
+
+// builtinNames lists the names in Builtins, in order, for the builtins
+// builtin. It is filled in by init because Builtins cannot refer to itself.
+var builtinNames []string
+
+func init() {
+	for _, b := range Builtins {
+		builtinNames = append(builtinNames, b.Name)
+	}
+}
+
+// arrayAndCount checks the (array, n) arguments of take and drop. A negative
+// n is an error; one larger than the array is clamped to its length.
+func arrayAndCount(name string, args []Object) (*Array, int, *Error) {
+	if len(args) != 2 {
+		return nil, 0, newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=2", name, len(args))
+	}
+
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return nil, 0, newError(TypeError, "first argument to `%s` must be ARRAY, got %s", name, args[0].Type())
+	}
+	n, ok := args[1].(*Integer)
+	if !ok {
+		return nil, 0, newError(TypeError, "second argument to `%s` must be INTEGER, got %s", name, args[1].Type())
+	}
+	if n.Value < 0 {
+		return nil, 0, newError(ArgumentError, "second argument to `%s` must not be negative, got %d", name, n.Value)
+	}
+
+	if n.Value > int64(len(arr.Elements)) {
+		return arr, len(arr.Elements), nil
+	}
+	return arr, int(n.Value), nil
+}
+
+// absInt64 returns the absolute value of n, which unlike -n is right for the
+// smallest int64 too.
+func absInt64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// baseArgument checks the base argument of to_base and from_base.
+func baseArgument(name string, arg Object) (int, *Error) {
+	base, ok := arg.(*Integer)
+	if !ok {
+		return 0, newError(TypeError, "second argument to `%s` must be INTEGER, got %s", name, arg.Type())
+	}
+	if base.Value < 2 || base.Value > 36 {
+		return 0, newError(ArgumentError, "base of `%s` must be between 2 and 36, got %d", name, base.Value)
+	}
+	return int(base.Value), nil
+}
+
+// setArgument checks the single SET argument of set_len and set_to_array.
+func setArgument(name string, args []Object) (*Set, *Error) {
+	if len(args) != 1 {
+		return nil, newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=1", name, len(args))
+	}
+
+	s, ok := args[0].(*Set)
+	if !ok {
+		return nil, newError(TypeError, "argument to `%s` must be SET, got %s", name, args[0].Type())
+	}
+	return s, nil
+}
+
+// setAndElement checks the (set, element) arguments of set_add, set_has and
+// set_remove. The element must be hashable.
+func setAndElement(name string, args []Object) (*Set, Object, *Error) {
+	if len(args) != 2 {
+		return nil, nil, newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=2", name, len(args))
+	}
+
+	s, ok := args[0].(*Set)
+	if !ok {
+		return nil, nil, newError(TypeError, "first argument to `%s` must be SET, got %s", name, args[0].Type())
+	}
+	if _, ok := KeyFor(args[1]); !ok {
+		return nil, nil, newError(TypeError, "%w: %s", ErrUnhashable, args[1].Type())
+	}
+	return s, args[1], nil
+}
+
+// containsEqual reports whether elements holds an object Equal to obj.
+func containsEqual(elements []Object, obj Object) bool {
+	for _, el := range elements {
+		if Equal(el, obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringPredicateBuiltin returns the function of a builtin that takes two
+// Strings and reports the result of pred on them.
+func stringPredicateBuiltin(name string, pred func(s, sub string) bool) BuiltinFunction {
+	return func(h *Host, args ...Object) Object {
+		if len(args) != 2 {
+			return newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=2", name, len(args))
+		}
+
+		s, ok := args[0].(*String)
+		if !ok {
+			return newError(TypeError, "first argument to `%s` must be STRING, got %s", name, args[0].Type())
+		}
+		sub, ok := args[1].(*String)
+		if !ok {
+			return newError(TypeError, "second argument to `%s` must be STRING, got %s", name, args[1].Type())
+		}
+
+		return NativeBoolToBooleanObject(pred(s.Value, sub.Value))
+	}
+}
+
+// roundingBuiltin returns the function of a builtin that turns a Float into
+// an Integer using round. Integers are returned unchanged. A Float that is
+// NaN, infinite or rounds to a value an int64 can't hold is an error.
+func roundingBuiltin(name string, round func(float64) float64) BuiltinFunction {
+	return func(h *Host, args ...Object) Object {
+		if len(args) != 1 {
+			return newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=1", name, len(args))
+		}
+
+		switch arg := args[0].(type) {
+		case *Integer:
+			return arg
+		case *Float:
+			rounded := round(arg.Value)
+			// -2**63 is exact as a float64, and 2**63 the first value above
+			// the int64 range; NaN fails both comparisons
+			if !(rounded >= math.MinInt64 && rounded < -math.MinInt64) {
+				return newError(RuntimeError, "integer overflow: `%s` of %s", name, arg.Inspect())
+			}
+			return NewInteger(int64(rounded))
+		default:
+			return newError(TypeError, "argument to `%s` must be INTEGER or FLOAT, got %s", name, args[0].Type())
+		}
+	}
+}
+
+// quantifierBuiltin returns the function of any (stop=true) or all
+// (stop=false). It stops at the first element the predicate answers stop
+// for and returns stop; if there is none it returns !stop.
+func quantifierBuiltin(name string, stop bool) BuiltinFunction {
+	return func(h *Host, args ...Object) Object {
+		if len(args) != 2 {
+			return newError(ArgumentError, "wrong number of arguments to `%s`. got=%d, want=2", name, len(args))
+		}
+
+		arr, ok := args[0].(*Array)
+		if !ok {
+			return newError(TypeError, "first argument to `%s` must be ARRAY, got %s", name, args[0].Type())
+		}
+		if !isCallable(args[1]) {
+			return newError(TypeError, "second argument to `%s` must be a function, got %s", name, args[1].Type())
+		}
+
+		for _, el := range arr.Elements {
+			match, err := callPredicate(h, args[1], el)
+			if err != nil {
+				return err
+			}
+			if match == stop {
+				return NativeBoolToBooleanObject(stop)
+			}
+		}
+
+		return NativeBoolToBooleanObject(!stop)
+	}
+}
+
+// rangeLength returns how many of start, start+step, ... lie before end.
+// The distance between start and end is taken unsigned, where it cannot
+// overflow; a length too large for an int64 is returned as math.MaxInt64.
+func rangeLength(start, end, step int64) int64 {
+	var distance, stride uint64
+	switch {
+	case step > 0 && start < end:
+		distance, stride = uint64(end)-uint64(start), uint64(step)
+	case step < 0 && start > end:
+		distance, stride = uint64(start)-uint64(end), -uint64(step)
+	default:
+		return 0
+	}
+
+	length := (distance-1)/stride + 1
+	if length > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(length)
+}
+
+// CheckedPow computes base**exp for exp >= 0 by repeated squaring, reporting
+// false instead of wrapping around when the result doesn't fit an int64.
+func CheckedPow(base, exp int64) (int64, bool) {
+	result := int64(1)
+	for exp > 0 {
+		var ok bool
+		if exp&1 == 1 {
+			result, ok = checkedMul(result, base)
+			if !ok {
+				return 0, false
+			}
+		}
+		exp >>= 1
+		if exp > 0 {
+			base, ok = checkedMul(base, base)
+			if !ok {
+				return 0, false
+			}
+		}
+	}
+	return result, true
+}
+
+// checkedAdd adds a and b, reporting false instead of wrapping around when
+// the sum doesn't fit an int64.
+func checkedAdd(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+func checkedMul(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	product := a * b
+	if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return product, true
+}
+
+// ToFloat returns the value of an Integer or Float as a float64.
+func ToFloat(obj Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value), true
+	case *Float:
+		return obj.Value, true
+	default:
+		return 0, false
+	}
+}
+
+// readLine reads up to and including the next newline, one byte at a time so
+// that nothing past the line is consumed from r. The line is returned without
+// its line ending; io.EOF is only reported when there was nothing left to read.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+func isCallable(obj Object) bool {
+	switch obj.(type) {
+	case *CompiledFunction, *Closure, *Builtin, *Memoized, *Partial:
+		return true
+	}
+	return false
+}
+
+// call invokes fn through the host. A call that fails is reported as a fatal
+// Error, so that it halts the program just like the failure itself would.
+func call(h *Host, fn Object, args ...Object) Object {
+	result, err := h.Call(fn, args...)
+	if err != nil {
+		return fatal(err)
+	}
+
+	return result
+}
+
+// callPredicate calls pred with el and reports whether the result is truthy.
+func callPredicate(h *Host, pred, el Object) (bool, *Error) {
+	result := call(h, pred, el)
+	if err, ok := result.(*Error); ok {
+		return false, err
+	}
+	return IsTruthy(result), nil
+}
+
+// fatal turns an error from running the program into a fatal Error.
+func fatal(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		fatal := *e
+		fatal.Fatal = true
+		return &fatal
+	}
+	wrapped := newError(RuntimeError, "%w", err)
+	wrapped.Fatal = true
+	return wrapped
+}
+
+// deepClone copies arrays, hashes, heaps and sets recursively. Everything else, functions
+// included, can't be mutated and is returned as is. A container reached more
+// than once, even through a cycle, is copied once and the copy is reused.
+func deepClone(obj Object) Object {
+	return cloneInto(obj, make(map[Object]Object))
+}
+
+// cloneInto is deepClone with the copies made so far, keyed by original. Each
+// copy is recorded before its elements are cloned so that cycles end.
+func cloneInto(obj Object, copies map[Object]Object) Object {
+	switch obj.(type) {
+	case *Array, *Hash, *Heap, *Set:
+		if c, ok := copies[obj]; ok {
+			return c
+		}
+	}
+
+	switch obj := obj.(type) {
+	case *Array:
+		arr := &Array{Elements: make([]Object, len(obj.Elements))}
+		copies[obj] = arr
+		for i, el := range obj.Elements {
+			arr.Elements[i] = cloneInto(el, copies)
+		}
+		return arr
+
+	case *Hash:
+		hash := NewHash(len(obj.Order))
+		copies[obj] = hash
+		for _, k := range obj.Order {
+			pair := obj.Pairs[k]
+			hash.Set(k, HashPair{Key: pair.Key, Value: cloneInto(pair.Value, copies)})
+		}
+		return hash
+
+	case *Heap:
+		heap := &Heap{Elements: make([]Object, len(obj.Elements)), Less: obj.Less}
+		copies[obj] = heap
+		for i, el := range obj.Elements {
+			heap.Elements[i] = cloneInto(el, copies)
+		}
+		return heap
+
+	case *Set:
+		set := NewSet(len(obj.Order))
+		copies[obj] = set
+		for _, el := range obj.Ordered() {
+			set.Add(cloneInto(el, copies))
+		}
+		return set
+
+	default:
+		return obj
+	}
+}
+
+// clampIndex resolves a negative index against length and clamps the result
+// to [0, length].
+func clampIndex(i int64, length int) int {
+	if i < 0 {
+		i += int64(length)
+	}
+	if i < 0 {
+		return 0
+	}
+	if i > int64(length) {
+		return length
+	}
+	return int(i)
 }
 
-func newError(format string, a ...interface{}) *Error {
-	return &Error{Message: fmt.Sprintf(format, a...)}
+func newError(kind ErrorKind, format string, a ...interface{}) *Error {
+	return NewError(kind, format, a...)
 }
 
 func GetBuiltinByName(name string) *Builtin {
@@ -0,0 +1,107 @@
+package object
+
+// Equal compares two objects by value. Scalars are equal when they have the
+// same type and value, arrays when their elements are pairwise equal and
+// hashes when they hold the same keys mapped to equal values; sets are equal
+// when they hold the same elements, in any order. An integer and a float are
+// equal when they hold the same number, as they are for ==, but an integer is
+// never equal to a char. Everything else, such as functions, falls back to
+// identity.
+//
+// The VM's == and the builtins comparing values all go through Equal, so they
+// agree on what equal means. Containers that hold themselves are compared
+// without recursing forever: a pair already being compared counts as equal.
+func Equal(left, right Object) bool {
+	return equal(left, right, nil)
+}
+
+// equal is Equal with the pairs of containers currently being compared,
+// created on the first container pair.
+func equal(left, right Object, comparing map[[2]Object]bool) bool {
+	if left == right {
+		return true
+	}
+
+	switch left.(type) {
+	case *Array, *Hash:
+		pair := [2]Object{left, right}
+		if comparing[pair] {
+			return true
+		}
+		if comparing == nil {
+			comparing = make(map[[2]Object]bool)
+		}
+		comparing[pair] = true
+		defer delete(comparing, pair)
+	}
+
+	switch left := left.(type) {
+	case *Integer:
+		switch right := right.(type) {
+		case *Integer:
+			return left.Value == right.Value
+		case *Float:
+			return float64(left.Value) == right.Value
+		}
+		return false
+
+	case *Boolean:
+		right, ok := right.(*Boolean)
+		return ok && left.Value == right.Value
+
+	case *Null:
+		_, ok := right.(*Null)
+		return ok
+
+	case *Float:
+		rightValue, ok := ToFloat(right)
+		return ok && left.Value == rightValue
+
+	case *Char:
+		right, ok := right.(*Char)
+		return ok && left.Value == right.Value
+
+	case *String:
+		right, ok := right.(*String)
+		return ok && left.Value == right.Value
+
+	case *Array:
+		right, ok := right.(*Array)
+		if !ok || len(left.Elements) != len(right.Elements) {
+			return false
+		}
+		for i, el := range left.Elements {
+			if !equal(el, right.Elements[i], comparing) {
+				return false
+			}
+		}
+		return true
+
+	case *Hash:
+		right, ok := right.(*Hash)
+		if !ok || len(left.Pairs) != len(right.Pairs) {
+			return false
+		}
+		for key, pair := range left.Pairs {
+			other, ok := right.Pairs[key]
+			if !ok || !equal(pair.Value, other.Value, comparing) {
+				return false
+			}
+		}
+		return true
+
+	case *Set:
+		right, ok := right.(*Set)
+		if !ok || len(left.Elements) != len(right.Elements) {
+			return false
+		}
+		for key := range left.Elements {
+			if _, ok := right.Elements[key]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
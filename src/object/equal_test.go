@@ -0,0 +1,126 @@
+package object
+
+import "testing"
+
+func TestEqual(t *testing.T) {
+	array := func(elements ...Object) *Array { return &Array{Elements: elements} }
+	hash := func(kvs ...Object) *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		for i := 0; i < len(kvs); i += 2 {
+			h.Pairs[kvs[i].(Hashable).HashKey()] = HashPair{Key: kvs[i], Value: kvs[i+1]}
+		}
+		return h
+	}
+	set := func(elements ...Object) *Set {
+		s := NewSet(len(elements))
+		for _, el := range elements {
+			s.Add(el)
+		}
+		return s
+	}
+	fn := &CompiledFunction{}
+
+	tests := []struct {
+		left, right Object
+		expected    bool
+	}{
+		{&Integer{Value: 1}, &Integer{Value: 1}, true},
+		{&Integer{Value: 1}, &Integer{Value: 2}, false},
+		{&Float{Value: 1.5}, &Float{Value: 1.5}, true},
+		{&Char{Value: 'a'}, &Char{Value: 'a'}, true},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&String{Value: "a"}, &String{Value: "b"}, false},
+		{&Boolean{Value: true}, TRUE, true},
+		{&Boolean{Value: true}, FALSE, false},
+		{&Null{}, NULL, true},
+		// integers and floats compare by value, as they do for ==
+		{&Integer{Value: 1}, &Float{Value: 1}, true},
+		{&Integer{Value: 1}, &Float{Value: 1.5}, false},
+		{array(&Integer{Value: 1}), array(&Float{Value: 1}), true},
+		// no other conversions between types
+		{&Integer{Value: 97}, &Char{Value: 'a'}, false},
+		{&String{Value: "1"}, &Integer{Value: 1}, false},
+		{NULL, FALSE, false},
+		{array(), hash(), false},
+		{
+			array(&Integer{Value: 1}, array(&String{Value: "x"}, NULL)),
+			array(&Integer{Value: 1}, array(&String{Value: "x"}, NULL)),
+			true,
+		},
+		{
+			array(&Integer{Value: 1}, array(&String{Value: "x"})),
+			array(&Integer{Value: 1}, array(&String{Value: "y"})),
+			false,
+		},
+		{array(&Integer{Value: 1}), array(&Integer{Value: 1}, &Integer{Value: 2}), false},
+		{
+			hash(&String{Value: "a"}, array(&Integer{Value: 1}), &Integer{Value: 2}, TRUE),
+			hash(&Integer{Value: 2}, &Boolean{Value: true}, &String{Value: "a"}, array(&Integer{Value: 1})),
+			true,
+		},
+		{
+			hash(&String{Value: "a"}, &Integer{Value: 1}),
+			hash(&String{Value: "a"}, &Integer{Value: 2}),
+			false,
+		},
+		{
+			hash(&String{Value: "a"}, &Integer{Value: 1}),
+			hash(&String{Value: "b"}, &Integer{Value: 1}),
+			false,
+		},
+		{hash(&String{Value: "a"}, &Integer{Value: 1}), hash(), false},
+		{set(&Integer{Value: 1}, &String{Value: "a"}), set(&String{Value: "a"}, &Integer{Value: 1}), true},
+		{set(&Integer{Value: 1}), set(&Integer{Value: 2}), false},
+		{set(&Integer{Value: 1}), set(&Integer{Value: 1}, &Integer{Value: 2}), false},
+		{set(), array(), false},
+		{fn, fn, true},
+		{fn, &CompiledFunction{}, false},
+	}
+
+	for i, tt := range tests {
+		if got := Equal(tt.left, tt.right); got != tt.expected {
+			t.Errorf("tests[%d] - Equal(%s, %s) wrong. want=%t, got=%t", i, tt.left.Inspect(), tt.right.Inspect(), tt.expected, got)
+		}
+		if got := Equal(tt.right, tt.left); got != tt.expected {
+			t.Errorf("tests[%d] - Equal(%s, %s) wrong. want=%t, got=%t", i, tt.right.Inspect(), tt.left.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestEqualCycles(t *testing.T) {
+	// each container holds itself as its last element
+	cyclicArray := func(first Object) *Array {
+		a := &Array{Elements: []Object{first, nil}}
+		a.Elements[1] = a
+		return a
+	}
+	cyclicHash := func(n int64) *Hash {
+		h := NewHash(2)
+		h.Set((&String{Value: "n"}).HashKey(), HashPair{Key: &String{Value: "n"}, Value: &Integer{Value: n}})
+		h.Set((&String{Value: "self"}).HashKey(), HashPair{Key: &String{Value: "self"}, Value: h})
+		return h
+	}
+
+	a := cyclicArray(&Integer{Value: 1})
+
+	tests := []struct {
+		name        string
+		left, right Object
+		expected    bool
+	}{
+		{"same cyclic arrays", a, cyclicArray(&Integer{Value: 1}), true},
+		{"cyclic arrays differing in a scalar", a, cyclicArray(&Integer{Value: 2}), false},
+		{"cyclic array against one unrolled step", a, &Array{Elements: []Object{&Integer{Value: 1}, a}}, true},
+		{"same cyclic hashes", cyclicHash(1), cyclicHash(1), true},
+		{"cyclic hashes differing in a scalar", cyclicHash(1), cyclicHash(2), false},
+	}
+
+	for _, tt := range tests {
+		if got := Equal(tt.left, tt.right); got != tt.expected {
+			t.Errorf("%s: Equal wrong. want=%t, got=%t", tt.name, tt.expected, got)
+		}
+		if got := Equal(tt.right, tt.left); got != tt.expected {
+			t.Errorf("%s: Equal (swapped) wrong. want=%t, got=%t", tt.name, tt.expected, got)
+		}
+	}
+}
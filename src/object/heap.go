@@ -0,0 +1,112 @@
+package object
+
+import "fmt"
+
+// Heap is a binary min-heap. Without Less it holds integers and pops the
+// smallest first; with Less, a callable taking two elements, it pops first
+// whichever element Less says comes before all others.
+type Heap struct {
+	Elements []Object
+	Less     Object
+}
+
+func (hp *Heap) Type() ObjectType { return HEAP_OBJ }
+func (hp *Heap) Inspect() string  { return fmt.Sprintf("heap(len=%d)", len(hp.Elements)) }
+
+// Push adds x to the heap. If Less fails, the heap is left as it was.
+func (hp *Heap) Push(h *Host, x Object) *Error {
+	if hp.Less == nil && x.Type() != INTEGER_OBJ {
+		return newError(TypeError, "heap without a comparator holds only INTEGER, got %s", x.Type())
+	}
+
+	hp.Elements = append(hp.Elements, x)
+
+	var swaps [][2]int
+	i := len(hp.Elements) - 1
+	for i > 0 {
+		parent := (i - 1) / 2
+		less, err := hp.less(h, i, parent)
+		if err != nil {
+			hp.undo(swaps)
+			hp.Elements[len(hp.Elements)-1] = nil
+			hp.Elements = hp.Elements[:len(hp.Elements)-1]
+			return err
+		}
+		if !less {
+			break
+		}
+		hp.swap(i, parent)
+		swaps = append(swaps, [2]int{i, parent})
+		i = parent
+	}
+
+	return nil
+}
+
+// Pop removes and returns the first element of the heap, or nil when it is
+// empty. If Less fails, the heap is left as it was.
+func (hp *Heap) Pop(h *Host) (Object, *Error) {
+	n := len(hp.Elements)
+	if n == 0 {
+		return nil, nil
+	}
+
+	top := hp.Elements[0]
+	hp.swap(0, n-1)
+	hp.Elements[n-1] = nil
+	hp.Elements = hp.Elements[:n-1]
+
+	var swaps [][2]int
+	i := 0
+	for {
+		smallest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child >= len(hp.Elements) {
+				continue
+			}
+			less, err := hp.less(h, child, smallest)
+			if err != nil {
+				hp.undo(swaps)
+				hp.Elements = hp.Elements[:n]
+				hp.Elements[n-1] = top
+				hp.swap(0, n-1)
+				return nil, err
+			}
+			if less {
+				smallest = child
+			}
+		}
+		if smallest == i {
+			break
+		}
+		hp.swap(i, smallest)
+		swaps = append(swaps, [2]int{i, smallest})
+		i = smallest
+	}
+
+	return top, nil
+}
+
+func (hp *Heap) less(h *Host, i, j int) (bool, *Error) {
+	if hp.Less == nil {
+		return hp.Elements[i].(*Integer).Value < hp.Elements[j].(*Integer).Value, nil
+	}
+
+	result := call(h, hp.Less, hp.Elements[i], hp.Elements[j])
+	if err, ok := result.(*Error); ok {
+		return false, err
+	}
+	return IsTruthy(result), nil
+}
+
+func (hp *Heap) swap(i, j int) {
+	hp.Elements[i], hp.Elements[j] = hp.Elements[j], hp.Elements[i]
+}
+
+// undo reverts swaps, made in order, to put the elements back where they
+// were before the first of them.
+func (hp *Heap) undo(swaps [][2]int) {
+	for k := len(swaps) - 1; k >= 0; k-- {
+		hp.swap(swaps[k][0], swaps[k][1])
+	}
+}
@@ -0,0 +1,52 @@
+package object
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Host connects builtins to the world outside the program: where `puts`
+// writes to, where `input` reads from, what time `now` reports and where
+// `rand` gets its numbers from. Call is set by whatever runs the program and
+// lets builtins call back into functions passed to them; Resume likewise runs
+// a generator up to its next yield. MaxArrayLength bounds the arrays
+// builtins may create; zero or less means no bound.
+type Host struct {
+	Out            io.Writer
+	In             io.Reader
+	Now            func() time.Time
+	Rand           *rand.Rand
+	Call           func(fn Object, args ...Object) (Object, error)
+	Resume         func(gen *Generator) (Object, error)
+	MaxArrayLength int
+}
+
+// DefaultMaxArrayLength is the MaxArrayLength of a Host returned by NewHost.
+const DefaultMaxArrayLength = 1 << 24
+
+// NewHost returns a Host using the process's standard output and input, the
+// system clock and a random source of its own, seeded from the clock.
+func NewHost() *Host {
+	return &Host{
+		Out:  os.Stdout,
+		In:   os.Stdin,
+		Now:  time.Now,
+		Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		MaxArrayLength: DefaultMaxArrayLength,
+	}
+}
+
+// CheckArrayLength returns an error if n is negative or an array of n
+// elements would be longer than h allows, and nil otherwise.
+func (h *Host) CheckArrayLength(n int64) *Error {
+	if n < 0 {
+		return NewError(RuntimeError, "invalid array length %d", n)
+	}
+	if h.MaxArrayLength > 0 && n > int64(h.MaxArrayLength) {
+		return NewError(RuntimeError, "%w: length %d exceeds the maximum of %d", ErrArrayTooLarge, n, h.MaxArrayLength)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package object
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrNotSerializable is returned (wrapped) by ToJSON for values that have no
+// JSON representation, such as functions and errors.
+var ErrNotSerializable = errors.New("value cannot be serialized to JSON")
+
+// ToJSON encodes obj as JSON. Hashes become JSON objects, so only String and
+// Integer keys are accepted, and not both 1 and "1" in the same hash; object
+// keys are emitted in the hash's insertion order.
+func ToJSON(obj Object) ([]byte, error) {
+	v, err := toJSONValue(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func toJSONValue(obj Object) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return obj.Value, nil
+
+	case *Float:
+		if math.IsNaN(obj.Value) || math.IsInf(obj.Value, 0) {
+			return nil, fmt.Errorf("%w: float %s", ErrNotSerializable, obj.Inspect())
+		}
+		return obj.Value, nil
+
+	case *String:
+		return obj.Value, nil
+
+	case *Boolean:
+		return obj.Value, nil
+
+	case *Null:
+		return nil, nil
+
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, el := range obj.Elements {
+			v, err := toJSONValue(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = v
+		}
+		return elements, nil
+
+	case *Hash:
+		members := jsonObject{}
+		seen := make(map[string]bool, len(obj.Pairs))
+		for _, pair := range obj.OrderedPairs() {
+			var key string
+			switch k := pair.Key.(type) {
+			case *String:
+				key = k.Value
+			case *Integer:
+				key = strconv.FormatInt(k.Value, 10)
+			default:
+				return nil, fmt.Errorf("%w: hash key of type %s", ErrNotSerializable, pair.Key.Type())
+			}
+
+			if seen[key] {
+				return nil, fmt.Errorf("%w: duplicate object key %q", ErrNotSerializable, key)
+			}
+			seen[key] = true
+
+			v, err := toJSONValue(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			members.keys = append(members.keys, key)
+			members.values = append(members.values, v)
+		}
+		return members, nil
+
+	case nil:
+		return nil, fmt.Errorf("%w: nil object", ErrNotSerializable)
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotSerializable, obj.Type())
+	}
+}
+
+// jsonObject is a JSON object whose members are written in the order they
+// were added, which a map would lose.
+type jsonObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// FromJSON decodes a single JSON document into Monkey objects. Objects become
+// Hashes keyed by String; numbers written without a fraction or exponent
+// that fit an int64 become Integers, and all others Floats.
+func FromJSON(data []byte) (Object, error) {
+	// decoding into a RawMessage checks the whole document, with the
+	// decoder's own error messages and nesting limit, before any of it is
+	// converted
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if dec.More() {
+		return nil, errors.New("unexpected data after top-level value")
+	}
+
+	dec = json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return nextJSONValue(dec)
+}
+
+// nextJSONValue reads the next value from dec and converts it. Arrays and
+// objects are read token by token so that the keys of an object are inserted
+// into the Hash in the order the document lists them.
+func nextJSONValue(dec *json.Decoder) (Object, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok := tok.(type) {
+	case nil:
+		return NULL, nil
+
+	case bool:
+		return NativeBoolToBooleanObject(tok), nil
+
+	case string:
+		return &String{Value: tok}, nil
+
+	case json.Number:
+		if i, err := tok.Int64(); err == nil {
+			return NewInteger(i), nil
+		}
+		f, err := tok.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("number %s is out of range", tok)
+		}
+		return &Float{Value: f}, nil
+
+	case json.Delim:
+		if tok == '[' {
+			elements := []Object{}
+			for dec.More() {
+				el, err := nextJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, el)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return &Array{Elements: elements}, nil
+		}
+
+		hash := NewHash(0)
+		for dec.More() {
+			// the decoder only hands out strings in key position
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := nextJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			key := &String{Value: k.(string)}
+			hash.Set(key.HashKey(), HashPair{Key: key, Value: value})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return hash, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected JSON token %v", tok)
+	}
+}
@@ -0,0 +1,81 @@
+package object
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		input    Object
+		expected string
+	}{
+		{&Integer{Value: -42}, `-42`},
+		{&Float{Value: 1.5}, `1.5`},
+		{&String{Value: "say \"hi\""}, `"say \"hi\""`},
+		{&Boolean{Value: true}, `true`},
+		{&Null{}, `null`},
+		{&Array{Elements: []Object{}}, `[]`},
+		{
+			&Array{Elements: []Object{
+				&Integer{Value: 1},
+				&Array{Elements: []Object{&String{Value: "a"}, &Null{}}},
+			}},
+			`[1,["a",null]]`,
+		},
+		{
+			newTestHash(
+				&String{Value: "b"}, &Array{Elements: []Object{&Boolean{Value: false}}},
+				&Integer{Value: 1}, newTestHash(&String{Value: "x"}, &Integer{Value: 2}),
+			),
+			`{"b":[false],"1":{"x":2}}`,
+		},
+		{
+			newTestHash(
+				&String{Value: "z"}, &Integer{Value: 1},
+				&String{Value: "a"}, &Integer{Value: 2},
+				&String{Value: "m"}, &Integer{Value: 3},
+			),
+			`{"z":1,"a":2,"m":3}`,
+		},
+	}
+
+	for _, tt := range tests {
+		actual, err := ToJSON(tt.input)
+		if err != nil {
+			t.Fatalf("ToJSON(%s) returned error: %s", tt.input.Inspect(), err)
+		}
+
+		if string(actual) != tt.expected {
+			t.Errorf("wrong JSON for %s. want=%s, got=%s", tt.input.Inspect(), tt.expected, actual)
+		}
+	}
+}
+
+func TestToJSONRejectsUnserializable(t *testing.T) {
+	tests := []Object{
+		&CompiledFunction{},
+		&Error{Message: "boom"},
+		&Float{Value: math.Inf(1)},
+		&Float{Value: math.NaN()},
+		&Array{Elements: []Object{&Integer{Value: 1}, &Builtin{Name: "len"}}},
+		newTestHash(&Boolean{Value: true}, &Integer{Value: 1}),
+		newTestHash(&Integer{Value: 1}, &String{Value: "a"}, &String{Value: "1"}, &String{Value: "b"}),
+	}
+
+	for _, tt := range tests {
+		_, err := ToJSON(tt)
+		if !errors.Is(err, ErrNotSerializable) {
+			t.Errorf("expected ErrNotSerializable for %s, got=%v", tt.Inspect(), err)
+		}
+	}
+}
+
+func newTestHash(kv ...Object) *Hash {
+	hash := NewHash(len(kv) / 2)
+	for i := 0; i < len(kv); i += 2 {
+		hash.Set(kv[i].(Hashable).HashKey(), HashPair{Key: kv[i], Value: kv[i+1]})
+	}
+	return hash
+}
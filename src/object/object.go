@@ -2,10 +2,13 @@ package object
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"monkey/src/ast"
 	"monkey/src/code"
+	"strconv"
 	"strings"
 )
 
@@ -13,6 +16,8 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
+	CHAR_OBJ              = "CHAR"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
@@ -23,6 +28,12 @@ const (
 	ARRAY_OBJ             = "ARRAY"
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
+	MEMOIZED_OBJ          = "MEMOIZED"
+	PARTIAL_OBJ           = "PARTIAL"
+	GENERATOR_OBJ         = "GENERATOR"
+	HEAP_OBJ              = "HEAP"
+	SET_OBJ               = "SET"
+	CLOSURE_OBJ           = "CLOSURE"
 )
 
 type HashKey struct {
@@ -39,6 +50,30 @@ type Integer struct {
 	Value int64
 }
 
+const (
+	minCachedInteger = -128
+	maxCachedInteger = 255
+)
+
+// integerCache holds shared Integers for small values. Sharing is safe
+// because an Integer is never modified after it has been created.
+var integerCache = func() []*Integer {
+	cache := make([]*Integer, maxCachedInteger-minCachedInteger+1)
+	for i := range cache {
+		cache[i] = &Integer{Value: int64(i + minCachedInteger)}
+	}
+	return cache
+}()
+
+// NewInteger returns an Integer holding v, reusing a shared instance for
+// values in [-128, 255].
+func NewInteger(v int64) *Integer {
+	if v >= minCachedInteger && v <= maxCachedInteger {
+		return integerCache[v-minCachedInteger]
+	}
+	return &Integer{Value: v}
+}
+
 func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
@@ -46,6 +81,33 @@ func (i *Integer) HashKey() HashKey {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+type Float struct {
+	Value float64
+}
+
+// Inspect always shows a decimal point or exponent, so a whole Float can be
+// told apart from an Integer.
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
+// Char is a single Unicode character.
+type Char struct {
+	Value rune
+}
+
+func (c *Char) HashKey() HashKey {
+	return HashKey{Type: c.Type(), Value: uint64(c.Value)}
+}
+
+func (c *Char) Inspect() string  { return string(c.Value) }
+func (c *Char) Type() ObjectType { return CHAR_OBJ }
+
 type Boolean struct {
 	Value bool
 }
@@ -65,6 +127,34 @@ func (b *Boolean) HashKey() HashKey {
 func (i *Boolean) Inspect() string  { return fmt.Sprintf("%t", i.Value) }
 func (i *Boolean) Type() ObjectType { return BOOLEAN_OBJ }
 
+// TRUE, FALSE and NULL are the only Boolean and Null values that should
+// exist, so they can be compared by identity.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
+// IsTruthy reports whether obj counts as true in a condition: everything but
+// false and null does.
+func IsTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func NativeBoolToBooleanObject(input bool) *Boolean {
+	if input {
+		return TRUE
+	}
+	return FALSE
+}
+
 type Null struct{}
 
 func (n *Null) Inspect() string  { return "null" }
@@ -77,13 +167,60 @@ type ReturnValue struct {
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 
+// ErrorKind tells what category of failure an Error is.
+type ErrorKind int
+
+const (
+	RuntimeError ErrorKind = iota // anything not covered by a specific kind
+	TypeError
+	IndexError
+	ArgumentError
+	DivideByZero
+	AssertionError
+)
+
+var errorKindNames = map[ErrorKind]string{
+	RuntimeError:   "RuntimeError",
+	TypeError:      "TypeError",
+	IndexError:     "IndexError",
+	ArgumentError:  "ArgumentError",
+	DivideByZero:   "DivideByZero",
+	AssertionError: "AssertionError",
+}
+
+func (k ErrorKind) String() string {
+	if name, ok := errorKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
 type Error struct {
+	Kind    ErrorKind
 	Message string
+	// Fatal errors returned by builtins halt the VM instead of being
+	// handed to the program as a value.
+	Fatal bool
+
+	cause error
+}
+
+// NewError formats an Error of the given kind like fmt.Errorf does, so an
+// error passed with %w can still be found with errors.Is and errors.As.
+func NewError(kind ErrorKind, format string, a ...interface{}) *Error {
+	err := fmt.Errorf(format, a...)
+	return &Error{Kind: kind, Message: err.Error(), cause: errors.Unwrap(err)}
 }
 
 func (e *Error) Inspect() string  { return "Error: " + e.Message }
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
 
+// Error makes *Error usable as a Go error, which is how the VM reports
+// runtime errors.
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.cause }
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
@@ -131,7 +268,7 @@ type Builtin struct {
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function: " + b.Name }
 
-type BuiltinFunction func(args ...Object) Object
+type BuiltinFunction func(h *Host, args ...Object) Object
 
 type Array struct {
 	Elements []Object
@@ -153,20 +290,84 @@ func (a *Array) Inspect() string {
 	return out.String()
 }
 
+// HashKey hashes the keys of the elements, so that arrays with equal
+// elements share a key. Only arrays whose elements are all hashable can be
+// used as keys; see KeyFor.
+func (a *Array) HashKey() HashKey {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, e := range a.Elements {
+		key, ok := KeyFor(e)
+		if !ok {
+			key = HashKey{Type: e.Type(), Value: 0}
+		}
+		h.Write([]byte(key.Type))
+		binary.LittleEndian.PutUint64(buf[:], key.Value)
+		h.Write(buf[:])
+	}
+
+	return HashKey{Type: a.Type(), Value: h.Sum64()}
+}
+
 type HashPair struct {
 	Key   Object
 	Value Object
 }
 
+// Hash maps keys to pairs and remembers the order keys were added in.
+// Pairs should be changed through Set and Delete, which keep Order in step.
 type Hash struct {
 	Pairs map[HashKey]HashPair
+	Order []HashKey // keys of Pairs, in insertion order
+}
+
+// NewHash returns an empty Hash with room for size pairs.
+func NewHash(size int) *Hash {
+	return &Hash{Pairs: make(map[HashKey]HashPair, size), Order: make([]HashKey, 0, size)}
+}
+
+// Set stores pair under key. A new key goes to the end of the order; an
+// existing one keeps its place.
+func (h *Hash) Set(key HashKey, pair HashPair) {
+	if h.Pairs == nil {
+		h.Pairs = make(map[HashKey]HashPair)
+	}
+	if _, ok := h.Pairs[key]; !ok {
+		h.Order = append(h.Order, key)
+	}
+	h.Pairs[key] = pair
+}
+
+// Delete removes key and reports whether it was there.
+func (h *Hash) Delete(key HashKey) bool {
+	if _, ok := h.Pairs[key]; !ok {
+		return false
+	}
+	delete(h.Pairs, key)
+
+	for i, k := range h.Order {
+		if k == key {
+			h.Order = append(h.Order[:i:i], h.Order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// OrderedPairs returns the pairs of h in insertion order.
+func (h *Hash) OrderedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Order))
+	for _, k := range h.Order {
+		pairs = append(pairs, h.Pairs[k])
+	}
+	return pairs
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
 func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 	pairs := []string{}
-	for _, pair := range h.Pairs {
+	for _, pair := range h.OrderedPairs() {
 		pairs = append(pairs, fmt.Sprintf("%s: %s",
 			pair.Key.Inspect(), pair.Value.Inspect()))
 	}
@@ -180,6 +381,27 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string // empty for anonymous functions
+	// Variadic functions collect the arguments past NumParameters-1 into an
+	// Array bound to their last parameter.
+	Variadic bool
+	// DefaultEntries is nil unless some parameters have default values. The
+	// instructions then start with code assigning those defaults, one
+	// parameter after another, and DefaultEntries[n] is the offset to start
+	// executing at when the first n defaulted parameters were passed. The
+	// last entry is where the body starts.
+	DefaultEntries []int
+	// Generator functions contain a yield. Calling one returns a Generator
+	// instead of running the body.
+	Generator bool
+}
+
+// NumDefaults returns how many parameters have a default value.
+func (cf *CompiledFunction) NumDefaults() int {
+	if len(cf.DefaultEntries) == 0 {
+		return 0
+	}
+	return len(cf.DefaultEntries) - 1
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -187,6 +409,127 @@ func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
+// Closure is a function together with the values of the variables it
+// captured from the functions enclosing it when it was created. Functions
+// that capture nothing stay plain CompiledFunctions.
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("CLOSURE[%p] free=%d", c, len(c.Free))
+}
+
+// Generator is a call of a generator function, suspended at its start or at
+// a yield. While suspended it holds no VM frame: Stack has the frame's locals
+// and operands and IP the instruction it stopped at, and the VM copies them
+// back onto its stack to resume it.
+type Generator struct {
+	Fn      *CompiledFunction
+	Free    []Object // of the closure that was called, if any
+	IP      int
+	Stack   []Object
+	Running bool
+	Done    bool // the body has returned, or failed
+}
+
+func (g *Generator) Type() ObjectType { return GENERATOR_OBJ }
+func (g *Generator) Inspect() string  { return fmt.Sprintf("Generator[%p]", g) }
+
+// Memoized wraps a callable and remembers its results, so that the wrapped
+// function runs once per distinct list of arguments.
+type Memoized struct {
+	Fn    Object
+	Cache map[string]Object
+}
+
+func (m *Memoized) Type() ObjectType { return MEMOIZED_OBJ }
+func (m *Memoized) Inspect() string  { return "memoized(" + m.Fn.Inspect() + ")" }
+
+// CacheKey identifies a list of arguments in the cache. Every value in it,
+// also inside arrays, hashes and sets, is tagged with its type, so neither
+// 1 and "1" nor [1] and ["1"] collide.
+func (m *Memoized) CacheKey(args []Object) string {
+	var out strings.Builder
+	for _, arg := range args {
+		writeCacheKey(&out, arg)
+		out.WriteString(",")
+	}
+	return out.String()
+}
+
+func writeCacheKey(out *strings.Builder, obj Object) {
+	switch obj := obj.(type) {
+	case *Array:
+		out.WriteString("ARRAY[")
+		for _, el := range obj.Elements {
+			writeCacheKey(out, el)
+			out.WriteString(",")
+		}
+		out.WriteString("]")
+
+	case *Hash:
+		out.WriteString("HASH{")
+		for _, pair := range obj.OrderedPairs() {
+			writeCacheKey(out, pair.Key)
+			out.WriteString(":")
+			writeCacheKey(out, pair.Value)
+			out.WriteString(",")
+		}
+		out.WriteString("}")
+
+	case *Set:
+		out.WriteString("SET[")
+		for _, el := range obj.Ordered() {
+			writeCacheKey(out, el)
+			out.WriteString(",")
+		}
+		out.WriteString("]")
+
+	default:
+		fmt.Fprintf(out, "%s:%q", obj.Type(), obj.Inspect())
+	}
+}
+
+// Partial is a callable with some arguments already bound. Calling it calls
+// Fn with Args followed by the arguments of the call.
+type Partial struct {
+	Fn   Object
+	Args []Object
+}
+
+func (p *Partial) Type() ObjectType { return PARTIAL_OBJ }
+func (p *Partial) Inspect() string  { return "bound(" + p.Fn.Inspect() + ")" }
+
 type Hashable interface {
 	HashKey() HashKey
 }
+
+// KeyFor returns the key obj is stored under in a hash, or false when obj
+// can't be used as a key. Arrays are hashed by their contents, so an array
+// changed after it was used as a key is no longer found under it.
+func KeyFor(obj Object) (HashKey, bool) {
+	if arr, ok := obj.(*Array); ok {
+		for _, e := range arr.Elements {
+			if _, ok := KeyFor(e); !ok {
+				return HashKey{}, false
+			}
+		}
+	}
+
+	hashable, ok := obj.(Hashable)
+	if !ok {
+		return HashKey{}, false
+	}
+	return hashable.HashKey(), true
+}
+
+// ErrUnhashable is wrapped by the errors reported when an object that isn't
+// Hashable is used as a hash key.
+var ErrUnhashable = errors.New("unusable as hash key")
+
+// ErrArrayTooLarge is wrapped by the errors reported when an array would
+// grow past the Host's MaxArrayLength.
+var ErrArrayTooLarge = errors.New("array too large")
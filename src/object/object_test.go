@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "hello"}
@@ -21,3 +24,229 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("string with different content have same hash keys")
 	}
 }
+
+func TestNewIntegerSharesSmallValues(t *testing.T) {
+	for _, v := range []int64{-128, -1, 0, 1, 255} {
+		if NewInteger(v) != NewInteger(v) {
+			t.Errorf("NewInteger(%d) did not return the shared instance", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("NewInteger(%d) has wrong value %d", v, NewInteger(v).Value)
+		}
+	}
+
+	for _, v := range []int64{-129, 256, 1 << 40} {
+		if NewInteger(v) == NewInteger(v) {
+			t.Errorf("NewInteger(%d) unexpectedly returned a shared instance", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("NewInteger(%d) has wrong value %d", v, NewInteger(v).Value)
+		}
+	}
+}
+
+var sinkInteger *Integer
+
+func BenchmarkIntegerAllocation(b *testing.B) {
+	b.Run("literal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkInteger = &Integer{Value: int64(i % 256)}
+		}
+	})
+
+	b.Run("NewInteger", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkInteger = NewInteger(int64(i % 256))
+		}
+	})
+}
+
+func TestNewError(t *testing.T) {
+	err := NewError(TypeError, "%w: %s", ErrUnhashable, "ARRAY")
+
+	if err.Kind != TypeError || err.Kind.String() != "TypeError" {
+		t.Errorf("wrong kind. got=%s", err.Kind)
+	}
+
+	if err.Error() != "unusable as hash key: ARRAY" {
+		t.Errorf("wrong message. got=%q", err.Error())
+	}
+
+	if !errors.Is(err, ErrUnhashable) {
+		t.Errorf("error does not wrap ErrUnhashable")
+	}
+
+	if ErrorKind(99).String() != "ErrorKind(99)" {
+		t.Errorf("wrong name for unknown kind. got=%s", ErrorKind(99))
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{4, "4.0"},
+		{0.25, "0.25"},
+		{-1.5, "-1.5"},
+		{1e21, "1e+21"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong Inspect for %g. want=%q, got=%q", tt.value, tt.expected, f.Inspect())
+		}
+	}
+}
+
+func TestArrayHashKey(t *testing.T) {
+	one := &Array{Elements: []Object{&Integer{Value: 1}, &String{Value: "a"}}}
+	two := &Array{Elements: []Object{&Integer{Value: 1}, &String{Value: "a"}}}
+	diff := &Array{Elements: []Object{&String{Value: "a"}, &Integer{Value: 1}}}
+
+	if one.HashKey() != two.HashKey() {
+		t.Errorf("arrays with same elements have different hash keys")
+	}
+	if one.HashKey() == diff.HashKey() {
+		t.Errorf("arrays with different elements have same hash keys")
+	}
+
+	nested := &Array{Elements: []Object{one, &Array{Elements: []Object{&Hash{}}}}}
+	if _, ok := KeyFor(nested); ok {
+		t.Errorf("KeyFor accepted an array holding a hash")
+	}
+	if _, ok := KeyFor(&Array{Elements: []Object{one, two}}); !ok {
+		t.Errorf("KeyFor rejected an array of hashable arrays")
+	}
+}
+
+func TestHashOrder(t *testing.T) {
+	h := NewHash(0)
+	for _, k := range []int64{3, 1, 2} {
+		key := NewInteger(k)
+		h.Set(key.HashKey(), HashPair{Key: key, Value: key})
+	}
+	h.Set(NewInteger(1).HashKey(), HashPair{Key: NewInteger(1), Value: NewInteger(10)})
+
+	if got, want := h.Inspect(), "{3: 3, 1: 10, 2: 2}"; got != want {
+		t.Fatalf("wrong order after Set. want=%q, got=%q", want, got)
+	}
+
+	if !h.Delete(NewInteger(1).HashKey()) {
+		t.Fatalf("Delete of a present key returned false")
+	}
+	if h.Delete(NewInteger(1).HashKey()) {
+		t.Fatalf("Delete of a missing key returned true")
+	}
+	if got, want := h.Inspect(), "{3: 3, 2: 2}"; got != want {
+		t.Fatalf("wrong order after Delete. want=%q, got=%q", want, got)
+	}
+	if len(h.Order) != len(h.Pairs) {
+		t.Fatalf("Order and Pairs out of step. len(Order)=%d, len(Pairs)=%d", len(h.Order), len(h.Pairs))
+	}
+
+	h.Set(NewInteger(1).HashKey(), HashPair{Key: NewInteger(1), Value: NewInteger(1)})
+	if got, want := h.Inspect(), "{3: 3, 2: 2, 1: 1}"; got != want {
+		t.Fatalf("re-added key not moved to the end. want=%q, got=%q", want, got)
+	}
+}
+
+func TestInspectPretty(t *testing.T) {
+	hash := NewHash(2)
+	for _, kv := range []struct {
+		key   string
+		value Object
+	}{
+		{"name", &String{Value: "x"}},
+		{"tags", &Array{Elements: []Object{NewInteger(1), &Array{Elements: []Object{NewInteger(2)}}}}},
+	} {
+		key := &String{Value: kv.key}
+		hash.Set(key.HashKey(), HashPair{Key: key, Value: kv.value})
+	}
+
+	tests := []struct {
+		input    Object
+		expected string
+	}{
+		{NewInteger(1), "1"},
+		{&Array{Elements: []Object{}}, "[]"},
+		{NewHash(0), "{}"},
+		{&Array{Elements: []Object{hash, NewInteger(3)}}, "[\n\t{\n\t\tname: x,\n\t\ttags: [\n\t\t\t1,\n\t\t\t[\n\t\t\t\t2\n\t\t\t]\n\t\t]\n\t},\n\t3\n]"},
+	}
+
+	for _, tt := range tests {
+		got := InspectPretty(tt.input, "\t")
+		if got != tt.expected {
+			t.Errorf("wrong output for %s.\nwant=%q\ngot=%q", tt.input.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestCheckArrayLength(t *testing.T) {
+	h := &Host{MaxArrayLength: 3}
+
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, ""},
+		{3, ""},
+		{4, "array too large: length 4 exceeds the maximum of 3"},
+		{-1, "invalid array length -1"},
+	}
+
+	for _, tt := range tests {
+		err := h.CheckArrayLength(tt.n)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %d: %s", tt.n, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("wrong error for %d. want=%q, got=%v", tt.n, tt.want, err)
+		}
+	}
+
+	// without a maximum only negative lengths are rejected
+	if err := (&Host{}).CheckArrayLength(-5); err == nil {
+		t.Errorf("negative length accepted by a host without a maximum")
+	}
+}
+
+func TestMemoizedCacheKey(t *testing.T) {
+	m := &Memoized{}
+	str := func(v string) Object { return &String{Value: v} }
+	arr := func(els ...Object) Object { return &Array{Elements: els} }
+
+	distinct := [][]Object{
+		{NewInteger(1)},
+		{str("1")},
+		{arr(NewInteger(1))},
+		{arr(str("1"))},
+		{arr(arr(NewInteger(1), NewInteger(2)))},
+		{arr(arr(NewInteger(1), str("2")))},
+		{arr(arr(NewInteger(1)), NewInteger(2))},
+		{arr(NewInteger(1)), arr(NewInteger(2))},
+		{str("1, 2")},
+		{str(`1", "2`)},
+	}
+
+	seen := map[string]int{}
+	for i, args := range distinct {
+		key := m.CacheKey(args)
+		if j, ok := seen[key]; ok {
+			t.Errorf("arguments %d and %d share the key %q", j, i, key)
+		}
+		seen[key] = i
+	}
+
+	nested := []Object{arr(arr(NewInteger(1)), str("x"))}
+	again := []Object{arr(arr(NewInteger(1)), str("x"))}
+	if m.CacheKey(nested) != m.CacheKey(again) {
+		t.Errorf("equal nested arguments got different keys")
+	}
+}
@@ -0,0 +1,57 @@
+package object
+
+import "strings"
+
+// InspectPretty is like Inspect but puts each element of a non-empty array
+// or hash on a line of its own, indented by one more indent than the
+// collection holding it. Other objects are rendered by their Inspect.
+func InspectPretty(obj Object, indent string) string {
+	var out strings.Builder
+	writePretty(&out, obj, indent, "")
+	return out.String()
+}
+
+func writePretty(out *strings.Builder, obj Object, indent, prefix string) {
+	inner := prefix + indent
+
+	switch obj := obj.(type) {
+	case *Array:
+		if len(obj.Elements) == 0 {
+			out.WriteString("[]")
+			return
+		}
+
+		out.WriteString("[\n")
+		for i, el := range obj.Elements {
+			out.WriteString(inner)
+			writePretty(out, el, indent, inner)
+			if i < len(obj.Elements)-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(prefix + "]")
+
+	case *Hash:
+		if len(obj.Order) == 0 {
+			out.WriteString("{}")
+			return
+		}
+
+		out.WriteString("{\n")
+		for i, pair := range obj.OrderedPairs() {
+			out.WriteString(inner)
+			out.WriteString(pair.Key.Inspect())
+			out.WriteString(": ")
+			writePretty(out, pair.Value, indent, inner)
+			if i < len(obj.Order)-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(prefix + "}")
+
+	default:
+		out.WriteString(obj.Inspect())
+	}
+}
@@ -0,0 +1,78 @@
+package object
+
+import "strings"
+
+// Set is a collection of distinct hashable objects. Like Hash it remembers
+// the order elements were added in; Elements should be changed through Add
+// and Remove, which keep Order in step.
+type Set struct {
+	Elements map[HashKey]Object
+	Order    []HashKey // keys of Elements, in insertion order
+}
+
+// NewSet returns an empty Set with room for size elements.
+func NewSet(size int) *Set {
+	return &Set{Elements: make(map[HashKey]Object, size), Order: make([]HashKey, 0, size)}
+}
+
+func (s *Set) Type() ObjectType { return SET_OBJ }
+func (s *Set) Inspect() string {
+	elements := make([]string, len(s.Order))
+	for i, el := range s.Ordered() {
+		elements[i] = el.Inspect()
+	}
+	return "set([" + strings.Join(elements, ", ") + "])"
+}
+
+// Add puts obj in the set, unless an equal element is already there. It
+// returns an error when obj can't be hashed.
+func (s *Set) Add(obj Object) *Error {
+	key, ok := KeyFor(obj)
+	if !ok {
+		return newError(TypeError, "%w: %s", ErrUnhashable, obj.Type())
+	}
+	if _, ok := s.Elements[key]; !ok {
+		s.Elements[key] = obj
+		s.Order = append(s.Order, key)
+	}
+	return nil
+}
+
+// Has reports whether obj is in the set.
+func (s *Set) Has(obj Object) bool {
+	key, ok := KeyFor(obj)
+	if !ok {
+		return false
+	}
+	_, ok = s.Elements[key]
+	return ok
+}
+
+// Remove takes obj out of the set and reports whether it was there.
+func (s *Set) Remove(obj Object) bool {
+	key, ok := KeyFor(obj)
+	if !ok {
+		return false
+	}
+	if _, ok := s.Elements[key]; !ok {
+		return false
+	}
+	delete(s.Elements, key)
+
+	for i, k := range s.Order {
+		if k == key {
+			s.Order = append(s.Order[:i:i], s.Order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Ordered returns the elements of s in insertion order.
+func (s *Set) Ordered() []Object {
+	elements := make([]Object, len(s.Order))
+	for i, k := range s.Order {
+		elements[i] = s.Elements[k]
+	}
+	return elements
+}
@@ -6,31 +6,45 @@ import (
 	"monkey/src/lexer"
 	"monkey/src/token"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 const (
 	_ int = iota
 	LOWEST
+	TERNARY     // a ? b : c
+	NULLISH     // a ?? b
 	EQUALS      // ==
 	LESSGREATER // > or <
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
+	POWER       // **
 	CALL        // myfunc(X)
 	INDEX       // array[index]
+	POSTFIX     // X++ or X--
 )
 
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.EQ:        EQUALS,
+	token.NOT_EQ:    EQUALS,
+	token.LT:        LESSGREATER,
+	token.GT:        LESSGREATER,
+	token.LT_EQ:     LESSGREATER,
+	token.GT_EQ:     LESSGREATER,
+	token.IN:        LESSGREATER,
+	token.PLUS:      SUM,
+	token.MINUS:     SUM,
+	token.SLASH:     PRODUCT,
+	token.ASTERISK:  PRODUCT,
+	token.POWER:     POWER,
+	token.LPAREN:    CALL,
+	token.LBRACKET:  INDEX,
+	token.QUESTION:  TERNARY,
+	token.NULLISH:   NULLISH,
+	token.INCREMENT: POSTFIX,
+	token.DECREMENT: POSTFIX,
 }
 
 type Parser struct {
@@ -38,6 +52,7 @@ type Parser struct {
 
 	curToken  token.Token
 	peekToken token.Token
+	queued    []token.Token // read from the lexer but not yet peeked at
 
 	errors []string
 
@@ -57,14 +72,20 @@ func New(l *lexer.Lexer) *Parser {
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
+	p.registerPrefix(token.CHAR, p.parseCharLiteral)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.YIELD, p.parseYieldExpression)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
+	p.registerPrefix(token.NULL, p.parseNullLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.TEMPLATE, p.parseTemplateLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 
@@ -72,12 +93,20 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.POWER, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.IN, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.QUESTION, p.parseTernaryExpression)
+	p.registerInfix(token.NULLISH, p.parseInfixExpression)
+	p.registerInfix(token.INCREMENT, p.parsePostfixExpression)
+	p.registerInfix(token.DECREMENT, p.parsePostfixExpression)
 
 	p.nextToken()
 	p.nextToken()
@@ -87,7 +116,36 @@ func New(l *lexer.Lexer) *Parser {
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
+	p.peekToken = p.readToken()
+
+	// -- in front of an operand is two minus signs, as in a--b or --5, so
+	// that only a -- ending an expression is a postfix decrement
+	if p.peekToken.Type == token.DECREMENT {
+		after := p.readToken()
+		if p.startsOperand(after.Type) {
+			minus := token.Token{Type: token.MINUS, Literal: "-"}
+			p.peekToken = minus
+			p.queued = append([]token.Token{minus, after}, p.queued...)
+		} else {
+			p.queued = append([]token.Token{after}, p.queued...)
+		}
+	}
+}
+
+func (p *Parser) readToken() token.Token {
+	if len(p.queued) > 0 {
+		tok := p.queued[0]
+		p.queued = p.queued[1:]
+		return tok
+	}
+	return p.l.NextToken()
+}
+
+// startsOperand reports whether an expression can start with a token of type
+// t. A -- can, as it is then split into two minus signs.
+func (p *Parser) startsOperand(t token.TokenType) bool {
+	_, ok := p.prefixParseFns[t]
+	return ok || t == token.DECREMENT
 }
 
 func (p *Parser) parseIdentifier() ast.Expression {
@@ -102,8 +160,16 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseReturnStatement()
 	case token.FOR:
 		return p.parseForStatment()
+	case token.WHILE:
+		return p.parseWhileStatement()
+	case token.DO:
+		return p.parseDoWhileStatement()
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
 	case token.IDENT:
-		if p.peekToken.Type == token.ASSIGN {
+		if token.IsAssignment(p.peekToken.Type) {
 			return p.parseAssignExpression()
 		}
 		return p.parseExpressionStatement()
@@ -114,6 +180,10 @@ func (p *Parser) parseStatement() ast.Statement {
 }
 
 func (p *Parser) parseLetStatment() ast.Statement {
+	if p.peekTokenIs(token.LBRACKET) {
+		return p.parseDestructuringLetStatement()
+	}
+
 	stmt := &ast.LetStatement{Token: p.curToken}
 
 	if !p.expectPeek(token.IDENT) {
@@ -133,6 +203,10 @@ func (p *Parser) parseLetStatment() ast.Statement {
 
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -193,6 +267,126 @@ func (p *Parser) parseForStatment() ast.Statement {
 
 }
 
+func (p *Parser) parseWhileStatement() ast.Statement {
+	stmt := &ast.WhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseBlockStatement()
+
+	return stmt
+}
+
+func (p *Parser) parseDoWhileStatement() ast.Statement {
+	stmt := &ast.DoWhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stmt.Body = p.parseBlockStatement()
+
+	if !p.expectPeek(token.WHILE) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseYieldExpression() ast.Expression {
+	exp := &ast.YieldExpression{Token: p.curToken}
+
+	if p.peekTokenIs(token.SEMICOLON) || p.peekTokenIs(token.RBRACE) || p.peekTokenIs(token.EOF) {
+		return exp
+	}
+
+	p.nextToken()
+	exp.Value = p.parseExpression(LOWEST)
+
+	return exp
+}
+
+func (p *Parser) parseTryExpression() ast.Expression {
+	exp := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	exp.Body = p.parseBlockStatement()
+
+	if !p.expectPeek(token.CATCH) {
+		return nil
+	}
+
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		exp.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	exp.Catch = p.parseBlockStatement()
+
+	return exp
+}
+
+func (p *Parser) parseBreakStatement() ast.Statement {
+	stmt := &ast.BreakStatement{Token: p.curToken}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() ast.Statement {
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() ast.Statement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
@@ -235,7 +429,8 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
-	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	digits := strings.ReplaceAll(p.curToken.Literal, "_", "")
+	value, err := strconv.ParseInt(digits, 0, 64)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
 		p.errors = append(p.errors, msg)
@@ -247,10 +442,132 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	digits := strings.ReplaceAll(p.curToken.Literal, "_", "")
+	value, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse %q as float", p.curToken.Literal)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+func (p *Parser) parseCharLiteral() ast.Expression {
+	// the lexer only makes CHAR tokens of a single valid rune
+	value, _ := utf8.DecodeRuneInString(p.curToken.Literal)
+	return &ast.CharLiteral{Token: p.curToken, Value: value}
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+// templateEscapes are the escapes in template text besides \` and \$, which
+// stand for themselves like any other escaped character.
+var templateEscapes = map[byte]string{
+	'n': "\n",
+	't': "\t",
+}
+
+func (p *Parser) parseTemplateLiteral() ast.Expression {
+	lit := &ast.TemplateLiteral{Token: p.curToken}
+	raw := p.curToken.Literal
+
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			value := text.String()
+			lit.Parts = append(lit.Parts, &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: value}, Value: value})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case raw[i] == '\\' && i+1 < len(raw):
+			i++
+			if escaped, ok := templateEscapes[raw[i]]; ok {
+				text.WriteString(escaped)
+			} else {
+				text.WriteByte(raw[i])
+			}
+
+		case raw[i] == '$' && i+1 < len(raw) && raw[i+1] == '{':
+			end := closingBrace(raw, i+2)
+			if end < 0 {
+				p.errors = append(p.errors, "unterminated ${ in template literal")
+				return nil
+			}
+			exp := p.parseEmbeddedExpression(raw[i+2 : end])
+			if exp == nil {
+				return nil
+			}
+			flush()
+			lit.Parts = append(lit.Parts, exp)
+			i = end
+
+		default:
+			text.WriteByte(raw[i])
+		}
+	}
+	flush()
+
+	return lit
+}
+
+// closingBrace returns the index of the brace closing the one before start,
+// skipping nested braces and string literals, or -1 if there is none.
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// parseEmbeddedExpression parses the source of a ${...} in a template
+// literal, which must be a single expression.
+func (p *Parser) parseEmbeddedExpression(src string) ast.Expression {
+	sub := New(lexer.New(src))
+	program := sub.ParseProgram()
+	if len(sub.Errors()) > 0 {
+		p.errors = append(p.errors, sub.Errors()...)
+		return nil
+	}
+
+	if len(program.Statements) != 1 {
+		p.errors = append(p.errors, fmt.Sprintf("template expression must be a single expression, got %q", src))
+		return nil
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		p.errors = append(p.errors, fmt.Sprintf("template expression must be a single expression, got %q", src))
+		return nil
+	}
+
+	return stmt.Expression
+}
+
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 
@@ -275,6 +592,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		value := p.parseExpression(LOWEST)
 
 		hash.Pairs[key] = value
+		hash.Keys = append(hash.Keys, key)
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
@@ -311,12 +629,20 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 
 	precedence := p.curPrecendence()
+	// ** is right associative: 2 ** 3 ** 2 is 2 ** (3 ** 2)
+	if expresion.Token.Type == token.POWER {
+		precedence--
+	}
 	p.nextToken()
 	expresion.Right = p.parseExpression(precedence)
 
 	return expresion
 }
 
+func (p *Parser) parseNullLiteral() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	boolValue, err := strconv.ParseBool(p.curToken.Literal)
 	if err != nil {
@@ -382,7 +708,7 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	p.parseFunctionParameters(lit)
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -393,33 +719,118 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	identifiers := []*ast.Identifier{}
+func (p *Parser) parseFunctionParameters(lit *ast.FunctionLiteral) {
+	lit.Parameters = []*ast.Identifier{}
 
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return identifiers
+		return
 	}
 
 	p.nextToken()
+	p.parseFunctionParameter(lit)
 
+	for !lit.Variadic && p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+		p.parseFunctionParameter(lit)
+	}
+
+	// the variadic parameter has to be the last one, so anything but a
+	// closing paren here is an error
+	if !p.expectPeek(token.RPAREN) {
+		lit.Parameters = nil
+		lit.Defaults = nil
+	}
+}
+
+// parseFunctionParameter parses a single parameter with its optional default
+// value or variadic marker and appends it to lit.
+func (p *Parser) parseFunctionParameter(lit *ast.FunctionLiteral) {
 	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	identifiers = append(identifiers, ident)
 
-	for p.peekTokenIs(token.COMMA) {
+	var def ast.Expression
+	if p.peekTokenIs(token.ASSIGN) {
 		p.nextToken()
 		p.nextToken()
+		def = p.parseExpression(LOWEST)
+	}
 
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		identifiers = append(identifiers, ident)
+	// once a parameter has a default, all following ones need one too,
+	// otherwise there is no telling which arguments were left out
+	last := len(lit.Defaults) - 1
+	if def == nil && last >= 0 && lit.Defaults[last] != nil && !p.peekTokenIs(token.ELLIPSIS) {
+		msg := fmt.Sprintf("parameter %s needs a default value", ident.Value)
+		p.errors = append(p.errors, msg)
 	}
 
-	if !p.expectPeek(token.RPAREN) {
+	lit.Parameters = append(lit.Parameters, ident)
+	lit.Defaults = append(lit.Defaults, def)
+	lit.Variadic = p.parseVariadicMarker()
+
+	if lit.Variadic && def != nil {
+		msg := fmt.Sprintf("variadic parameter %s cannot have a default value", ident.Value)
+		p.errors = append(p.errors, msg)
+	}
+}
+
+// parseVariadicMarker consumes a "..." following the current parameter and
+// reports whether there was one.
+func (p *Parser) parseVariadicMarker() bool {
+	if !p.peekTokenIs(token.ELLIPSIS) {
+		return false
+	}
+	p.nextToken()
+	return true
+}
+
+func (p *Parser) parseDestructuringLetStatement() ast.Statement {
+	stmt := &ast.DestructuringLetStatement{Token: p.curToken}
+	p.nextToken()
+
+	for !p.peekTokenIs(token.RBRACKET) {
+		if p.peekTokenIs(token.ELLIPSIS) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			stmt.Rest = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			// the rest pattern has to be the last one
+			break
+		}
+
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+
+		if !p.peekTokenIs(token.RBRACKET) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
 
-	return identifiers
+	if len(stmt.Names) == 0 && stmt.Rest == nil {
+		p.errors = append(p.errors, "destructuring pattern needs at least one name")
+		return nil
+	}
+
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
 
+	return stmt
 }
 
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
@@ -457,16 +868,18 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 		return nil
 	}
 
-	if p.peekTokenIs(token.ASSIGN) {
+	if token.IsAssignment(p.peekToken.Type) {
 		p.nextToken()
+		operator := p.curToken.Literal
 		p.nextToken()
 
 		val := p.parseExpression(LOWEST)
 
 		return &ast.IndexAssignmentExpression{
-			Token: exp.Token,
-			Index: exp,
-			Value: val,
+			Token:    exp.Token,
+			Index:    exp,
+			Operator: operator,
+			Value:    val,
 		}
 
 	}
@@ -481,9 +894,8 @@ func (p *Parser) parseAssignExpression() ast.Statement {
 		Value: p.curToken.Literal,
 	}}
 
-	if !p.expectPeek(token.ASSIGN) {
-		return nil
-	}
+	p.nextToken()
+	exp.Operator = p.curToken.Literal
 
 	p.nextToken()
 
@@ -509,6 +921,10 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
+		// a trailing comma
+		if p.peekTokenIs(end) {
+			break
+		}
 		p.nextToken()
 		list = append(list, p.parseExpression(LOWEST))
 	}
@@ -585,6 +1001,35 @@ func (p *Parser) registerPrefix(tokenType token.TokenType, fn prefixParseFn) {
 	p.prefixParseFns[tokenType] = fn
 }
 
+func (p *Parser) parseTernaryExpression(condition ast.Expression) ast.Expression {
+	expression := &ast.TernaryExpression{Token: p.curToken, Condition: condition}
+
+	p.nextToken()
+	expression.Consequence = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.COLON) {
+		return nil
+	}
+
+	// parsing the alternative with the lowest precedence makes the operator
+	// right associative: a ? b : c ? d : e is a ? b : (c ? d : e)
+	p.nextToken()
+	expression.Alternative = p.parseExpression(LOWEST)
+
+	return expression
+}
+
+func (p *Parser) parsePostfixExpression(target ast.Expression) ast.Expression {
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.errors = append(p.errors, fmt.Sprintf("cannot apply %s to %s", p.curToken.Literal, target.String()))
+		return nil
+	}
+
+	return &ast.PostfixExpression{Token: p.curToken, Target: target, Operator: p.curToken.Literal}
+}
+
 func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 	p.infixParseFns[tokenType] = fn
 }
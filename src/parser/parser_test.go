@@ -135,6 +135,71 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedNames []string
+		expectedRest  string
+		expected      string
+	}{
+		{"let [a, b] = f();", []string{"a", "b"}, "", "let [a, b] = f();"},
+		{"let [a, ...rest] = [1, 2]", []string{"a"}, "rest", "let [a, ...rest] = [1, 2];"},
+		{"let [...all] = x;", nil, "all", "let [...all] = x;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got %d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.DestructuringLetStatement)
+		if !ok {
+			t.Fatalf("stmt is not *ast.DestructuringLetStatement. got=%T", program.Statements[0])
+		}
+
+		if len(stmt.Names) != len(tt.expectedNames) {
+			t.Fatalf("wrong number of names. want=%d, got=%d", len(tt.expectedNames), len(stmt.Names))
+		}
+		for i, name := range tt.expectedNames {
+			testIdentifier(t, stmt.Names[i], name)
+		}
+
+		if tt.expectedRest == "" && stmt.Rest != nil {
+			t.Errorf("stmt.Rest is not nil. got=%s", stmt.Rest)
+		}
+		if tt.expectedRest != "" {
+			testIdentifier(t, stmt.Rest, tt.expectedRest)
+		}
+
+		if stmt.String() != tt.expected {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", tt.expected, stmt.String())
+		}
+	}
+}
+
+func TestMalformedDestructuring(t *testing.T) {
+	tests := []string{
+		"let [] = x;",
+		"let [a, ...rest, b] = x;",
+		"let [1] = x;",
+		"let [a] x;",
+	}
+
+	for _, input := range tests {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
 func TestAssignStatements(t *testing.T) {
 
 	tests := []struct {
@@ -161,6 +226,32 @@ func TestAssignStatements(t *testing.T) {
 	}
 }
 
+func TestCompoundAssignments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x += 5;", "x += 5"},
+		{"x -= y * 2;", "x -= (y * 2)"},
+		{"x *= 2;", "x *= 2"},
+		{"x /= 2;", "x /= 2"},
+		{"a[i + 1] += 3;", "a[(i + 1)] += 3"},
+		{"h[\"k\"] /= 2;", "h[k] /= 2"},
+	}
+
+	for _, tt := range tests {
+		program := setup(t, tt.input)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got %d", len(program.Statements))
+		}
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program. want %q, got %q", tt.expected, program.String())
+		}
+	}
+}
+
 func TestReturnStatement(t *testing.T) {
 
 	input := `
@@ -222,6 +313,21 @@ func TestIdentifierExpression(t *testing.T) {
 
 }
 
+func TestMalformedIntegerLiterals(t *testing.T) {
+	tests := []string{"0xZZ", "0b102", "0o8", "0x"}
+
+	for _, input := range tests {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		expected := fmt.Sprintf("could not parse %q as integer", input)
+		if len(errors) == 0 || errors[0] != expected {
+			t.Errorf("wrong errors for %q. want %q, got %q", input, expected, errors)
+		}
+	}
+}
+
 func TestIntegerLiteralExpression(t *testing.T) {
 	input := "5;"
 
@@ -250,6 +356,50 @@ func TestIntegerLiteralExpression(t *testing.T) {
 
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	program := setup(t, "3.25;")
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statement. go=%d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Value != 3.25 {
+		t.Fatalf("literal.Value not %g. got=%g", 3.25, literal.Value)
+	}
+	if literal.TokenLiteral() != "3.25" {
+		t.Fatalf("literal.TokenLiteral() not %s. got=%s", "3.25", literal.TokenLiteral())
+	}
+}
+
+func TestCharLiteralExpression(t *testing.T) {
+	program := setup(t, `'\n';`)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.CharLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.CharLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Value != '\n' {
+		t.Errorf("literal.Value not %q. got=%q", '\n', literal.Value)
+	}
+	if literal.String() != `'\n'` {
+		t.Errorf("literal.String() not %q. got=%q", `'\n'`, literal.String())
+	}
+}
+
 func TestStringLiteralExpression(t *testing.T) {
 	input := `"hello world";`
 
@@ -389,6 +539,8 @@ func TestParsingInfixExpresssions(t *testing.T) {
 		{"5 * 5;", 5, "*", 5},
 		{"5 > 5;", 5, ">", 5},
 		{"5 > 5;", 5, ">", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 >= 5;", 5, ">=", 5},
 		{"5 == 5;", 5, "==", 5},
 		{"5 != 5;", 5, "!=", 5},
 		{"alice == bob;", "alice", "==", "bob"},
@@ -429,10 +581,78 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"!-a",
 			"(!(-a))",
 		},
+		{
+			"-i++ * 2",
+			"((-(i++)) * 2)",
+		},
+		{
+			"a[0]--",
+			"((a[0])--)",
+		},
+		{
+			"1--1",
+			"(1 - (-1))",
+		},
+		{
+			"a--b",
+			"(a - (-b))",
+		},
+		{
+			"--5",
+			"(-(-5))",
+		},
+		{
+			"2 * a--b * c",
+			"((2 * a) - ((-b) * c))",
+		},
+		{
+			"a----b",
+			"(a - (-(-(-b))))",
+		},
+		{
+			"a--;",
+			"(a--)",
+		},
 		{
 			"a+b+c",
 			"((a + b) + c)",
 		},
+		{
+			"a + 1 in b == !c",
+			"(((a + 1) in b) == (!c))",
+		},
+		{
+			"2 ** 3 ** 2",
+			"(2 ** (3 ** 2))",
+		},
+		{
+			"-a ** 2 * b",
+			"((-(a ** 2)) * b)",
+		},
+		{
+			"a ** -b",
+			"(a ** (-b))",
+		},
+		{
+			"a < b ? c + 1 : d",
+			"((a < b) ? (c + 1) : d)",
+		},
+		{
+			"a ?? b == c ? d : e ?? f",
+			"((a ?? (b == c)) ? d : (e ?? f))",
+		},
+		{
+			"a ?? b ?? c",
+			"((a ?? b) ?? c)",
+		},
+		{
+			"a ? b : c ? d : e",
+			"(a ? b : (c ? d : e))",
+		},
+		{
+			"a ? b ? c : d : e",
+			"(a ? (b ? c : d) : e)",
+		},
 		{
 			"a+b-c",
 			"((a + b) - c)",
@@ -651,6 +871,193 @@ for i, v in arr {
 	testLetStatment(t, block, "x")
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `
+while (x < 10) {
+	x = x + 1;
+}
+`
+
+	program := setup(t, input)
+
+	pLen := len(program.Statements)
+
+	if pLen != 1 {
+		t.Fatalf("len(program.Statements) is not 1. got=%d", pLen)
+	}
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+
+	if !ok {
+		t.Fatalf("program.Statements[0] not of type (*ast.WhileStatement). got=%T", program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", 10) {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 1 {
+		t.Fatalf("stmt.Body.Statements len not 1 got=%d", len(stmt.Body.Statements))
+	}
+
+	testAssignStatment(t, stmt.Body.Statements[0], "x", "(x + 1)")
+}
+
+func TestDoWhileStatement(t *testing.T) {
+	input := `
+do {
+	x = x + 1;
+} while (x < 10);
+`
+
+	program := setup(t, input)
+
+	pLen := len(program.Statements)
+
+	if pLen != 1 {
+		t.Fatalf("len(program.Statements) is not 1. got=%d", pLen)
+	}
+	stmt, ok := program.Statements[0].(*ast.DoWhileStatement)
+
+	if !ok {
+		t.Fatalf("program.Statements[0] not of type (*ast.DoWhileStatement). got=%T", program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", 10) {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 1 {
+		t.Fatalf("stmt.Body.Statements len not 1 got=%d", len(stmt.Body.Statements))
+	}
+
+	testAssignStatment(t, stmt.Body.Statements[0], "x", "(x + 1)")
+}
+
+func TestTryExpression(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedParam string
+		expected      string
+	}{
+		{"try { f(x) } catch (e) { e }", "e", "try {\nf(x)} catch (e) {\ne}"},
+		{"try { x; } catch { y; }", "", "try {\nx} catch {\ny}"},
+	}
+
+	for _, tt := range tests {
+		program := setup(t, tt.input)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("len(program.Statements) is not 1. got=%d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] not of type (*ast.ExpressionStatement). got=%T", program.Statements[0])
+		}
+
+		exp, ok := stmt.Expression.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("stmt.Expression is not *ast.TryExpression. got=%T", stmt.Expression)
+		}
+
+		if tt.expectedParam == "" && exp.Param != nil {
+			t.Errorf("exp.Param is not nil. got=%s", exp.Param)
+		}
+		if tt.expectedParam != "" {
+			testIdentifier(t, exp.Param, tt.expectedParam)
+		}
+
+		if exp.String() != tt.expected {
+			t.Errorf("exp.String() wrong. want=%q, got=%q", tt.expected, exp.String())
+		}
+	}
+}
+
+func TestYieldExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"yield x + 1;", "yield (x + 1)"},
+		{"yield;", "yield"},
+		{"yield", "yield"},
+	}
+
+	for _, tt := range tests {
+		program := setup(t, tt.input)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("len(program.Statements) is not 1. got=%d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] not of type (*ast.ExpressionStatement). got=%T", program.Statements[0])
+		}
+
+		exp, ok := stmt.Expression.(*ast.YieldExpression)
+		if !ok {
+			t.Fatalf("stmt.Expression is not *ast.YieldExpression. got=%T", stmt.Expression)
+		}
+
+		if exp.String() != tt.expected {
+			t.Errorf("exp.String() wrong. want=%q, got=%q", tt.expected, exp.String())
+		}
+	}
+}
+
+func TestTemplateLiteral(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		parts    int
+	}{
+		{"`hello ${name}, you are ${age + 1}`", "`hello ${name}, you are ${(age + 1)}`", 4},
+		{"`${x}`", "`${x}`", 1},
+		{"`plain`", "`plain`", 1},
+		{"``", "``", 0},
+		{"`\\${x}`", "`${x}`", 1},
+	}
+
+	for _, tt := range tests {
+		program := setup(t, tt.input)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		lit, ok := stmt.Expression.(*ast.TemplateLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.TemplateLiteral. got=%T", stmt.Expression)
+		}
+
+		if len(lit.Parts) != tt.parts {
+			t.Errorf("wrong number of parts for %q. want=%d, got=%d", tt.input, tt.parts, len(lit.Parts))
+		}
+		if lit.String() != tt.expected {
+			t.Errorf("lit.String() wrong. want=%q, got=%q", tt.expected, lit.String())
+		}
+	}
+}
+
+func TestInvalidTemplateLiterals(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"`${x`", "no prefix parse func for ILLEGAL found"},
+		{"`${}`", "template expression must be a single expression, got \"\""},
+		{"`${x; y}`", "template expression must be a single expression, got \"x; y\""},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expectedError {
+			t.Errorf("wrong errors for %q. want %q, got %q", tt.input, tt.expectedError, errors)
+		}
+	}
+}
+
 func TestIfElseExpression(t *testing.T) {
 	input := "if (x < y) { x } else { y }"
 
@@ -748,8 +1155,9 @@ func TestFunctionLiteral(t *testing.T) {
 
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
-		input          string
-		expectedParams []string
+		input            string
+		expectedParams   []string
+		expectedVariadic bool
 	}{
 		{
 			input: "fn() {};", expectedParams: []string{},
@@ -761,6 +1169,12 @@ func TestFunctionParameterParsing(t *testing.T) {
 		{
 			input: "fn(x, y) {};", expectedParams: []string{"x", "y"},
 		},
+		{
+			input: "fn(rest...) {};", expectedParams: []string{"rest"}, expectedVariadic: true,
+		},
+		{
+			input: "fn(x, rest...) {};", expectedParams: []string{"x", "rest"}, expectedVariadic: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -776,6 +1190,76 @@ func TestFunctionParameterParsing(t *testing.T) {
 		for i, ident := range tt.expectedParams {
 			testLiteralExpression(t, function.Parameters[i], ident)
 		}
+
+		if function.Variadic != tt.expectedVariadic {
+			t.Errorf("function.Variadic wrong. want %t, got %t", tt.expectedVariadic, function.Variadic)
+		}
+	}
+}
+
+func TestDefaultParameterParsing(t *testing.T) {
+	program := setup(t, "fn(x, y = 10, z = x + y) {};")
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	function := stmt.Expression.(*ast.FunctionLiteral)
+
+	if len(function.Defaults) != 3 {
+		t.Fatalf("len of defaults wrong. want 3, got %d", len(function.Defaults))
+	}
+
+	if function.Defaults[0] != nil {
+		t.Errorf("x has a default value. got=%s", function.Defaults[0])
+	}
+	testIntegerLiteral(t, function.Defaults[1], 10)
+	testInfixExpression(t, function.Defaults[2], "x", "+", "y")
+}
+
+func TestInvalidDefaultParameters(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"fn(x = 1, y) {};", "parameter y needs a default value"},
+		{"fn(rest = 1...) {};", "variadic parameter rest cannot have a default value"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expectedError {
+			t.Errorf("wrong errors for %q. want %q, got %q", tt.input, tt.expectedError, errors)
+		}
+	}
+}
+
+func TestInvalidPostfixTargets(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"1++;", "cannot apply ++ to 1"},
+		{"f()--;", "cannot apply -- to f()"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expectedError {
+			t.Errorf("wrong errors for %q. want %q, got %q", tt.input, tt.expectedError, errors)
+		}
+	}
+}
+
+func TestVariadicParameterMustBeLast(t *testing.T) {
+	p := New(lexer.New("fn(rest..., x) {};"))
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected parser errors but got none")
 	}
 }
 
@@ -916,6 +1400,9 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 
 		testIntegerLiteral(t, value, expectedValue)
 	}
+	if hash.String() != "{one:1, two:2, three:3}" {
+		t.Errorf("keys not kept in source order. got=%q", hash.String())
+	}
 }
 
 func TestParsingEmptyHashLiteral(t *testing.T) {
@@ -934,6 +1421,33 @@ func TestParsingEmptyHashLiteral(t *testing.T) {
 	}
 }
 
+func TestTrailingCommas(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3,]", "[1, 2, 3]"},
+		{"[\n\t1,\n\t2,\n]", "[1, 2]"},
+		{"{1: 2, 3: 4,}", "{1:2, 3:4}"},
+		{"f(a, b,)", "f(a, b)"},
+	}
+
+	for _, tt := range tests {
+		program := setup(t, tt.input)
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+
+	for _, input := range []string{"[,]", "{,}", "[1,,]", "f(,)"} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q but got none", input)
+		}
+	}
+}
+
 func TestParsingHashLiteralsWithExpression(t *testing.T) {
 	input := `{"one": 0+1, "two": 10-8, "three": 15/5}`
 
@@ -2,12 +2,9 @@ package repl
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"monkey/src/compiler"
-	"monkey/src/lexer"
-	"monkey/src/object"
-	"monkey/src/parser"
 	"monkey/src/vm"
 )
 
@@ -15,9 +12,7 @@ const PROMPT = ">> "
 
 func Start(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
-	symbolTable := compiler.NewSymbolTable()
+	session := NewSession(vm.WithOutput(out))
 
 	for {
 		fmt.Print(PROMPT)
@@ -26,36 +21,22 @@ func Start(in io.Reader, out io.Writer) {
 			return
 		}
 
-		line := scanner.Text()
+		result, err := session.Eval(scanner.Text())
 
-		l := lexer.New(line)
-		p := parser.New(l)
-
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
-		}
-
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation Failed:\n %s\n", err)
+		var parseErr *ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			printParserErrors(out, parseErr.Errors)
+			continue
+		case err != nil:
+			fmt.Fprintf(out, "Woops! %s\n", err)
 			continue
 		}
 
-		code := comp.Bytecode()
-		constants = code.Constants
-
-		machine := vm.NewWithGlobalsStore(code, globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+		if result != nil {
+			io.WriteString(out, result.Inspect())
+			io.WriteString(out, "\n")
 		}
-
-		stackTop := machine.LastPoppedStackElem()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
-
 	}
 }
 
@@ -0,0 +1,72 @@
+package repl
+
+import (
+	"fmt"
+	"monkey/src/compiler"
+	"monkey/src/lexer"
+	"monkey/src/object"
+	"monkey/src/parser"
+	"monkey/src/vm"
+	"strings"
+)
+
+// ParseError is returned by Session.Eval when the source could not be parsed.
+type ParseError struct {
+	Errors []string
+}
+
+func (e *ParseError) Error() string {
+	return "parser errors: " + strings.Join(e.Errors, "; ")
+}
+
+// Session evaluates successive pieces of source code as if they were one
+// program: names defined by one call to Eval can be used by the next.
+type Session struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+	opts        []vm.Option
+}
+
+// NewSession returns an empty Session. opts are applied to the VM of every
+// evaluation.
+func NewSession(opts ...vm.Option) *Session {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	return &Session{
+		symbolTable: symbolTable,
+		constants:   []object.Object{},
+		globals:     make([]object.Object, vm.GlobalsSize),
+		opts:        opts,
+	}
+}
+
+// Eval compiles and runs src and returns the value of its last expression
+// statement.
+func (s *Session) Eval(src string) (object.Object, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	comp := compiler.NewWithState(s.symbolTable, s.constants)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %w", err)
+	}
+
+	bytecode := comp.Bytecode()
+	s.constants = bytecode.Constants
+
+	machine := vm.NewWithGlobalsStore(bytecode, s.globals, s.opts...)
+	err = machine.Run()
+	if err != nil {
+		return nil, fmt.Errorf("executing bytecode failed: %w", err)
+	}
+
+	return machine.LastPoppedStackElem(), nil
+}
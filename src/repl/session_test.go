@@ -0,0 +1,87 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"monkey/src/object"
+	"monkey/src/vm"
+	"testing"
+)
+
+func TestSessionKeepsStateBetweenEvals(t *testing.T) {
+	s := NewSession()
+
+	steps := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 5", 5},
+		{"x + 1", 6},
+		{"let add = fn(a) { a + x }; add(10)", 15},
+		{"x = 7; add(1)", 8},
+		{"let y = 100; add(y)", 107},
+	}
+
+	for _, step := range steps {
+		result, err := s.Eval(step.input)
+		if err != nil {
+			t.Fatalf("eval %q failed: %s", step.input, err)
+		}
+
+		integer, ok := result.(*object.Integer)
+		if !ok {
+			t.Fatalf("result of %q is not Integer. got=%T (%+v)", step.input, result, result)
+		}
+		if integer.Value != step.expected {
+			t.Errorf("wrong result for %q. want=%d, got=%d", step.input, step.expected, integer.Value)
+		}
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	s := NewSession()
+
+	_, err := s.Eval("let = 1")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected *ParseError, got=%T (%v)", err, err)
+	}
+
+	_, err = s.Eval("y")
+	if err == nil || err.Error() != "compilation failed: undefined variable y" {
+		t.Fatalf("wrong compile error. got=%v", err)
+	}
+
+	_, err = s.Eval("1 / 0")
+	var runtimeErr *object.Error
+	if !errors.As(err, &runtimeErr) || runtimeErr.Kind != object.DivideByZero {
+		t.Fatalf("expected division by zero error, got=%v", err)
+	}
+
+	// a failed evaluation leaves the session usable
+	result, err := s.Eval("let z = 2; z * 21")
+	if err != nil {
+		t.Fatalf("eval failed: %s", err)
+	}
+	if result.Inspect() != "42" {
+		t.Errorf("wrong result. want=42, got=%s", result.Inspect())
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	var out bytes.Buffer
+	s := NewSession(vm.WithOutput(&out))
+
+	_, err := s.Eval(`let greet = fn(name) { puts("hi " + name) }`)
+	if err != nil {
+		t.Fatalf("eval failed: %s", err)
+	}
+	_, err = s.Eval(`greet("there")`)
+	if err != nil {
+		t.Fatalf("eval failed: %s", err)
+	}
+
+	if out.String() != "hi there\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
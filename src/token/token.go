@@ -14,6 +14,8 @@ const (
 	// Identifier + Literal
 	IDENT = "IDENT"
 	INT   = "INT"
+	FLOAT = "FLOAT"
+	CHAR  = "CHAR"
 
 	// Operators
 	ASSIGN    = "="
@@ -21,16 +23,28 @@ const (
 	MINUS     = "-"
 	SLASH     = "/"
 	ASTERISK  = "*"
+	POWER     = "**"
 	BANG      = "!"
 	EQ        = "=="
 	NOT_EQ    = "!="
 	BACKSLASH = "\\"
 
-	LT = "<"
-	GT = ">"
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+
+	INCREMENT = "++"
+	DECREMENT = "--"
+
+	LT    = "<"
+	GT    = ">"
+	LT_EQ = "<="
+	GT_EQ = ">="
 
 	COMMA     = ","
 	SEMICOLON = ";"
+	ELLIPSIS  = "..."
 
 	LPAREN = "("
 	RPAREN = ")"
@@ -40,6 +54,8 @@ const (
 	LBRACKET = "["
 	RBRACKET = "]"
 	COLON    = ":"
+	QUESTION = "?"
+	NULLISH  = "??"
 
 	FUNCTION = "FUNCTION"
 	LET      = "LET"
@@ -48,21 +64,48 @@ const (
 	RETURN   = "RETURN"
 	TRUE     = "TRUE"
 	FALSE    = "FALSE"
+	NULL     = "NULL"
 	STRING   = "STRING"
+	TEMPLATE = "TEMPLATE"
 	FOR      = "FOR"
 	IN       = "IN"
+	WHILE    = "WHILE"
+	DO       = "DO"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	YIELD    = "YIELD"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
 )
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"for":    FOR,
-	"in":     IN,
-	"let":    LET,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
-	"true":   TRUE,
-	"false":  FALSE,
+	"fn":       FUNCTION,
+	"for":      FOR,
+	"in":       IN,
+	"while":    WHILE,
+	"do":       DO,
+	"try":      TRY,
+	"catch":    CATCH,
+	"yield":    YIELD,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"let":      LET,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"true":     TRUE,
+	"false":    FALSE,
+	"null":     NULL,
+}
+
+// IsAssignment reports whether t is "=" or one of the compound assignment
+// operators.
+func IsAssignment(t TokenType) bool {
+	switch t {
+	case ASSIGN, PLUS_ASSIGN, MINUS_ASSIGN, ASTERISK_ASSIGN, SLASH_ASSIGN:
+		return true
+	}
+	return false
 }
 
 func LookupIdent(ident string) TokenType {
@@ -7,8 +7,15 @@ import (
 
 type Frame struct {
 	fn          *object.CompiledFunction
+	free        []object.Object // captured by the closure being run, if any
 	ip          int
 	basePointer int
+
+	// depth counts the calls in progress up to and including this frame's,
+	// also those whose frame was reused by a tail call
+	depth int
+
+	generator *object.Generator // set when the frame runs a generator
 }
 
 func NewFrame(fn *object.CompiledFunction, basePointer int) *Frame {
@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"io"
+	"math/rand"
+	"monkey/src/compiler"
+	"time"
+)
+
+// Option configures optional VM behaviour when it is created.
+type Option func(*VM)
+
+// WithProfiling makes the VM count how often each opcode is executed. The
+// counts are available from OpcodeCounts.
+func WithProfiling() Option {
+	return func(vm *VM) {
+		vm.profiling = true
+	}
+}
+
+// WithOutput makes builtins such as puts write to w instead of standard
+// output.
+func WithOutput(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.host.Out = w
+	}
+}
+
+// WithInput makes the input builtin read from r instead of standard input.
+func WithInput(r io.Reader) Option {
+	return func(vm *VM) {
+		vm.host.In = r
+	}
+}
+
+// WithClock makes the now builtin report the time returned by now instead of
+// the system clock.
+func WithClock(now func() time.Time) Option {
+	return func(vm *VM) {
+		vm.host.Now = now
+	}
+}
+
+// WithRand makes the rand and seed builtins use r.
+func WithRand(r *rand.Rand) Option {
+	return func(vm *VM) {
+		vm.host.Rand = r
+	}
+}
+
+// WithMaxArrayLength makes creating an array of more than n elements a
+// runtime error. n of zero or less removes the bound, which is
+// object.DefaultMaxArrayLength otherwise.
+func WithMaxArrayLength(n int) Option {
+	return func(vm *VM) {
+		vm.host.MaxArrayLength = n
+	}
+}
+
+// WithMaxRecursionDepth makes it a runtime error for more than n calls to be
+// in progress at once. Unlike the MaxFrames limit this counts tail calls,
+// which reuse their caller's frame, as calls of their own. n of zero or less
+// means no limit, which is the default.
+func WithMaxRecursionDepth(n int) Option {
+	return func(vm *VM) {
+		vm.maxDepth = n
+	}
+}
+
+// WithMaxInstructions makes it a runtime error for the VM to execute more
+// than n instructions in total, which bounds programs that never finish. n
+// of zero means no limit, which is the default.
+func WithMaxInstructions(n uint64) Option {
+	return func(vm *VM) {
+		vm.maxInstructions = n
+	}
+}
+
+// WithSymbolTable gives the VM the symbol table its bytecode was compiled
+// with, so that globals can be looked up by name with GetGlobal.
+func WithSymbolTable(s *compiler.SymbolTable) Option {
+	return func(vm *VM) {
+		vm.symbolTable = s
+	}
+}
@@ -0,0 +1,59 @@
+package vm
+
+import "monkey/src/object"
+
+// VMState is a checkpoint of a VM's globals, stack, frames and try handlers
+// taken with Snapshot. The slices are copies, but the objects they refer to
+// are shared with the VM, so mutating an array or hash in place is visible
+// through the snapshot as well. That includes generators: one that is
+// resumed after the snapshot was taken stays where it got to on Restore.
+type VMState struct {
+	globals     []object.Object
+	stack       []object.Object
+	sp          int
+	frames      []Frame
+	framesIndex int
+	handlers    []handler
+}
+
+// Snapshot captures the current execution state of the VM.
+func (vm *VM) Snapshot() *VMState {
+	s := &VMState{
+		globals:     make([]object.Object, vm.globalsHigh),
+		stack:       make([]object.Object, vm.sp),
+		sp:          vm.sp,
+		frames:      make([]Frame, vm.framesIndex),
+		framesIndex: vm.framesIndex,
+		handlers:    make([]handler, len(vm.handlers)),
+	}
+
+	copy(s.globals, vm.globals[:vm.globalsHigh])
+	copy(s.stack, vm.stack[:vm.sp])
+	for i := 0; i < vm.framesIndex; i++ {
+		s.frames[i] = *vm.frames[i]
+	}
+	copy(s.handlers, vm.handlers)
+
+	return s
+}
+
+// Restore rolls the VM back to a state captured by Snapshot. Globals defined
+// after the snapshot was taken are cleared.
+func (vm *VM) Restore(s *VMState) {
+	copy(vm.globals, s.globals)
+	for i := len(s.globals); i < vm.globalsHigh; i++ {
+		vm.globals[i] = nil
+	}
+	vm.globalsHigh = len(s.globals)
+
+	copy(vm.stack, s.stack)
+	vm.sp = s.sp
+
+	for i := 0; i < s.framesIndex; i++ {
+		frame := s.frames[i]
+		vm.frames[i] = &frame
+	}
+	vm.framesIndex = s.framesIndex
+
+	vm.handlers = append(vm.handlers[:0], s.handlers...)
+}
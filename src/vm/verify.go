@@ -0,0 +1,327 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/src/code"
+	"monkey/src/compiler"
+	"monkey/src/object"
+)
+
+// Verify checks that b can be run without the VM reading past the end of an
+// instruction stream or indexing outside the constants, builtins, locals or
+// captured values. It walks the main program and every function constant
+// and returns an error naming the first problem and its offset. Bytecode
+// that did not come from this compiler, e.g. loaded with
+// compiler.LoadBytecode, should be verified before it is run.
+func Verify(b *compiler.Bytecode) error {
+	free := freeCounts(b)
+
+	main := &object.CompiledFunction{Instructions: b.Instructions}
+	err := verifyFunction("main", main, true, 0, b.Constants)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		err := verifyFunction(fmt.Sprintf("constant %d", i), fn, false, free[i], b.Constants)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeCounts returns, for every function constant, how many captured values
+// it is certain to have: the fewest any OpClosure creating it provides, or
+// none if it is also loaded with OpConstant or never loaded at all.
+func freeCounts(b *compiler.Bytecode) map[int]int {
+	counts := make(map[int]int)
+
+	streams := []code.Instructions{b.Instructions}
+	for _, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			streams = append(streams, fn.Instructions)
+		}
+	}
+
+	for _, ins := range streams {
+		decoded, err := decode(ins)
+		if err != nil {
+			// reported with its offset by verifyFunction
+			continue
+		}
+
+		for _, d := range decoded {
+			var n int
+			switch d.op {
+			case code.OpConstant:
+				n = 0
+			case code.OpClosure:
+				n = d.operands[1]
+			default:
+				continue
+			}
+
+			index := d.operands[0]
+			if previous, ok := counts[index]; !ok || n < previous {
+				counts[index] = n
+			}
+		}
+	}
+
+	return counts
+}
+
+type verifiedInstruction struct {
+	pos      int
+	op       code.Opcode
+	operands []int
+}
+
+// decode splits ins into instructions, failing on an unknown opcode or
+// missing operand bytes.
+func decode(ins code.Instructions) ([]verifiedInstruction, error) {
+	decoded := []verifiedInstruction{}
+
+	for pos := 0; pos < len(ins); {
+		def, err := code.Lookup(ins[pos])
+		if err != nil {
+			return decoded, fmt.Errorf("offset %d: %s", pos, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if pos+1+width > len(ins) {
+			return decoded, fmt.Errorf("offset %d: %s needs %d operand bytes, got %d",
+				pos, def.Name, width, len(ins)-pos-1)
+		}
+
+		operands, _ := code.ReadOperands(def, ins[pos+1:])
+		decoded = append(decoded, verifiedInstruction{pos: pos, op: code.Opcode(ins[pos]), operands: operands})
+		pos += 1 + width
+	}
+
+	return decoded, nil
+}
+
+func verifyFunction(name string, fn *object.CompiledFunction, isMain bool, numFree int, constants []object.Object) error {
+	ins := fn.Instructions
+
+	decoded, err := decode(ins)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	starts := make(map[int]bool, len(decoded)+1)
+	for _, d := range decoded {
+		starts[d.pos] = true
+	}
+	// jumping to the end leaves the main program, but would run off the
+	// end of a function
+	if isMain {
+		starts[len(ins)] = true
+	}
+
+	if fn.NumLocals < fn.NumParameters {
+		return fmt.Errorf("%s: %d parameters but only %d locals", name, fn.NumParameters, fn.NumLocals)
+	}
+	for _, entry := range fn.DefaultEntries {
+		if !starts[entry] {
+			return fmt.Errorf("%s: default parameter entry %d is not an instruction", name, entry)
+		}
+	}
+
+	for _, d := range decoded {
+		def, _ := code.Lookup(byte(d.op))
+
+		switch d.op {
+		case code.OpConstant:
+			if d.operands[0] >= len(constants) {
+				return fmt.Errorf("%s: offset %d: constant index %d out of range, have %d",
+					name, d.pos, d.operands[0], len(constants))
+			}
+
+		case code.OpClosure:
+			if d.operands[0] >= len(constants) {
+				return fmt.Errorf("%s: offset %d: constant index %d out of range, have %d",
+					name, d.pos, d.operands[0], len(constants))
+			}
+			if _, ok := constants[d.operands[0]].(*object.CompiledFunction); !ok {
+				return fmt.Errorf("%s: offset %d: OpClosure of non-function constant %d",
+					name, d.pos, d.operands[0])
+			}
+
+		case code.OpJump, code.OpJumpNotTruthy, code.OpSetupTry:
+			if !starts[d.operands[0]] {
+				return fmt.Errorf("%s: offset %d: %s target %d is not an instruction",
+					name, d.pos, def.Name, d.operands[0])
+			}
+
+		case code.OpGetBuiltin:
+			if d.operands[0] >= len(object.Builtins) {
+				return fmt.Errorf("%s: offset %d: builtin index %d out of range, have %d",
+					name, d.pos, d.operands[0], len(object.Builtins))
+			}
+
+		case code.OpGetLocal, code.OpSetLocal:
+			if d.operands[0] >= fn.NumLocals {
+				return fmt.Errorf("%s: offset %d: local index %d out of range, have %d",
+					name, d.pos, d.operands[0], fn.NumLocals)
+			}
+
+		case code.OpHash:
+			if d.operands[0]%2 != 0 {
+				return fmt.Errorf("%s: offset %d: OpHash of %d values, which are not key-value pairs",
+					name, d.pos, d.operands[0])
+			}
+
+		case code.OpDestructure:
+			if d.operands[1] > 1 {
+				return fmt.Errorf("%s: offset %d: OpDestructure rest flag %d is neither 0 nor 1",
+					name, d.pos, d.operands[1])
+			}
+
+		case code.OpGetFree:
+			if d.operands[0] >= numFree {
+				return fmt.Errorf("%s: offset %d: free index %d out of range, have %d",
+					name, d.pos, d.operands[0], numFree)
+			}
+		}
+	}
+
+	return verifyStack(name, decoded, len(ins), isMain, fn.DefaultEntries)
+}
+
+// stackEffect returns how many values the instruction d pops off the stack
+// and how many it then pushes.
+func stackEffect(d verifiedInstruction) (pops, pushes int) {
+	switch d.op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal,
+		code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree, code.OpCurrentClosure:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpPow, code.OpIn,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterEqual,
+		code.OpLessThan, code.OpLessEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang, code.OpYield:
+		return 1, 1
+	case code.OpPopN:
+		return d.operands[0], 0
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal, code.OpReturnValue:
+		return 1, 0
+	case code.OpIndexAssign:
+		return 3, 1
+	case code.OpDup:
+		return 1, 2
+	case code.OpDupTwo:
+		return 2, 4
+	case code.OpArray, code.OpHash:
+		return d.operands[0], 1
+	case code.OpCall, code.OpTailCall:
+		return d.operands[0] + 1, 1
+	case code.OpClosure:
+		return d.operands[1], 1
+	case code.OpDestructure:
+		return 1, d.operands[0] + d.operands[1]
+	}
+	return 0, 0
+}
+
+// verifyStack follows every path through decoded, an instruction stream of
+// length size, to check that no instruction pops more values than are on
+// the stack. Where paths join the smallest stack depth counts. Execution may
+// only run past the end of the main program; a function has to return.
+func verifyStack(name string, decoded []verifiedInstruction, size int, isMain bool, entries []int) error {
+	index := make(map[int]int, len(decoded)+1)
+	for i, d := range decoded {
+		index[d.pos] = i
+	}
+	index[size] = len(decoded)
+
+	depths := make([]int, len(decoded)+1)
+	visited := make([]bool, len(decoded)+1)
+	worklist := []int{}
+
+	reach := func(from, pos, depth int) error {
+		i := index[pos]
+		if i == len(decoded) && !isMain {
+			return fmt.Errorf("%s: offset %d: execution runs past the end of the function", name, from)
+		}
+		if !visited[i] || depth < depths[i] {
+			visited[i] = true
+			depths[i] = depth
+			worklist = append(worklist, i)
+		}
+		return nil
+	}
+
+	for _, entry := range append([]int{0}, entries...) {
+		err := reach(0, entry, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for len(worklist) > 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		if i == len(decoded) {
+			continue
+		}
+
+		d := decoded[i]
+		def, _ := code.Lookup(byte(d.op))
+		next := size
+		if i+1 < len(decoded) {
+			next = decoded[i+1].pos
+		}
+
+		pops, pushes := stackEffect(d)
+		if pops > depths[i] {
+			return fmt.Errorf("%s: offset %d: %s pops %d values, stack has %d",
+				name, d.pos, def.Name, pops, depths[i])
+		}
+		depth := depths[i] - pops + pushes
+
+		var err error
+		switch d.op {
+		case code.OpReturnValue, code.OpReturn, code.OpTailCall:
+			if isMain {
+				return fmt.Errorf("%s: offset %d: %s outside of a function", name, d.pos, def.Name)
+			}
+			// a tail call of a builtin carries on with the OpReturnValue
+			// following it
+			if d.op == code.OpTailCall {
+				err = reach(d.pos, next, depth)
+			}
+		case code.OpJump:
+			err = reach(d.pos, d.operands[0], depth)
+		case code.OpJumpNotTruthy:
+			err = reach(d.pos, d.operands[0], depth)
+			if err == nil {
+				err = reach(d.pos, next, depth)
+			}
+		case code.OpSetupTry:
+			// the catch block starts with the error on the stack
+			err = reach(d.pos, d.operands[0], depth+1)
+			if err == nil {
+				err = reach(d.pos, next, depth)
+			}
+		default:
+			err = reach(d.pos, next, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,10 +1,14 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"monkey/src/code"
 	"monkey/src/compiler"
 	"monkey/src/object"
+	"time"
+	"unicode/utf8"
 )
 
 const StackSize = 2048
@@ -13,9 +17,9 @@ const MaxFrames = 1024
 
 const GlobalsSize = 65536
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
 
 type VM struct {
 	constants []object.Object
@@ -23,18 +27,34 @@ type VM struct {
 	stack []object.Object
 	sp    int // Always points to the next value. Top of stack is stack[sp-1]
 
-	globals []object.Object
+	globals     []object.Object
+	globalsHigh int // one past the highest global index written so far
 
 	frames      []*Frame
 	framesIndex int
+
+	profiling    bool
+	opcodeCounts [256]uint64
+
+	instructionCount uint64
+	framesPushed     uint64
+
+	handlers []handler // innermost try last
+
+	maxDepth        int    // of calls in progress; no limit when zero
+	maxInstructions uint64 // executed in total; no limit when zero
+
+	host *object.Host // passed to builtins
+
+	symbolTable *compiler.SymbolTable // only set WithSymbolTable
 }
 
-func New(bytecode *compiler.Bytecode) *VM {
+func New(bytecode *compiler.Bytecode, opts ...Option) *VM {
 	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
 	mainFrame := NewFrame(mainFn, 0)
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
-	return &VM{
+	vm := &VM{
 		constants: bytecode.Constants,
 
 		stack:       make([]object.Object, StackSize),
@@ -42,15 +62,84 @@ func New(bytecode *compiler.Bytecode) *VM {
 		globals:     make([]object.Object, GlobalsSize),
 		frames:      frames,
 		framesIndex: 1,
+
+		host: object.NewHost(),
+	}
+	vm.host.Call = vm.callValue
+	vm.host.Resume = vm.resumeGenerator
+
+	for _, opt := range opts {
+		opt(vm)
 	}
+
+	return vm
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object, opts ...Option) *VM {
+	vm := New(bytecode, opts...)
 	vm.globals = s
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] != nil {
+			vm.globalsHigh = i + 1
+			break
+		}
+	}
 	return vm
 }
 
+// handler records where to continue when a runtime error occurs inside a try
+// body, and the state to unwind to.
+type handler struct {
+	catchIP     int
+	framesIndex int
+	sp          int
+}
+
+// recoverFrom hands err to the innermost try handler, unless that belongs to a
+// frame at or below minFrames. It reports whether err was handled, in which
+// case execution continues in the handler's catch block.
+func (vm *VM) recoverFrom(err error, minFrames int) bool {
+	if len(vm.handlers) == 0 {
+		return false
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	// a try set up on a full stack has no room for the error
+	if h.framesIndex <= minFrames || h.sp >= StackSize {
+		return false
+	}
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	var runtimeErr *object.Error
+	if !errors.As(err, &runtimeErr) {
+		runtimeErr = object.NewError(object.RuntimeError, "%s", err)
+	}
+	// the program gets the error as a value, which must not halt the VM when
+	// passed through a builtin
+	caught := *runtimeErr
+	caught.Fatal = false
+
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+	vm.currentFrame().ip = h.catchIP - 1
+	vm.stack[vm.sp] = &caught
+	vm.sp++
+
+	return true
+}
+
+// dropHandlers removes the handlers of frames that have returned.
+func (vm *VM) dropHandlers() {
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex > vm.framesIndex {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
+
+// hasHandler reports whether the current frame is inside a try body.
+func (vm *VM) hasHandler() bool {
+	return len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex == vm.framesIndex
+}
+
 func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
@@ -58,6 +147,7 @@ func (vm *VM) currentFrame() *Frame {
 func (vm *VM) pushFrame(f *Frame) {
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	vm.framesPushed++
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -65,231 +155,818 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framesIndex]
 }
 
+// GetGlobal returns the value of the global variable name. It needs the VM to
+// have been created WithSymbolTable and reports false if name is not a global
+// or has not been set yet.
+func (vm *VM) GetGlobal(name string) (object.Object, bool) {
+	if vm.symbolTable == nil {
+		return nil, false
+	}
+
+	symbol, ok := vm.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope || symbol.Index >= len(vm.globals) {
+		return nil, false
+	}
+
+	value := vm.globals[symbol.Index]
+	return value, value != nil
+}
+
+// LastPoppedStackElem returns the value most recently popped off the stack,
+// or nil when the stack is full and so nothing can be above its top.
 func (vm *VM) LastPoppedStackElem() object.Object {
+	if vm.sp >= len(vm.stack) {
+		return nil
+	}
 	return vm.stack[vm.sp]
 }
 
+// OpcodeCounts reports how many times each opcode has been executed. It is
+// empty unless the VM was created WithProfiling.
+func (vm *VM) OpcodeCounts() map[code.Opcode]uint64 {
+	counts := make(map[code.Opcode]uint64)
+	for op, n := range vm.opcodeCounts {
+		if n > 0 {
+			counts[code.Opcode(op)] = n
+		}
+	}
+	return counts
+}
+
+// Run executes the program to its end, one execOne at a time, so that it
+// and Step share a single implementation of every opcode.
 func (vm *VM) Run() error {
-	var ip int
-	var ins code.Instructions
-	var op code.Opcode
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
-		vm.currentFrame().ip++
-
-		ip = vm.currentFrame().ip
-		ins = vm.currentFrame().Instructions()
-		op = code.Opcode(ins[ip])
-
-		switch op {
-		case code.OpConstant:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
-			err := vm.push(vm.constants[constIndex])
-			if err != nil {
-				return err
-			}
+	for !vm.finished() {
+		err := vm.execOne()
+		if err != nil && !vm.recoverFrom(err, 0) {
+			return err
+		}
+	}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-			err := vm.executeBinaryOperation(op)
-			if err != nil {
-				return err
-			}
+	return nil
+}
 
-		case code.OpPop:
-			vm.pop()
+// RunBytecode verifies b and runs it in a new VM configured by opts. It
+// returns the last value popped off the stack, as LastPoppedStackElem does.
+// Bytecode that fails verification is not run.
+func RunBytecode(b *compiler.Bytecode, opts ...Option) (object.Object, error) {
+	err := Verify(b)
+	if err != nil {
+		return nil, err
+	}
 
-		case code.OpTrue:
-			err := vm.push(True)
-			if err != nil {
-				return err
-			}
+	vm := New(b, opts...)
+	err = vm.Run()
+	if err != nil {
+		return nil, err
+	}
 
-		case code.OpFalse:
-			err := vm.push(False)
-			if err != nil {
-				return err
-			}
+	return vm.LastPoppedStackElem(), nil
+}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
-			err := vm.executeComparison(op)
-			if err != nil {
-				return err
-			}
+// RunStats describes the work done by RunWithStats.
+type RunStats struct {
+	Instructions uint64 // instructions executed
+	FramesPushed uint64 // function calls that got a new frame
+	Duration     time.Duration
+}
 
-		case code.OpBang:
-			err := vm.executeBangOperator()
-			if err != nil {
-				return err
-			}
+// RunWithStats is Run, also reporting how much work it took. The stats are
+// filled in even when running fails.
+func (vm *VM) RunWithStats() (RunStats, error) {
+	instructions := vm.instructionCount
+	frames := vm.framesPushed
+	start := time.Now()
 
-		case code.OpMinus:
-			err := vm.executeMinusOperator()
-			if err != nil {
-				return err
-			}
+	err := vm.Run()
 
-		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+	stats := RunStats{
+		Instructions: vm.instructionCount - instructions,
+		FramesPushed: vm.framesPushed - frames,
+		Duration:     time.Since(start),
+	}
+	return stats, err
+}
 
-			condition := vm.pop()
-			if !isTruthy(condition) {
-				vm.currentFrame().ip = pos - 1
-			}
+// Step executes a single instruction and reports whether the program has
+// run to completion.
+func (vm *VM) Step() (bool, error) {
+	if vm.finished() {
+		return true, nil
+	}
 
-		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip = pos - 1
+	err := vm.execOne()
+	if err != nil && !vm.recoverFrom(err, 0) {
+		return true, err
+	}
 
-		case code.OpNull:
-			err := vm.push(Null)
-			if err != nil {
-				return err
-			}
+	return vm.finished(), nil
+}
 
-		case code.OpSetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+// IP returns the instruction pointer of the current frame. It points at the
+// last executed instruction, or -1 before the frame has started.
+func (vm *VM) IP() int {
+	return vm.currentFrame().ip
+}
 
-			vm.globals[globalIndex] = vm.pop()
+// FrameIndex returns the index of the current frame; 0 is the main program.
+func (vm *VM) FrameIndex() int {
+	return vm.framesIndex - 1
+}
 
-		case code.OpGetGlobal:
+// StackTop returns the value on top of the stack, or nil if it is empty.
+func (vm *VM) StackTop() object.Object {
+	if vm.sp == 0 {
+		return nil
+	}
+	return vm.stack[vm.sp-1]
+}
 
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+func (vm *VM) finished() bool {
+	frame := vm.currentFrame()
+	return frame.ip >= len(frame.Instructions())-1
+}
 
-			err := vm.push(vm.globals[globalIndex])
-			if err != nil {
-				return err
-			}
-		case code.OpArray:
-			numElements := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
-			array := vm.buildArray(vm.sp-int(numElements), vm.sp)
-			vm.sp = vm.sp - int(numElements)
+// instructionLimitExceeded returns the error for executing more
+// instructions than the VM was configured to allow.
+func (vm *VM) instructionLimitExceeded() error {
+	return object.NewError(object.RuntimeError, "instruction limit exceeded (limit=%d)", vm.maxInstructions)
+}
 
-			err := vm.push(array)
+// execOne executes the instruction following the current frame's ip.
+func (vm *VM) execOne() error {
+	vm.instructionCount++
+	if vm.maxInstructions > 0 && vm.instructionCount > vm.maxInstructions {
+		return vm.instructionLimitExceeded()
+	}
+	return vm.execute()
+}
 
-			if err != nil {
-				return err
-			}
+// execute is execOne for an instruction that has already been counted.
+func (vm *VM) execute() error {
+	frame := vm.currentFrame()
+	ins := frame.Instructions()
 
-		case code.OpHash:
-			numElements := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
-			hash, err := vm.buildHash(vm.sp-int(numElements), vm.sp)
-			if err != nil {
-				return err
-			}
+	frame.ip++
+	ip := frame.ip
+	op := code.Opcode(ins[ip])
 
-			vm.sp = vm.sp - int(numElements)
+	if vm.profiling {
+		vm.opcodeCounts[op]++
+	}
 
-			err = vm.push(hash)
-			if err != nil {
-				return err
-			}
+	switch op {
+	case code.OpConstant:
+		constIndex := code.ReadUint16(ins[ip+1:])
+		frame.ip += 2
+		err := vm.push(vm.constants[constIndex])
+		if err != nil {
+			return err
+		}
 
-		case code.OpIndex:
-			index := vm.pop()
-			left := vm.pop()
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpPow:
+		err := vm.executeBinaryOperation(op)
+		if err != nil {
+			return err
+		}
 
-			err := vm.executeIndexExpression(left, index)
-			if err != nil {
-				return err
-			}
+	case code.OpPop:
+		vm.pop()
 
-		case code.OpIndexAssign:
-			value := vm.pop()
-			index := vm.pop()
-			left := vm.pop()
+	case code.OpPopN:
+		n := int(code.ReadUint8(ins[ip+1:]))
+		frame.ip += 1
+		// LastPoppedStackElem sees the deepest value, as after n OpPops
+		vm.sp -= n
 
-			err := vm.executeIndexAssignmentExpression(left, index, value)
-			if err != nil {
-				return err
-			}
+	case code.OpNoOp:
 
-		case code.OpCall:
-			numArgs := code.ReadUint8(ins[ip+1:])
-			err := vm.callFunction(int(numArgs))
-			if err != nil {
-				return err
-			}
+	case code.OpDup:
+		err := vm.push(vm.stack[vm.sp-1])
+		if err != nil {
+			return err
+		}
 
-		case code.OpSetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+	case code.OpDupTwo:
+		err := vm.push(vm.stack[vm.sp-2])
+		if err != nil {
+			return err
+		}
+		err = vm.push(vm.stack[vm.sp-2])
+		if err != nil {
+			return err
+		}
 
-			frame := vm.currentFrame()
+	case code.OpDestructure:
+		numNames := int(code.ReadUint16(ins[ip+1:]))
+		hasRest := code.ReadUint8(ins[ip+3:]) == 1
+		frame.ip += 3
 
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		err := vm.executeDestructure(vm.pop(), numNames, hasRest)
+		if err != nil {
+			return err
+		}
 
-		case code.OpGetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+	case code.OpTrue:
+		err := vm.push(True)
+		if err != nil {
+			return err
+		}
 
-			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
-			if err != nil {
-				return err
-			}
+	case code.OpFalse:
+		err := vm.push(False)
+		if err != nil {
+			return err
+		}
 
-		case code.OpReturn:
-			frame := vm.popFrame()
-			vm.sp = frame.basePointer - 1
+	case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterEqual, code.OpLessThan, code.OpLessEqual:
+		err := vm.executeComparison(op)
+		if err != nil {
+			return err
+		}
 
-			err := vm.push(Null)
-			if err != nil {
-				return err
-			}
+	case code.OpIn:
+		err := vm.executeInOperator()
+		if err != nil {
+			return err
+		}
 
-		case code.OpReturnValue:
-			returnValue := vm.pop()
+	case code.OpBang:
+		err := vm.executeBangOperator()
+		if err != nil {
+			return err
+		}
 
-			frame := vm.popFrame()
-			vm.sp = frame.basePointer - 1
+	case code.OpMinus:
+		err := vm.executeMinusOperator()
+		if err != nil {
+			return err
+		}
 
-			err := vm.push(returnValue)
-			if err != nil {
-				return err
-			}
+	case code.OpJumpNotTruthy:
+		pos := int(code.ReadUint16(ins[ip+1:]))
+		frame.ip += 2
+
+		condition := vm.pop()
+		if !object.IsTruthy(condition) {
+			frame.ip = pos - 1
+		}
+
+	case code.OpJump:
+		pos := int(code.ReadUint16(ins[ip+1:]))
+		frame.ip = pos - 1
+
+	case code.OpNull:
+		err := vm.push(Null)
+		if err != nil {
+			return err
+		}
+
+	case code.OpSetGlobal:
+		globalIndex := code.ReadUint16(ins[ip+1:])
+		frame.ip += 2
+
+		err := vm.checkGlobalIndex(globalIndex)
+		if err != nil {
+			return err
+		}
+
+		vm.globals[globalIndex] = vm.pop()
+		if int(globalIndex) >= vm.globalsHigh {
+			vm.globalsHigh = int(globalIndex) + 1
+		}
+
+	case code.OpGetGlobal:
+
+		globalIndex := code.ReadUint16(ins[ip+1:])
+		frame.ip += 2
+
+		err := vm.checkGlobalIndex(globalIndex)
+		if err != nil {
+			return err
+		}
+
+		err = vm.pushVariable(vm.globals[globalIndex])
+		if err != nil {
+			return err
+		}
+	case code.OpArray:
+		numElements := code.ReadUint16(ins[ip+1:])
+		frame.ip += 2
+		array, err := vm.buildArray(vm.sp-int(numElements), vm.sp)
+		if err != nil {
+			return err
+		}
+		vm.sp = vm.sp - int(numElements)
+
+		err = vm.push(array)
+
+		if err != nil {
+			return err
+		}
+
+	case code.OpHash:
+		numElements := code.ReadUint16(ins[ip+1:])
+		frame.ip += 2
+		hash, err := vm.buildHash(vm.sp-int(numElements), vm.sp)
+		if err != nil {
+			return err
+		}
+
+		vm.sp = vm.sp - int(numElements)
+
+		err = vm.push(hash)
+		if err != nil {
+			return err
+		}
+
+	case code.OpIndex:
+		index := vm.pop()
+		left := vm.pop()
+
+		err := vm.executeIndexExpression(left, index)
+		if err != nil {
+			return err
+		}
+
+	case code.OpIndexAssign:
+		value := vm.pop()
+		index := vm.pop()
+		left := vm.pop()
+
+		err := vm.executeIndexAssignmentExpression(left, index, value)
+		if err != nil {
+			return err
+		}
+
+	case code.OpCall:
+		numArgs := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		err := vm.executeCall(int(numArgs))
+		if err != nil {
+			return err
+		}
+
+	case code.OpTailCall:
+		numArgs := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		err := vm.executeTailCall(int(numArgs))
+		if err != nil {
+			return err
+		}
+
+	case code.OpGetBuiltin:
+		builtinIndex := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		definition := object.Builtins[builtinIndex]
+
+		err := vm.push(definition.Builtin)
+		if err != nil {
+			return err
+		}
+
+	case code.OpSetLocal:
+		localIndex := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+
+	case code.OpGetLocal:
+		localIndex := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		err := vm.pushVariable(vm.stack[frame.basePointer+int(localIndex)])
+		if err != nil {
+			return err
 		}
 
+	case code.OpClosure:
+		constIndex := code.ReadUint16(ins[ip+1:])
+		numFree := int(code.ReadUint8(ins[ip+3:]))
+		frame.ip += 3
+
+		fn, ok := vm.constants[constIndex].(*object.CompiledFunction)
+		if !ok {
+			return object.NewError(object.RuntimeError, "not a function: %s", vm.constants[constIndex].Type())
+		}
+
+		free := make([]object.Object, numFree)
+		copy(free, vm.stack[vm.sp-numFree:vm.sp])
+		vm.sp = vm.sp - numFree
+
+		err := vm.push(&object.Closure{Fn: fn, Free: free})
+		if err != nil {
+			return err
+		}
+
+	case code.OpGetFree:
+		freeIndex := code.ReadUint8(ins[ip+1:])
+		frame.ip += 1
+
+		err := vm.push(frame.free[freeIndex])
+		if err != nil {
+			return err
+		}
+
+	case code.OpCurrentClosure:
+		var current object.Object = frame.fn
+		if frame.free != nil {
+			current = &object.Closure{Fn: frame.fn, Free: frame.free}
+		}
+
+		err := vm.push(current)
+		if err != nil {
+			return err
+		}
+
+	case code.OpSetupTry:
+		catchIP := int(code.ReadUint16(ins[ip+1:]))
+		frame.ip += 2
+		vm.handlers = append(vm.handlers, handler{catchIP: catchIP, framesIndex: vm.framesIndex, sp: vm.sp})
+
+	case code.OpPopTry:
+		n := len(vm.handlers)
+		if n == 0 || vm.handlers[n-1].framesIndex != vm.framesIndex {
+			return object.NewError(object.RuntimeError, "no try block to leave")
+		}
+		vm.handlers = vm.handlers[:n-1]
+
+	case code.OpCheckStack:
+		// between statements nothing but the frame's locals is on the stack
+		want := frame.basePointer + frame.fn.NumLocals
+		if vm.sp != want {
+			return object.NewError(object.RuntimeError, "unbalanced stack at %d: sp=%d, want=%d", ip, vm.sp, want)
+		}
+
+	case code.OpYield:
+		value := vm.pop()
+		gen := frame.generator
+		if gen == nil {
+			return object.NewError(object.RuntimeError, "yield outside of generator")
+		}
+
+		// the yield expression evaluates to null once the generator resumes
+		err := vm.push(Null)
+		if err != nil {
+			return err
+		}
+		vm.suspend(gen, frame)
+		gen.Running = false
+
+		err = vm.push(value)
+		if err != nil {
+			return err
+		}
+
+	case code.OpReturn:
+		if frame.generator != nil {
+			frame.generator.Running = false
+			frame.generator.Done = true
+		}
+		vm.popFrame()
+		vm.dropHandlers()
+		vm.sp = frame.basePointer - 1
+
+		err := vm.push(Null)
+		if err != nil {
+			return err
+		}
+
+	case code.OpReturnValue:
+		returnValue := vm.pop()
+		// a generator that returns is exhausted, and next gives null
+		if frame.generator != nil {
+			frame.generator.Running = false
+			frame.generator.Done = true
+			returnValue = Null
+		}
+
+		vm.popFrame()
+		vm.dropHandlers()
+		vm.sp = frame.basePointer - 1
+
+		err := vm.push(returnValue)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
+// callValue calls fn with args on behalf of a builtin and runs the VM until
+// the call has returned.
+func (vm *VM) callValue(fn object.Object, args ...object.Object) (object.Object, error) {
+	frames := vm.framesIndex
+
+	err := vm.push(fn)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		err := vm.push(arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = vm.executeCall(len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	for vm.framesIndex > frames {
+		err := vm.execOne()
+		if err != nil && !vm.recoverFrom(err, frames) {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// checkGlobalIndex guards the globals store against indexes it is too small
+// for, which only hand-made bytecode or a smaller store passed to
+// NewWithGlobalsStore can produce.
+func (vm *VM) checkGlobalIndex(index uint16) error {
+	if int(index) >= len(vm.globals) {
+		return object.NewError(object.IndexError, "global index out of range")
+	}
+	return nil
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.CompiledFunction:
+		return vm.callFunction(callee, nil, numArgs)
+	case *object.Closure:
+		return vm.callFunction(callee.Fn, callee.Free, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	case *object.Memoized:
+		return vm.callMemoized(callee, numArgs)
+	case *object.Partial:
+		return vm.callPartial(callee, numArgs)
+	case nil:
+		return object.NewError(object.TypeError, "calling non-function")
 	default:
-		return true
+		return object.NewError(object.TypeError, "cannot call object of type %s", callee.Type())
 	}
 }
 
-func (vm *VM) callFunction(numArgs int) error {
-	vm.currentFrame().ip += 1
-	fn, ok := vm.stack[vm.sp-1-int(numArgs)].(*object.CompiledFunction)
-	if !ok {
-		return fmt.Errorf("calling non-function")
+// executeTailCall reuses the current frame when a function calls itself in
+// tail position with exactly its parameters, so that tail recursion runs in
+// constant space. Every other call goes through executeCall.
+func (vm *VM) executeTailCall(numArgs int) error {
+	frame := vm.currentFrame()
+
+	var fn *object.CompiledFunction
+	var free []object.Object
+	switch callee := vm.stack[vm.sp-1-numArgs].(type) {
+	case *object.CompiledFunction:
+		fn = callee
+	case *object.Closure:
+		fn, free = callee.Fn, callee.Free
+	}
+
+	// the frame cannot be reused while a try in it is waiting for errors
+	if fn != frame.fn || fn.Generator || fn.Variadic || fn.DefaultEntries != nil || numArgs != fn.NumParameters || vm.hasHandler() {
+		return vm.executeCall(numArgs)
+	}
+
+	err := vm.checkDepth(frame.depth + 1)
+	if err != nil {
+		return err
+	}
+	frame.depth++
+
+	copy(vm.stack[frame.basePointer:], vm.stack[vm.sp-numArgs:vm.sp])
+	frame.free = free
+	// as in callFunction, the next call must not see the previous one's
+	// locals
+	for i := frame.basePointer + numArgs; i < frame.basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	vm.sp = frame.basePointer + fn.NumLocals
+	frame.ip = -1
+
+	return nil
+}
+
+// callFunction calls fn, giving it the captured values free if it is the
+// function of a closure.
+func (vm *VM) callFunction(fn *object.CompiledFunction, free []object.Object, numArgs int) error {
+	fixed := fn.NumParameters
+	if fn.Variadic {
+		fixed--
+	}
+	required := fixed - fn.NumDefaults()
+
+	switch {
+	case required == fixed && !fn.Variadic && numArgs != fixed:
+		return arityError(fn, fmt.Sprintf("want=%d got=%d", fixed, numArgs))
+	case numArgs < required:
+		return arityError(fn, fmt.Sprintf("want at least %d got=%d", required, numArgs))
+	case numArgs > fixed && !fn.Variadic:
+		return arityError(fn, fmt.Sprintf("want at most %d got=%d", fixed, numArgs))
+	}
+
+	if vm.framesIndex >= MaxFrames {
+		return vm.stackOverflow(fn)
 	}
-	if fn.NumParameters != numArgs {
-		return fmt.Errorf("wrong number of arguments: want=%d got=%d", fn.NumParameters, numArgs)
+	depth := vm.currentFrame().depth + 1
+	err := vm.checkDepth(depth)
+	if err != nil {
+		return err
+	}
+
+	passed := numArgs
+	if fn.Variadic && numArgs >= fixed {
+		err := vm.collectRestArguments(numArgs - fixed)
+		if err != nil {
+			return err
+		}
+		passed = fixed
+		numArgs = fn.NumParameters
 	}
 
 	frame := NewFrame(fn, vm.sp-numArgs)
+	if frame.basePointer+fn.NumLocals > StackSize {
+		return vm.stackOverflow(fn)
+	}
+	frame.free = free
+	frame.depth = depth
+	if fn.DefaultEntries != nil {
+		// skip the defaults of the parameters that were passed
+		frame.ip = fn.DefaultEntries[passed-required] - 1
+	}
 	vm.pushFrame(frame)
+	// locals not yet assigned must not see what an earlier call left there
+	for i := vm.sp; i < frame.basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
 	vm.sp = frame.basePointer + fn.NumLocals
 
+	if fn.Variadic && passed < fixed {
+		vm.stack[frame.basePointer+fixed] = &object.Array{Elements: []object.Object{}}
+	}
+
+	if fn.Generator {
+		// the body doesn't start running until the first next
+		gen := &object.Generator{Fn: fn, Free: free}
+		vm.suspend(gen, frame)
+		return vm.push(gen)
+	}
+
 	return nil
 }
 
+// suspend moves the generator frame on top of the frame stack into gen and
+// removes it, leaving the stack as it was before the generator's callee slot.
+func (vm *VM) suspend(gen *object.Generator, frame *Frame) {
+	gen.IP = frame.ip
+	gen.Stack = append(gen.Stack[:0], vm.stack[frame.basePointer:vm.sp]...)
+
+	vm.popFrame()
+	vm.sp = frame.basePointer - 1
+}
+
+// resumeGenerator runs gen on behalf of the next builtin until it yields or
+// returns. Its frame is put back on top of the caller's, so a running
+// generator counts toward MaxFrames like any call, while a suspended one
+// holds no frame at all.
+func (vm *VM) resumeGenerator(gen *object.Generator) (object.Object, error) {
+	if gen.Done {
+		return Null, nil
+	}
+	if gen.Running {
+		return nil, object.NewError(object.RuntimeError, "generator is already running")
+	}
+	if vm.framesIndex >= MaxFrames || vm.sp+1+len(gen.Stack) > StackSize {
+		return nil, vm.stackOverflow(gen.Fn)
+	}
+	depth := vm.currentFrame().depth + 1
+	if err := vm.checkDepth(depth); err != nil {
+		return nil, err
+	}
+
+	frames := vm.framesIndex
+
+	// the generator takes the place of the callee below the frame
+	vm.stack[vm.sp] = gen
+	vm.sp++
+	frame := NewFrame(gen.Fn, vm.sp)
+	frame.free = gen.Free
+	frame.depth = depth
+	frame.ip = gen.IP
+	frame.generator = gen
+	vm.sp += copy(vm.stack[vm.sp:], gen.Stack)
+	vm.pushFrame(frame)
+	gen.Running = true
+
+	for vm.framesIndex > frames {
+		err := vm.execOne()
+		if err != nil && !vm.recoverFrom(err, frames) {
+			gen.Running = false
+			gen.Done = true
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// collectRestArguments replaces the top n arguments on the stack with a
+// single Array holding them.
+func (vm *VM) collectRestArguments(n int) error {
+	rest := make([]object.Object, n)
+	copy(rest, vm.stack[vm.sp-n:vm.sp])
+	vm.sp = vm.sp - n
+	return vm.push(&object.Array{Elements: rest})
+}
+
+func arityError(fn *object.CompiledFunction, detail string) error {
+	if fn.Name != "" {
+		return object.NewError(object.ArgumentError, "wrong number of arguments to %s: %s", fn.Name, detail)
+	}
+	return object.NewError(object.ArgumentError, "wrong number of arguments: %s", detail)
+}
+
+// resolveIndex maps a possibly negative index onto a position counted from
+// the start of a sequence of the given length.
+func resolveIndex(i int64, length int) int64 {
+	if i < 0 {
+		return int64(length) + i
+	}
+	return i
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result := builtin.Fn(vm.host, args...)
+	vm.sp = vm.sp - numArgs - 1
+
+	if result == nil {
+		return vm.push(Null)
+	}
+
+	if err, ok := result.(*object.Error); ok && err.Fatal {
+		return err
+	}
+
+	return vm.push(result)
+}
+
+// callPartial puts the wrapped function and the bound arguments in place of
+// the partial on the stack and calls it. Arity is only checked then.
+func (vm *VM) callPartial(p *object.Partial, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+	vm.sp = vm.sp - numArgs - 1
+
+	err := vm.push(p.Fn)
+	if err != nil {
+		return err
+	}
+	for _, arg := range append(p.Args, args...) {
+		err := vm.push(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return vm.executeCall(len(p.Args) + numArgs)
+}
+
+// callMemoized answers from the cache when it can and otherwise calls the
+// wrapped function, remembering what it returns.
+func (vm *VM) callMemoized(m *object.Memoized, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+	vm.sp = vm.sp - numArgs - 1
+
+	key := m.CacheKey(args)
+	if result, ok := m.Cache[key]; ok {
+		return vm.push(result)
+	}
+
+	result, err := vm.callValue(m.Fn, args...)
+	if err != nil {
+		return err
+	}
+	m.Cache[key] = result
+
+	return vm.push(result)
+}
+
 func (vm *VM) executeArrayIndexExpression(left, index object.Object) error {
 	arrayObject := left.(*object.Array)
-	i := index.(*object.Integer).Value
+	i := resolveIndex(index.(*object.Integer).Value, len(arrayObject.Elements))
 	max := int64(len(arrayObject.Elements) - 1)
 	if i < 0 || i > max {
 		return vm.push(Null)
@@ -300,12 +977,12 @@ func (vm *VM) executeArrayIndexExpression(left, index object.Object) error {
 
 func (vm *VM) executeHashIndexExpression(left, index object.Object) error {
 	hashObject := left.(*object.Hash)
-	key, ok := index.(object.Hashable)
+	key, ok := object.KeyFor(index)
 	if !ok {
-		return fmt.Errorf("unusable hash key: %s", index.Type())
+		return object.NewError(object.TypeError, "%w: %s", object.ErrUnhashable, index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
 		return vm.push(Null)
 	}
@@ -313,20 +990,68 @@ func (vm *VM) executeHashIndexExpression(left, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+// executeDestructure pushes the first numNames elements of value, preceded by
+// an array of the remaining ones if hasRest is set, with the first element
+// ending up on top of the stack.
+func (vm *VM) executeDestructure(value object.Object, numNames int, hasRest bool) error {
+	array, ok := value.(*object.Array)
+	if !ok {
+		return object.NewError(object.TypeError, "cannot destructure %s", value.Type())
+	}
+	if len(array.Elements) < numNames {
+		return object.NewError(object.IndexError, "not enough elements to destructure: want at least %d got %d", numNames, len(array.Elements))
+	}
+
+	if hasRest {
+		rest := make([]object.Object, len(array.Elements)-numNames)
+		copy(rest, array.Elements[numNames:])
+		err := vm.push(&object.Array{Elements: rest})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := numNames - 1; i >= 0; i-- {
+		err := vm.push(array.Elements[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// executeErrorIndexExpression gives access to the "message" and "kind" of an
+// error caught by try.
+func (vm *VM) executeErrorIndexExpression(left, index object.Object) error {
+	errorObject := left.(*object.Error)
+
+	switch index.(*object.String).Value {
+	case "message":
+		return vm.push(&object.String{Value: errorObject.Message})
+	case "kind":
+		return vm.push(&object.String{Value: errorObject.Kind.String()})
+	default:
+		return vm.push(Null)
+	}
+}
+
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndexExpression(left, index)
+	case left.Type() == object.ERROR_OBJ && index.Type() == object.STRING_OBJ:
+		return vm.executeErrorIndexExpression(left, index)
 	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
+		return object.NewError(object.TypeError, "index operator not supported: %s", left.Type())
 	}
 }
 
 func (vm *VM) executeArrayIndexAssignmentExpression(left, index, value object.Object) error {
 	arrayObject := left.(*object.Array)
-	i := index.(*object.Integer).Value
+	i := resolveIndex(index.(*object.Integer).Value, len(arrayObject.Elements))
 	max := int64(len(arrayObject.Elements) - 1)
 	if i < 0 || i > max {
 		return vm.push(Null)
@@ -339,14 +1064,14 @@ func (vm *VM) executeArrayIndexAssignmentExpression(left, index, value object.Ob
 
 func (vm *VM) executeHashIndexAssignmentExpression(left, index, value object.Object) error {
 	hashObject := left.(*object.Hash)
-	key, ok := index.(object.Hashable)
+	key, ok := object.KeyFor(index)
 	if !ok {
-		return fmt.Errorf("unusable hash key: %s", index.Type())
+		return object.NewError(object.TypeError, "%w: %s", object.ErrUnhashable, index.Type())
 	}
 
 	pair := object.HashPair{Key: index, Value: value}
 
-	hashObject.Pairs[key.HashKey()] = pair
+	hashObject.Set(key, pair)
 
 	return vm.push(value)
 }
@@ -358,18 +1083,20 @@ func (vm *VM) executeIndexAssignmentExpression(left, index, value object.Object)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndexAssignmentExpression(left, index, value)
 	default:
-		return fmt.Errorf("index assign operator not supported: %s", left.Type())
+		return object.NewError(object.TypeError, "index assign operator not supported: %s", left.Type())
 	}
 }
 
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(object.NewInteger(-operand.Value))
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return object.NewError(object.TypeError, "unsupported type for negation: %s", operand.Type())
 	}
-
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
 }
 
 func (vm *VM) executeBangOperator() error {
@@ -394,14 +1121,72 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if leftValue, rightValue, ok := floatOperands(left, right); ok {
+		return vm.executeFloatComparison(op, leftValue, rightValue)
+	}
+
+	if left.Type() == object.CHAR_OBJ && right.Type() == object.CHAR_OBJ {
+		leftValue := object.NewInteger(int64(left.(*object.Char).Value))
+		rightValue := object.NewInteger(int64(right.(*object.Char).Value))
+		return vm.executeIntegerComparison(op, leftValue, rightValue)
+	}
+
+	// booleans order as false < true
+	if left.Type() == object.BOOLEAN_OBJ && right.Type() == object.BOOLEAN_OBJ {
+		leftValue := object.NewInteger(boolToInt(left.(*object.Boolean).Value))
+		rightValue := object.NewInteger(boolToInt(right.(*object.Boolean).Value))
+		return vm.executeIntegerComparison(op, leftValue, rightValue)
+	}
+
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(left == right))
+		return vm.push(nativeBoolToBooleanObject(object.Equal(left, right)))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(left != right))
+		return vm.push(nativeBoolToBooleanObject(!object.Equal(left, right)))
+	default:
+		return object.NewError(object.RuntimeError, "unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+}
+
+// executeInOperator pops a container and a value and pushes whether the
+// value is a key of the hash, an element of the array or a member of the set.
+func (vm *VM) executeInOperator() error {
+	container := vm.pop()
+	value := vm.pop()
+
+	switch container := container.(type) {
+	case *object.Hash:
+		key, ok := object.KeyFor(value)
+		if !ok {
+			return object.NewError(object.TypeError, "%w: %s", object.ErrUnhashable, value.Type())
+		}
+		_, found := container.Pairs[key]
+		return vm.push(nativeBoolToBooleanObject(found))
+
+	case *object.Array:
+		for _, el := range container.Elements {
+			if object.Equal(el, value) {
+				return vm.push(True)
+			}
+		}
+		return vm.push(False)
+
+	case *object.Set:
+		if _, ok := object.KeyFor(value); !ok {
+			return object.NewError(object.TypeError, "%w: %s", object.ErrUnhashable, value.Type())
+		}
+		return vm.push(nativeBoolToBooleanObject(container.Has(value)))
+
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+		return object.NewError(object.TypeError, "operator in not supported for %s", container.Type())
+	}
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
 	}
+	return 0
 }
 
 func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
@@ -415,12 +1200,56 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return object.NewError(object.RuntimeError, "unknown operator: %d", op)
 	}
 
 }
 
+func (vm *VM) executeFloatComparison(op code.Opcode, leftValue, rightValue float64) error {
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return object.NewError(object.RuntimeError, "unknown operator: %d", op)
+	}
+}
+
+// floatOperands converts a pair of numbers of which at least one is a Float
+// to float64s, so that mixed arithmetic is done on Floats.
+func floatOperands(left, right object.Object) (float64, float64, bool) {
+	if left.Type() != object.FLOAT_OBJ && right.Type() != object.FLOAT_OBJ {
+		return 0, 0, false
+	}
+
+	leftValue, ok := object.ToFloat(left)
+	if !ok {
+		return 0, 0, false
+	}
+	rightValue, ok := object.ToFloat(right)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return leftValue, rightValue, true
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -429,7 +1258,7 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 }
 
 func (vm *VM) buildHash(start, end int) (object.Object, error) {
-	pairs := make(map[object.HashKey]object.HashPair)
+	hash := object.NewHash((end - start) / 2)
 
 	for i := start; i < end; i += 2 {
 		key := vm.stack[i]
@@ -437,25 +1266,29 @@ func (vm *VM) buildHash(start, end int) (object.Object, error) {
 
 		pair := object.HashPair{Key: key, Value: value}
 
-		hashKey, ok := key.(object.Hashable)
+		hashKey, ok := object.KeyFor(key)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			return nil, object.NewError(object.TypeError, "%w: %s", object.ErrUnhashable, key.Type())
 		}
 
-		pairs[hashKey.HashKey()] = pair
+		hash.Set(hashKey, pair)
 	}
 
-	return &object.Hash{Pairs: pairs}, nil
+	return hash, nil
 }
 
-func (vm *VM) buildArray(start, end int) object.Object {
+func (vm *VM) buildArray(start, end int) (object.Object, error) {
+	if err := vm.host.CheckArrayLength(int64(end - start)); err != nil {
+		return nil, err
+	}
+
 	elements := make([]object.Object, end-start)
 
 	for i := start; i < end; i++ {
 		elements[i-start] = vm.stack[i]
 	}
 
-	return &object.Array{Elements: elements}
+	return &object.Array{Elements: elements}, nil
 }
 
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
@@ -470,17 +1303,25 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.executeBinaryIntegerOperation(op, left, right)
 	}
 
+	if leftValue, rightValue, ok := floatOperands(left, right); ok {
+		return vm.executeBinaryFloatOperation(op, leftValue, rightValue)
+	}
+
+	if leftType == object.CHAR_OBJ || rightType == object.CHAR_OBJ {
+		return vm.executeBinaryCharOperation(op, left, right)
+	}
+
 	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
 
-	return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+	return object.NewError(object.TypeError, "unsupported types for binary operation: %s %s", leftType, rightType)
 
 }
 
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unkown string operator: %d", op)
+		return object.NewError(object.RuntimeError, "unkown string operator: %d", op)
 	}
 
 	leftValue := left.(*object.String).Value
@@ -503,17 +1344,115 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return object.NewError(object.DivideByZero, "division by zero")
+		}
+		result = leftValue / rightValue
+	case code.OpPow:
+		if rightValue < 0 {
+			return vm.push(&object.Float{Value: math.Pow(float64(leftValue), float64(rightValue))})
+		}
+		var ok bool
+		result, ok = object.CheckedPow(leftValue, rightValue)
+		if !ok {
+			return object.NewError(object.RuntimeError, "integer overflow: %d ** %d", leftValue, rightValue)
+		}
+	default:
+		return object.NewError(object.RuntimeError, "unknown integer operator: %d", op)
+	}
+
+	return vm.push(object.NewInteger(result))
+}
+
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, leftValue, rightValue float64) error {
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		if rightValue == 0 {
+			return object.NewError(object.DivideByZero, "division by zero")
+		}
 		result = leftValue / rightValue
+	case code.OpPow:
+		result = math.Pow(leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return object.NewError(object.RuntimeError, "unknown float operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(&object.Float{Value: result})
+}
+
+// checkDepth fails when a call would make depth calls be in progress and
+// that is more than the VM was configured to allow.
+func (vm *VM) checkDepth(depth int) error {
+	if vm.maxDepth > 0 && depth > vm.maxDepth {
+		return object.NewError(object.RuntimeError, "maximum recursion depth exceeded (limit=%d)", vm.maxDepth)
+	}
+	return nil
+}
+
+// stackOverflow returns the error for running out of frames or stack space
+// while running fn.
+func (vm *VM) stackOverflow(fn *object.CompiledFunction) error {
+	if fn.Name == "" {
+		return object.NewError(object.RuntimeError, "stack overflow (depth=%d)", vm.framesIndex)
+	}
+	return object.NewError(object.RuntimeError, "stack overflow (depth=%d) in %s", vm.framesIndex, fn.Name)
+}
+
+// executeBinaryCharOperation moves a Char by an Integer offset with + and -,
+// and gives the distance between two Chars with -.
+func (vm *VM) executeBinaryCharOperation(op code.Opcode, left, right object.Object) error {
+	var result int64
+
+	switch left := left.(type) {
+	case *object.Char:
+		switch right := right.(type) {
+		case *object.Integer:
+			switch op {
+			case code.OpAdd:
+				result = int64(left.Value) + right.Value
+			case code.OpSub:
+				result = int64(left.Value) - right.Value
+			default:
+				return object.NewError(object.RuntimeError, "unknown char operator: %d", op)
+			}
+		case *object.Char:
+			if op != code.OpSub {
+				return object.NewError(object.RuntimeError, "unknown char operator: %d", op)
+			}
+			return vm.push(object.NewInteger(int64(left.Value) - int64(right.Value)))
+		default:
+			return object.NewError(object.TypeError, "unsupported types for binary operation: %s %s", left.Type(), right.Type())
+		}
+
+	case *object.Integer:
+		char, ok := right.(*object.Char)
+		if !ok || op != code.OpAdd {
+			return object.NewError(object.TypeError, "unsupported types for binary operation: %s %s", left.Type(), right.Type())
+		}
+		result = left.Value + int64(char.Value)
+
+	default:
+		return object.NewError(object.TypeError, "unsupported types for binary operation: %s %s", left.Type(), right.Type())
+	}
+
+	if result < 0 || result > utf8.MaxRune || !utf8.ValidRune(rune(result)) {
+		return object.NewError(object.RuntimeError, "character out of range: %d", result)
+	}
+
+	return vm.push(&object.Char{Value: rune(result)})
 }
 
 func (vm *VM) push(o object.Object) error {
 	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+		return vm.stackOverflow(vm.currentFrame().fn)
 	}
 
 	vm.stack[vm.sp] = o
@@ -522,6 +1461,15 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// pushVariable pushes the value of a variable. The compiler never reads a
+// variable before assigning it, so only hand-made bytecode finds one unset.
+func (vm *VM) pushVariable(o object.Object) error {
+	if o == nil {
+		return object.NewError(object.RuntimeError, "variable read before it was assigned")
+	}
+	return vm.push(o)
+}
+
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
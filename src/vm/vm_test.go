@@ -1,13 +1,20 @@
 package vm
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"monkey/src/ast"
+	"monkey/src/code"
 	"monkey/src/compiler"
 	"monkey/src/lexer"
 	"monkey/src/object"
 	"monkey/src/parser"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func parse(input string) *ast.Program {
@@ -30,6 +37,19 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
+}
+
 func testBooleanObject(expected bool, actual object.Object) error {
 	result, ok := actual.(*object.Boolean)
 	if !ok {
@@ -73,6 +93,12 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
+		// everything the compiler produces must pass verification
+		err = Verify(comp.Bytecode())
+		if err != nil {
+			t.Fatalf("verify error for %q: %s", tt.input, err)
+		}
+
 		vm := New(comp.Bytecode())
 		err = vm.Run()
 		if err != nil {
@@ -96,6 +122,21 @@ func textExpectedObject(t *testing.T, expected interface{}, actual object.Object
 			t.Fatalf("testIntegerObject failed: %s", err)
 		}
 
+	case rune:
+		char, ok := actual.(*object.Char)
+		if !ok {
+			t.Fatalf("object is not Char. got=%T (%+v)", actual, actual)
+		}
+		if char.Value != expected {
+			t.Fatalf("object has wrong value. got=%q, want=%q", char.Value, expected)
+		}
+
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Fatalf("testFloatObject failed: %s", err)
+		}
+
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -125,6 +166,20 @@ func textExpectedObject(t *testing.T, expected interface{}, actual object.Object
 			}
 		}
 
+	case []interface{}:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Fatalf("object not array: %T (%+v)", actual, actual)
+		}
+
+		if len(array.Elements) != len(expected) {
+			t.Fatalf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+		}
+
+		for i, expectedElem := range expected {
+			textExpectedObject(t, expectedElem, array.Elements[i])
+		}
+
 	case map[object.HashKey]int64:
 		hash, ok := actual.(*object.Hash)
 		if !ok {
@@ -152,6 +207,21 @@ func textExpectedObject(t *testing.T, expected interface{}, actual object.Object
 			t.Fatalf("object is not Null: %T (%+v)", actual, actual)
 		}
 
+	case *object.Error:
+		errObj, ok := actual.(*object.Error)
+		if !ok {
+			t.Fatalf("object is not Error: %T (%+v)", actual, actual)
+		}
+
+		if errObj.Message != expected.Message {
+			t.Errorf("wrong error message. expected=%q, got=%q", expected.Message, errObj.Message)
+		}
+
+		// most cases only care about the message
+		if expected.Kind != object.RuntimeError && errObj.Kind != expected.Kind {
+			t.Errorf("wrong error kind. expected=%s, got=%s", expected.Kind, errObj.Kind)
+		}
+
 	}
 }
 
@@ -159,6 +229,12 @@ func TestIntegerArithmetic(t *testing.T) {
 	tests := []vmTestCase{
 		{"1", 1},
 		{"2", 2},
+		{"0xFF", 255},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"0x1f + 0B1", 32},
+		{"1_000", 1000},
+		{"1_000_000 / 0xF_F", 3921},
 		{"1 + 2", 3}, // FIXME
 		{"2 - 1", 1},
 		{"2 * 2", 4},
@@ -177,6 +253,43 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestPowerOperator(t *testing.T) {
+	tests := []vmTestCase{
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"(2 ** 3) ** 2", 64},
+		{"5 ** 0", 1},
+		{"-2 ** 2", -4},
+		{"(-2) ** 3", -8},
+		{"2 ** 62", 4611686018427387904},
+		{"(-2) ** 63", -9223372036854775808},
+		{"2 ** -1", 0.5},
+		{"2.0 ** 3", 8.0},
+		{"4 ** 0.5", 2.0},
+		{"let x = 3; x ** 2 * 2", 18},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestInOperator(t *testing.T) {
+	tests := []vmTestCase{
+		{`1 in {1: 2}`, true},
+		{`2 in {1: 2}`, false},
+		{`"a" in {"a": null}`, true},
+		{`[1, 2] in {[1, 2]: "pair"}`, true},
+		{`3 in [1, 2]`, false},
+		{`2 in [1, 2]`, true},
+		{`[2] in [[1], [2]]`, true},
+		{`"1" in [1]`, false},
+		{`2 in set([1, 2])`, true},
+		{`!(1 in [])`, true},
+		{`let h = {}; h["k"] = 1; "k" in h`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (false) { 10 }", Null},
@@ -195,6 +308,58 @@ func TestConditionals(t *testing.T) {
 
 }
 
+func TestNullCoalescing(t *testing.T) {
+	tests := []vmTestCase{
+		{"null ?? 5", 5},
+		{"3 ?? 5", 3},
+		{"false ?? 5", false},
+		{"null ?? null ?? 7", 7},
+		{"let h = {}; h[\"a\"] ?? 1 + 2", 3},
+		{"let h = {\"a\": 0}; h[\"a\"] ?? 1 + 2", 0},
+		{"null", Null},
+		// the right side is only evaluated when needed
+		{"3 ?? assert(false)", 3},
+	}
+
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`1 ?? puts("evaluated"); null ?? puts("fallback")`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	err = New(comp.Bytecode(), WithOutput(&out)).Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if out.String() != "fallback\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+func TestTernaryExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 < 2 ? 10 : 20", 10},
+		{"1 > 2 ? 10 : 20", 20},
+		{"let x = 5; x > 3 ? x * 2 : x - 2", 10},
+		{"let x = 2; x > 3 ? \"big\" : x > 1 ? \"medium\" : \"small\"", "medium"},
+		{"let x = 0; x > 3 ? \"big\" : x > 1 ? \"medium\" : \"small\"", "small"},
+		{"true ? false ? 1 : 2 : 3", 2},
+		{"[1 < 2 ? 1 : 0, 1 > 2 ? 1 : 0]", []int{1, 0}},
+		// only the taken branch is evaluated
+		{"true ? 1 : assert(false)", 1},
+		{"false ? assert(false) : 2", 2},
+		{"let f = fn(n) { n == 0 ? 0 : f(n - 1) }; f(10)", 0},
+		{"let x = 1; let r = true ? if (true) { let x = 2; x } : 0; [r, x]", []int{2, 1}},
+		{"let x = 1; let r = false ? 0 : if (true) { let x = 3; x }; [r, x]", []int{3, 1}},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"!(if (false) { 5; })", true},
@@ -204,6 +369,13 @@ func TestBooleanExpressions(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"2 <= 2", true},
+		{"1 <= 2", true},
+		{"3 <= 2", false},
+		{"3 >= 4", false},
+		{"4 >= 4", true},
+		{"5 >= 4", true},
+		{"(1 <= 2) == (2 >= 1)", true},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -228,313 +400,2900 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
-func TestGlobalLetStatements(t *testing.T) {
+func TestComparisonOperators(t *testing.T) {
 	tests := []vmTestCase{
-		{"let one = 1; one", 1},
-		{"let one = 1; let two = 2; one + two", 3},
-		{"let one = 1; let two = one + one; one + two", 3},
+		{"1 < 2", true},
+		{"2 < 1", false},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"2 > 1", true},
+		{"1 >= 2", false},
+		{"1.5 < 2", true},
+		{"2 <= 1.5", false},
+		{"'a' < 'b'", true},
+		{"'b' <= 'a'", false},
+		{"false < true", true},
+		{"true > true", false},
+		{"true >= false", true},
+		{"true <= false", false},
+		{"false == false", true},
+		{"1 < 2 == true > false", true},
+		// operands are evaluated left to right, whatever the operator
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(1) < f(2); log`, []int{1, 2}},
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(1) <= f(2); log`, []int{1, 2}},
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(1) > f(2); log`, []int{1, 2}},
 	}
 
 	runVmTests(t, tests)
 }
 
-func TestStringExpressions(t *testing.T) {
-	tests := []vmTestCase{
-		{`"monkey"`, "monkey"},
-		{`"mon" + "key"`, "monkey"},
-		{`"mon" + "key" + "banana"`, "monkeybanana"},
+func TestGreaterThanStillRuns(t *testing.T) {
+	// bytecode from before OpLessThan existed compiled 1 < 2 as 2 > 1
+	bytecode := &compiler.Bytecode{
+		Instructions: append(append(append(
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpConstant, 1)...),
+			code.Make(code.OpGreaterThan)...),
+			code.Make(code.OpPop)...),
+		Constants: []object.Object{&object.Integer{Value: 2}, &object.Integer{Value: 1}},
 	}
-	runVmTests(t, tests)
-}
 
-func TestArrayLiterals(t *testing.T) {
-	tests := []vmTestCase{
-		{"[]", []int{}},
-		{"[1, 2, 3]", []int{1, 2, 3}},
-		{"[1 + 2, 4 - 2, 3 * 4]", []int{3, 2, 12}},
+	vm := New(bytecode)
+	err := vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
 	}
 
-	runVmTests(t, tests)
+	err = testBooleanObject(true, vm.LastPoppedStackElem())
+	if err != nil {
+		t.Errorf("testBooleanObject failed: %s", err)
+	}
 }
 
-func TestHashLiterals(t *testing.T) {
-	tests := []vmTestCase{
-		{"{}", map[object.HashKey]int64{}},
-		{"{1: 2, 3: 4}", map[object.HashKey]int64{
-			(&object.Integer{Value: 1}).HashKey(): 2,
-			(&object.Integer{Value: 3}).HashKey(): 4,
-		}},
-		{"{1 + 1: 2 + 3, 4 * 2: 5 * 6}", map[object.HashKey]int64{
-			(&object.Integer{Value: 2}).HashKey(): 5,
-			(&object.Integer{Value: 8}).HashKey(): 30,
-		}},
+func TestPopN(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	pushes := concat(
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpConstant, 3),
+	)
+	constants := []object.Object{
+		&object.Integer{Value: 1},
+		&object.Integer{Value: 2},
+		&object.Integer{Value: 3},
+		&object.Integer{Value: 4},
 	}
 
-	runVmTests(t, tests)
+	popN := &compiler.Bytecode{
+		Instructions: concat(pushes, code.Make(code.OpPopN, 3)),
+		Constants:    constants,
+	}
+	pops := &compiler.Bytecode{
+		Instructions: concat(pushes, code.Make(code.OpPop), code.Make(code.OpPop), code.Make(code.OpPop)),
+		Constants:    constants,
+	}
+
+	for _, bytecode := range []*compiler.Bytecode{popN, pops} {
+		err := Verify(bytecode)
+		if err != nil {
+			t.Fatalf("verify error: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		// both leave the first value, and last popped the second
+		if vm.sp != 1 {
+			t.Errorf("wrong sp for %q. want=1, got=%d", bytecode.Instructions, vm.sp)
+		}
+		err = testIntegerObject(1, vm.StackTop())
+		if err != nil {
+			t.Errorf("wrong stack top for %q: %s", bytecode.Instructions, err)
+		}
+		err = testIntegerObject(2, vm.LastPoppedStackElem())
+		if err != nil {
+			t.Errorf("wrong last popped element for %q: %s", bytecode.Instructions, err)
+		}
+	}
+
+	err := Verify(&compiler.Bytecode{
+		Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpPopN, 2)),
+		Constants:    constants,
+	})
+	if err == nil || err.Error() != "main: offset 3: OpPopN pops 2 values, stack has 1" {
+		t.Errorf("wrong verify error for popping too many. got=%v", err)
+	}
 }
 
-func TestIndexExpressions(t *testing.T) {
-	tests := []vmTestCase{
-		{"[][0]", Null},
-		{"[1][0]", 1},
-		{"[1, 2][1]", 2},
-		{"[1, 2][10]", Null},
-		{"[[1, 2, 3], [4, 5]][0][1]", 2},
-		{"{}[0]", Null},
-		{"{1: 2, 3: 4}[1]", 2},
-		{"{1: 2, 3: 4}[3]", 4},
-		{"{1: 2, 3: 4}[4]", Null},
+func TestStackChecks(t *testing.T) {
+	programs := []string{
+		`1; 2 + 3; "a"`,
+		`let x = 1; x = x + 1; x += 2;`,
+		`let a = [1, if (true) { 2; 3 }]; a[1]`,
+		`let f = fn(a, b...) { let c = a; c }; f(1, 2, 3); f(1)`,
+		`let i = 0; while (i < 3) { i++; if (i == 2) { continue; } }`,
+		`let j = 0; while (true) { j++; if (j == 2) { break; } j; }`,
+		`do { 1; } while (false);`,
+		`let [a, b, ...rest] = [1, 2, 3, 4]; rest`,
+		`let r = try { 1 / 0 } catch (e) { e["kind"] }; r`,
+		`try { assert(false) } catch { 1 };`,
+		`let h = {"a": 1}; h["a"] = 2; h["b"] = h["c"] ?? 0;`,
+		`each([1, 2], fn(x) { x * 2 }); let y = null ?? 2; y`,
 	}
 
-	runVmTests(t, tests)
+	for _, input := range programs {
+		comp := compiler.NewWithStackChecks()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err != nil {
+			t.Errorf("vm error for %q: %s", input, err)
+		}
+	}
+
+	// two values pushed, only one popped
+	bytecode := &compiler.Bytecode{
+		Instructions: append(append(append(append(
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpConstant, 0)...),
+			code.Make(code.OpPop)...),
+			code.Make(code.OpCheckStack)...),
+			code.Make(code.OpConstant, 0)...),
+		Constants: []object.Object{&object.Integer{Value: 1}},
+	}
+
+	err := New(bytecode).Run()
+	if err == nil {
+		t.Fatalf("expected an error for unbalanced bytecode")
+	}
+	if err.Error() != "unbalanced stack at 7: sp=1, want=0" {
+		t.Errorf("wrong error. got=%q", err)
+	}
 }
 
-func TestIndexAssignmentExpressions(t *testing.T) {
-	tests := []vmTestCase{
-		{"let arr = [1]; arr[0] = 2; arr[0];", 2},
-		{"let arr = []; arr[0] = 2; arr[0];", Null},
-		{"let obj = {}; obj[1] = 5; obj[1]", 5},
-		{"let obj = {1: 2}; obj[1] = 3; obj[1]", 3},
-		{"let obj = {}; obj[1+1] = 2; obj[2]", 2},
-		{"let arr = [[1, 2], 3]; arr[0] = [3, 4 + 4]; arr[0]", []int{3, 8}},
+func TestGlobalIndexOutOfRange(t *testing.T) {
+	tests := []code.Instructions{
+		append(code.Make(code.OpConstant, 0), code.Make(code.OpSetGlobal, 8)...),
+		append(code.Make(code.OpGetGlobal, 8), code.Make(code.OpPop)...),
+		append(code.Make(code.OpGetGlobal, 65535), code.Make(code.OpPop)...),
 	}
 
-	runVmTests(t, tests)
+	for _, ins := range tests {
+		bytecode := &compiler.Bytecode{
+			Instructions: ins,
+			Constants:    []object.Object{&object.Integer{Value: 1}},
+		}
+
+		vm := NewWithGlobalsStore(bytecode, make([]object.Object, 8))
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("expected an error for %q", ins)
+		}
+		if err.Error() != "global index out of range" {
+			t.Errorf("wrong error. got=%q", err)
+		}
+	}
 }
 
-func TestCallingFunctionsWithoutArguments(t *testing.T) {
-	tests := []vmTestCase{
+func TestVerify(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	one := &object.Integer{Value: 1}
+	function := func(ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concat(ins...)}
+	}
+
+	tests := []struct {
+		name     string
+		bytecode *compiler.Bytecode
+		expected string
+	}{
 		{
-			input: `
-			let fivePlusTen = fn() { 5 + 10; };
-			fivePlusTen();`,
-			expected: 15,
+			"unknown opcode",
+			&compiler.Bytecode{Instructions: code.Instructions{255}},
+			"main: offset 0: opcode 255 undefined",
 		},
 		{
-			input: `
-			let one = fn() { 1; };
-			let two = fn() { 2; };
-			one() + two();`,
-			expected: 3,
+			"truncated operand",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), []byte{byte(code.OpConstant), 0}),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 3: OpConstant needs 2 operand bytes, got 1",
 		},
 		{
-			input: `
-			let a = fn() { 1 }
-			let b = fn() { a() + 1 }
-			let c = fn() { b() + 1 }
-			c()`,
-			expected: 3,
+			"constant out of range",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 5), code.Make(code.OpPop)),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 0: constant index 5 out of range, have 1",
 		},
-	}
-
-	runVmTests(t, tests)
-}
-
-func TestCallingFunctionsWithArguments(t *testing.T) {
-	tests := []vmTestCase{
 		{
-			input: `
-			let fivePlusTen = fn(x) { x + 5 + 10; };
-			fivePlusTen(5);`,
-			expected: 20,
+			"jump into an operand",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpJump, 1)),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 3: OpJump target 1 is not an instruction",
 		},
 		{
-			input: `
-			let one = fn(x) { x; };
-			let two = fn(x) { x; };
-			one(3) + two(2);`,
-			expected: 5,
+			"jump past the end",
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 100))},
+			"main: offset 1: OpJumpNotTruthy target 100 is not an instruction",
 		},
 		{
-			input: `
-			let sum = fn(a, b) { a+b; }
-			sum(1, 3)`,
-			expected: 4,
+			"catch outside the function",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					function(code.Make(code.OpSetupTry, 5), code.Make(code.OpNull), code.Make(code.OpReturnValue)),
+				},
+			},
+			"constant 0: offset 0: OpSetupTry target 5 is not an instruction",
 		},
 		{
-			input: `
-			let sum = fn(a, b) {
-				let c = a + b;
-				return c;
-			}
-			sum(3, 4)
-			`,
-			expected: 7,
+			"builtin out of range",
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpGetBuiltin, 250), code.Make(code.OpPop))},
+			fmt.Sprintf("main: offset 0: builtin index 250 out of range, have %d", len(object.Builtins)),
 		},
 		{
-			input: `
-			let sum = fn(a, b) {
-				let c = a + b;
-				return c;
-			}
-			sum(2, 2) + sum(1, 2)
-			`,
-
-			expected: 7,
+			"local in the main program",
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpGetLocal, 0), code.Make(code.OpPop))},
+			"main: offset 0: local index 0 out of range, have 0",
 		},
 		{
-			input: `
-			let globalNum = 10;
-           	let sum = fn(a, b) {
-               let c = a + b;
-               c + globalNum;
-			};
-            let outer = fn() {
-               sum(1, 2) + sum(3, 4) + globalNum;
-			};
-           	outer() + globalNum;
-			`,
-			expected: 50,
+			"free variable of a plain function",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpPop)),
+				Constants:    []object.Object{function(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))},
+			},
+			"constant 0: offset 0: free index 0 out of range, have 0",
 		},
-	}
-
-	runVmTests(t, tests)
-}
-
-func TestFunctionsWithReturnStatements(t *testing.T) {
-	tests := []vmTestCase{
 		{
-			input: `
-			let earlyExit = fn() { return 99; 100 };
-			earlyExit()`,
-			expected: 99,
+			"closure of a non-function",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 0: OpClosure of non-function constant 0",
 		},
 		{
-			input: `
-			let earlyExit = fn() { return 99; return 100; };
-			earlyExit()`,
-			expected: 99,
+			"function without a return",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpPop)),
+				Constants:    []object.Object{function(code.Make(code.OpNull))},
+			},
+			"constant 0: offset 0: execution runs past the end of the function",
 		},
-	}
-
-	runVmTests(t, tests)
-}
-
-func TestFunctionsWithoutReturnValue(t *testing.T) {
-	tests := []vmTestCase{
 		{
-			input: `
-			let noReturn = fn() { };
-			noReturn();`,
-			expected: Null,
+			"stack underflow",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpAdd)),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 3: OpAdd pops 2 values, stack has 1",
 		},
 		{
-			input: `
-			let first = fn() {};
-			let second = fn() { first(); };
-			second();`,
-			expected: Null,
+			"stack underflow on one path",
+			&compiler.Bytecode{
+				Instructions: concat(
+					code.Make(code.OpTrue),
+					code.Make(code.OpJumpNotTruthy, 7),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpPop),
+				),
+				Constants: []object.Object{one},
+			},
+			"main: offset 7: OpPop pops 1 values, stack has 0",
+		},
+		{
+			"return from the main program",
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpNull), code.Make(code.OpReturnValue))},
+			"main: offset 1: OpReturnValue outside of a function",
+		},
+		{
+			"odd number of hash values",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpHash, 1)),
+				Constants:    []object.Object{one},
+			},
+			"main: offset 3: OpHash of 1 values, which are not key-value pairs",
+		},
+		{
+			"more parameters than locals",
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpConstant, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{&object.CompiledFunction{
+					Instructions:  code.Make(code.OpReturn),
+					NumParameters: 2,
+					NumLocals:     1,
+				}},
+			},
+			"constant 0: 2 parameters but only 1 locals",
 		},
 	}
 
+	for _, tt := range tests {
+		err := Verify(tt.bytecode)
+		if err == nil {
+			t.Errorf("%s: expected a verification error", tt.name)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error.\nwant=%q\ngot=%q", tt.name, tt.expected, err)
+		}
+	}
+
+	// a closure provides the free variable the same function lacked above
+	valid := &compiler.Bytecode{
+		Instructions: concat(
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpClosure, 0, 1),
+			code.Make(code.OpPop),
+			code.Make(code.OpTrue),
+			code.Make(code.OpJumpNotTruthy, 12),
+		),
+		Constants: []object.Object{function(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)), one},
+	}
+	err := Verify(valid)
+	if err != nil {
+		t.Errorf("unexpected error for valid bytecode: %s", err)
+	}
+}
+
+func TestStructuralEquality(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] != [1, 2]", false},
+		{"[1, 2] == [2, 1]", false},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[] == []", true},
+		{`[1, "a", [true, [2]]] == [1, "a", [true, [2]]]`, true},
+		{`[1, "a", [true, [2]]] == [1, "a", [true, [3]]]`, false},
+		{`"mon" + "key" == "monkey"`, true},
+		{`{1: 2, "a": [3]} == {"a": [3], 1: 2}`, true},
+		{`{1: 2, "a": [3]} == {"a": [4], 1: 2}`, false},
+		{"{1: 2} == {1: 2, 3: 4}", false},
+		{"{1: 2} == {2: 2}", false},
+		{"{1: {2: [3]}} == {1: {2: [3]}}", true},
+		{"{1: {2: [3]}} != {1: {2: [4]}}", true},
+		{"[1] == {0: 1}", false},
+		{`[1] == "1"`, false},
+		{"[] == 0", false},
+	}
+
 	runVmTests(t, tests)
 }
 
-func TestFirstClassFunctions(t *testing.T) {
+func TestBooleanResultsAreSingletons(t *testing.T) {
 	tests := []vmTestCase{
-		{
-			input: `
-			   let returnsOne = fn() { 1; };
-			   let returnsOneReturner = fn() { returnsOne; };
-			   returnsOneReturner()();
-			   `,
-			expected: 1,
-		},
+		{"1 < 2", true},
+		{"2 >= 3", false},
+		{"let a = [1, 2]; let b = [1, 2]; a == b", true},
+		{`"a" + "b" != "ab"`, false},
+		{"!(1 == 1)", false},
+		{"!!5", true},
+		{"let i = 0; let r = false; while (i < 100) { r = i * 2 > 150; i = i + 1; } r", true},
+		{`parse_json("true")`, true},
+		{`parse_json("[false]")[0]`, false},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		expected := False
+		if tt.expected.(bool) {
+			expected = True
+		}
+
+		if vm.LastPoppedStackElem() != expected {
+			t.Errorf("%q did not return the shared Boolean. got=%p, want=%p",
+				tt.input, vm.LastPoppedStackElem(), expected)
+		}
+	}
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = 2; one + two", 3},
+		{"let one = 1; let two = one + one; one + two", 3},
 	}
+
 	runVmTests(t, tests)
 }
 
-func TestCallingFunctionsWithBindings(t *testing.T) {
+func TestCompoundAssignments(t *testing.T) {
 	tests := []vmTestCase{
+		{"let x = 1; x += 4; x", 5},
+		{"let x = 10; x -= 4; x *= 3; x /= 2; x", 9},
+		{"let s = \"mon\"; s += \"key\"; s", "monkey"},
+		{"let f = fn() { let x = 2; x *= x; x }; f()", 4},
+		{"let a = [10]; a[0] += 5; a[0]", 15},
+		{"let a = [1, 2]; a[-1] *= 10; a", []int{1, 20}},
+		{"let h = {\"k\": 1}; h[\"k\"] += 1; h[\"k\"]", 2},
+		{"let a = [1, 2, 3]; let i = 0; let next = fn() { i += 1; i }; a[next()] += 10; [a, i]",
+			[]interface{}{[]int{1, 12, 3}, 1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let [a, b] = [1, 2]; a - b", -1},
+		{"let [a, b] = [1, 2, 3]; [b, a]", []int{2, 1}},
+		{"let pair = fn() { [3, 4] }; let [x, y] = pair(); x * y", 12},
+		{"let f = fn(arr) { let [x, y] = arr; x + y }; f([5, 6])", 11},
+		{"let [first, ...rest] = [1, 2, 3]; rest", []int{2, 3}},
+		{"let [a, b, ...rest] = [1, 2]; [a, b, rest]", []interface{}{1, 2, []int{}}},
+		{"let [...all] = [1]; all", []int{1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; x = x + 5; x", 6},
+		{"let x = 1; let y = 2; x = y; x", 2},
+		{"let x = 1; x = 2; x = x * 3; x", 6},
 		{
 			input: `
-			let one = fn() { let one = 1; one; }
-			one();
-			`,
-			expected: 1,
+			let x = 1;
+			let f = fn() { let y = 2; y = y + x; y };
+			f()`,
+			expected: 3,
 		},
 		{
 			input: `
-			let oneAndTwo = fn() { let one = 1; let two = 2; one + two; };
-			oneAndTwo();`,
-			expected: 3,
+			let x = 1;
+			let f = fn() { x = 10; };
+			f();
+			x`,
+			expected: 10,
 		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWhileStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; let sum = 0; while (i < 5) { sum = sum + i; i = i + 1; } sum", 10},
+		{"let i = 0; while (false) { i = i + 1; } i", 0},
+		{"let i = 0; while (i < 5000) { i = i + 1; i; } i", 5000},
 		{
 			input: `
-			let oneAndTwo = fn() { let one = 1; let two = 2; one + two; }
-			let threeAndFour = fn() { let three = 3; let four = 4; three + four; }
-			oneAndTwo() + threeAndFour();`,
-			expected: 10,
+			let i = 0;
+			let big = 0;
+			while (i < 10) {
+				if (i > 6) { big = big + 1; }
+				i = i + 1;
+			}
+			big`,
+			expected: 3,
 		},
 		{
 			input: `
-			let firstFoobar = fn() { let foobar = 100; foobar; }
-			let secondFoobar = fn() { let foobar = 50; foobar; }
-			firstFoobar() + secondFoobar();`,
-			expected: 150,
+			let sumTo = fn(n) {
+				let i = 1;
+				let sum = 0;
+				while (i < n + 1) {
+					sum = sum + i;
+					i = i + 1;
+				}
+				sum
+			};
+			sumTo(100)`,
+			expected: 5050,
 		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDoWhileStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; do { i = i + 1; } while (false) i", 1},
+		{"let i = 10; do { i = i + 1; } while (i < 5); i", 11},
+		{"let i = 0; let sum = 0; do { sum += i; i += 1; } while (i < 5); sum", 10},
+		{"let i = 0; do { i += 1; i; } while (i < 5000); i", 5000},
+		{"let i = 0; do { i += 1; if (i == 3) { break; } } while (true); i", 3},
+		{"let i = 0; let odd = 0; do { i += 1; if (i - i / 2 * 2 == 0) { continue; } odd += 1; } while (i < 9); odd", 5},
+		{"let f = fn(n) { let runs = 0; do { runs += 1; } while (runs < n); runs }; [f(0), f(3)]", []int{1, 3}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (true) { if (i == 3) { break; } i = i + 1; } i", 3},
 		{
 			input: `
-			let globalSeed = 50;
-			let minusOne = fn() {
-			  let num = 1;
-			  return globalSeed - num;
+			let i = 0;
+			let sum = 0;
+			while (i < 10) {
+				i = i + 1;
+				if (i == 2) { continue; }
+				if (i == 7) { break; }
+				sum = sum + i;
 			}
-			let minusTwo = fn() {
-			  let num = 2;
-			  return globalSeed - num;
+			sum`,
+			expected: 19,
+		},
+		{
+			input: `
+			let i = 0;
+			let inner = 0;
+			while (i < 3) {
+				i = i + 1;
+				let j = 0;
+				while (true) {
+					j = j + 1;
+					if (j > 2) { break; }
+					inner = inner + 1;
+				}
 			}
-			minusOne() + minusTwo();`,
-			expected: 97,
+			inner`,
+			expected: 6,
 		},
 		{
 			input: `
-			let returnsOneReturner = fn() {
-			let returnsOne = fn() { 1; };
-				returnsOne;
+			let firstOver = fn(limit) {
+				let i = 0;
+				while (true) {
+					i = i + 1;
+					if (i * i > limit) { break; }
+				}
+				i
 			};
-			returnsOneReturner()();
-			`,
-			expected: 1,
+			firstOver(50)`,
+			expected: 8,
 		},
 	}
 
 	runVmTests(t, tests)
 }
 
-func TestCallingWithWrongNumOfArguments(t *testing.T) {
+func TestStringExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`"monkey"`, "monkey"},
+		{`"mon" + "key"`, "monkey"},
+		{`"mon" + "key" + "banana"`, "monkeybanana"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"[]", []int{}},
+		{"[1, 2, 3]", []int{1, 2, 3}},
+		{"[1 + 2, 4 - 2, 3 * 4]", []int{3, 2, 12}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTrailingCommas(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3,]", []int{1, 2, 3}},
+		{"len([\n\t\"a\",\n\t\"b\",\n])", 2},
+		{"{1: 2, 3: 4,}[3]", 4},
+		{"let add = fn(a, b) { a + b }; add(1, 2,)", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"{}", map[object.HashKey]int64{}},
+		{"{1: 2, 3: 4}", map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 2,
+			(&object.Integer{Value: 3}).HashKey(): 4,
+		}},
+		{"{1 + 1: 2 + 3, 4 * 2: 5 * 6}", map[object.HashKey]int64{
+			(&object.Integer{Value: 2}).HashKey(): 5,
+			(&object.Integer{Value: 8}).HashKey(): 30,
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[][0]", Null},
+		{"[1][0]", 1},
+		{"[1, 2][1]", 2},
+		{"[1, 2][10]", Null},
+		{"[[1, 2, 3], [4, 5]][0][1]", 2},
+		{"{}[0]", Null},
+		{"{1: 2, 3: 4}[1]", 2},
+		{"{1: 2, 3: 4}[3]", 4},
+		{"{1: 2, 3: 4}[4]", Null},
+		{"[1, 2, 3][-1]", 3},
+		{"[1, 2, 3][-3]", 1},
+		{"[1, 2, 3][-4]", Null},
+		{"[][-1]", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignmentExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let arr = [1]; arr[0] = 2; arr[0];", 2},
+		{"let arr = []; arr[0] = 2; arr[0];", Null},
+		{"let obj = {}; obj[1] = 5; obj[1]", 5},
+		{"let obj = {1: 2}; obj[1] = 3; obj[1]", 3},
+		{"let obj = {}; obj[1+1] = 2; obj[2]", 2},
+		{"let arr = [[1, 2], 3]; arr[0] = [3, 4 + 4]; arr[0]", []int{3, 8}},
+		{"let arr = [1, 2, 3]; arr[-1] = 9; arr", []int{1, 2, 9}},
+		{"let arr = [1, 2, 3]; arr[-4] = 9; arr", []int{1, 2, 3}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithoutArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
 			input: `
-			fn() { 5; }(1);`,
-			expected: "wrong number of arguments: want=0 got=1",
+			let fivePlusTen = fn() { 5 + 10; };
+			fivePlusTen();`,
+			expected: 15,
 		},
 		{
 			input: `
-			fn(a, b){ a + b}(3)`,
-			expected: "wrong number of arguments: want=2 got=1",
+			let one = fn() { 1; };
+			let two = fn() { 2; };
+			one() + two();`,
+			expected: 3,
+		},
+		{
+			input: `
+			let a = fn() { 1 }
+			let b = fn() { a() + 1 }
+			let c = fn() { b() + 1 }
+			c()`,
+			expected: 3,
 		},
 	}
 
-	for _, tt := range tests {
-		program := parse(tt.input)
-
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Errorf("compiler error: %s", err)
-		}
-
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-
-		if err == nil {
-			t.Errorf("expected vm error but got none")
-		}
+	runVmTests(t, tests)
+}
 
-		if err.Error() != tt.expected {
-			t.Errorf("expected vm error %s, got %s", tt.expected, err)
-		}
-	}
+func TestCallingFunctionsWithArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let fivePlusTen = fn(x) { x + 5 + 10; };
+			fivePlusTen(5);`,
+			expected: 20,
+		},
+		{
+			input: `
+			let one = fn(x) { x; };
+			let two = fn(x) { x; };
+			one(3) + two(2);`,
+			expected: 5,
+		},
+		{
+			input: `
+			let sum = fn(a, b) { a+b; }
+			sum(1, 3)`,
+			expected: 4,
+		},
+		{
+			input: `
+			let sum = fn(a, b) {
+				let c = a + b;
+				return c;
+			}
+			sum(3, 4)
+			`,
+			expected: 7,
+		},
+		{
+			input: `
+			let sum = fn(a, b) {
+				let c = a + b;
+				return c;
+			}
+			sum(2, 2) + sum(1, 2)
+			`,
+
+			expected: 7,
+		},
+		{
+			input: `
+			let globalNum = 10;
+           	let sum = fn(a, b) {
+               let c = a + b;
+               c + globalNum;
+			};
+            let outer = fn() {
+               sum(1, 2) + sum(3, 4) + globalNum;
+			};
+           	outer() + globalNum;
+			`,
+			expected: 50,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionsWithReturnStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let earlyExit = fn() { return 99; 100 };
+			earlyExit()`,
+			expected: 99,
+		},
+		{
+			input: `
+			let earlyExit = fn() { return 99; return 100; };
+			earlyExit()`,
+			expected: 99,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionsWithoutReturnValue(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let noReturn = fn() { };
+			noReturn();`,
+			expected: Null,
+		},
+		{
+			input: `
+			let first = fn() {};
+			let second = fn() { first(); };
+			second();`,
+			expected: Null,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countDown = fn(x) {
+				if (x == 0) { return 0; }
+				countDown(x - 1);
+			};
+			countDown(10);`,
+			expected: 0,
+		},
+		{
+			input: `
+			let fibonacci = fn(x) {
+				if (x < 2) { return x; }
+				fibonacci(x - 1) + fibonacci(x - 2)
+			};
+			fibonacci(15);`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{`let adder = fn(a) { fn(b) { a + b } }; let add2 = adder(2); add2(3)`, 5},
+		{`let f = fn(a) { fn(b) { fn(c) { a + b + c } } }; f(1)(2)(3)`, 6},
+		{`let f = fn(a) { let b = a * 2; fn() { let c = 1; fn() { a + b + c } } }; f(1)()()`, 4},
+		{`let make = fn(x) { fn() { x } }; let a = make(1); let b = make(2); [a(), b(), a()]`, []int{1, 2, 1}},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					if (x == 0) { return 0; }
+					countDown(x - 1)
+				};
+				countDown(1000);
+			};
+			wrapper();`,
+			expected: 0,
+		},
+		{
+			// each step is a tail call of a different closure of the same
+			// function, which has to see its own captured value
+			input: `
+			let f = fn(limit) {
+				let loop = fn(n) { if (n >= limit) { return n } loop(n + 1) };
+				loop(0)
+			};
+			[f(3), f(5)]`,
+			expected: []int{3, 5},
+		},
+		{`let f = fn(k) { let g = fn(x) { x + k }; [bind(g, 1)(), memoize(g)(2), count([1, 2, 3], fn(x) { x > k })] }; f(1)`, []int{2, 3, 2}},
+		{`let f = fn(step) { fn() { yield step; yield step * 2; } }; let gen = f(5)(); [next(gen), next(gen)]`, []int{5, 10}},
+		{`let f = fn(a) { fn(b = a) { b } }; [f(1)(), f(1)(2)]`, []int{1, 2}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestShadowingBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`let len = 5; len`, 5},
+		{`let len = fn(x) { 42 }; len([1, 2])`, 42},
+		{`let f = fn() { let len = 1; len }; [f(), len([1, 2])]`, []int{1, 2}},
+		{`let f = fn(len) { len * 2 }; [f(3), len("abc")]`, []int{6, 3}},
+		{`let len = 5; let f = fn() { len }; f()`, 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; if (true) { x + 1 }`, 2},
+		{`let x = 1; if (true) { let x = 2; x }`, 2},
+		{`let x = 1; if (true) { let x = 2; }; x`, 1},
+		{`let x = 1; if (false) { 0 } else { let x = 3; }; x`, 1},
+		{`let x = 1; if (true) { x = 5 }; x`, 5},
+		{`let i = 0; let sum = 0; while (i < 3) { let sq = i * i; sum += sq; i++ } sum`, 5},
+		{`let i = 0; do { let i = 10; } while (false); i`, 0},
+		{`let f = fn(n) { if (n > 0) { let d = n * 2; d } else { let d = 0 - n; d } }; [f(2), f(-3)]`, []int{4, 3}},
+		{`let f = fn() { let fs = []; let i = 0; while (i < 2) { let j = i; fs = push(fs, fn() { j }); i++ } fs }; let fs = f(); [fs[0](), fs[1]()]`, []int{0, 1}},
+		{`let e = 5; try { 1 / 0 } catch (e) { e["kind"] }`, "DivideByZero"},
+		{`let e = 5; try { 1 / 0 } catch (e) { 0 }; e`, 5},
+		{`let x = 1; try { let x = 2; x } catch (e) { 0 }; x`, 1},
+		{`let f = fn() { let r = try { let a = 2; a / 0 } catch (e) { let b = e["kind"]; b }; r }; f()`, "DivideByZero"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConstantPropagation(t *testing.T) {
+	tests := []vmTestCase{
+		{`let limit = 10; let f = fn(x) { x + limit }; f(5)`, 15},
+		{`let s = "mon"; let f = fn() { s + "key" }; f()`, "monkey"},
+		{`let x = 1; let f = fn() { x }; x = 2; f()`, 2},
+		{`let x = 1; let f = fn() { x += 1 }; f(); x`, 2},
+		{`let x = 1; if (true) { let x = 2; x }`, 2},
+		{`let x = 1; let f = fn(x) { x }; f(3)`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosureInspect(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(a, b) { fn() { a + b } }; [str(f(1, 2)), str(f)]`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	result := vm.LastPoppedStackElem().(*object.Array)
+	closure := result.Elements[0].(*object.String).Value
+	if !regexp.MustCompile(`^CLOSURE\[0x[0-9a-f]+\] free=2$`).MatchString(closure) {
+		t.Errorf("wrong inspect for closure. got=%q", closure)
+	}
+	fn := result.Elements[1].(*object.String).Value
+	if !strings.HasPrefix(fn, "CompiledFunction[") {
+		t.Errorf("function without captured variables is not a plain function. got=%q", fn)
+	}
+}
+
+func TestFirstClassFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			   let returnsOne = fn() { 1; };
+			   let returnsOneReturner = fn() { returnsOne; };
+			   returnsOneReturner()();
+			   `,
+			expected: 1,
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithBindings(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let one = fn() { let one = 1; one; }
+			one();
+			`,
+			expected: 1,
+		},
+		{
+			input: `
+			let oneAndTwo = fn() { let one = 1; let two = 2; one + two; };
+			oneAndTwo();`,
+			expected: 3,
+		},
+		{
+			input: `
+			let oneAndTwo = fn() { let one = 1; let two = 2; one + two; }
+			let threeAndFour = fn() { let three = 3; let four = 4; three + four; }
+			oneAndTwo() + threeAndFour();`,
+			expected: 10,
+		},
+		{
+			input: `
+			let firstFoobar = fn() { let foobar = 100; foobar; }
+			let secondFoobar = fn() { let foobar = 50; foobar; }
+			firstFoobar() + secondFoobar();`,
+			expected: 150,
+		},
+		{
+			input: `
+			let globalSeed = 50;
+			let minusOne = fn() {
+			  let num = 1;
+			  return globalSeed - num;
+			}
+			let minusTwo = fn() {
+			  let num = 2;
+			  return globalSeed - num;
+			}
+			minusOne() + minusTwo();`,
+			expected: 97,
+		},
+		{
+			input: `
+			let returnsOneReturner = fn() {
+			let returnsOne = fn() { 1; };
+				returnsOne;
+			};
+			returnsOneReturner()();
+			`,
+			expected: 1,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestVariadicFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `let f = fn(a, rest...) { rest }; f(1, 2, 3);`,
+			expected: []int{2, 3},
+		},
+		{
+			input:    `let f = fn(a, rest...) { rest }; f(1);`,
+			expected: []int{},
+		},
+		{
+			input:    `let f = fn(rest...) { len(rest) }; f() + f(1, 2, 3);`,
+			expected: 3,
+		},
+		{
+			input: `
+			let sum = fn(first, rest...) {
+				let total = first;
+				let i = 0;
+				while (i < len(rest)) {
+					total = total + rest[i];
+					i = i + 1;
+				}
+				total
+			};
+			sum(1, 2, 3, 4);`,
+			expected: 10,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDefaultParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `let f = fn(x, y = 10) { x + y }; f(5);`,
+			expected: 15,
+		},
+		{
+			input:    `let f = fn(x, y = 10) { x + y }; f(5, 1);`,
+			expected: 6,
+		},
+		{
+			input:    `let f = fn(x, y = x * 2, z = y + 1) { [x, y, z] }; f(1);`,
+			expected: []int{1, 2, 3},
+		},
+		{
+			input:    `let f = fn(x, y = x * 2, z = y + 1) { [x, y, z] }; f(1, 5);`,
+			expected: []int{1, 5, 6},
+		},
+		{
+			input:    `let f = fn(x = 1) { let y = 2; x + y }; f() + f(10);`,
+			expected: 15,
+		},
+		{
+			input:    `let f = fn(x, y = 2, rest...) { [x, y, len(rest)] }; f(1);`,
+			expected: []int{1, 2, 0},
+		},
+		{
+			input:    `let f = fn(x, y = 2, rest...) { [x, y, len(rest)] }; f(1, 3, 4, 5);`,
+			expected: []int{1, 3, 2},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrorKinds(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedKind object.ErrorKind
+		expectedMsg  string
+	}{
+		{`1 / 0`, object.DivideByZero, "division by zero"},
+		{`1.5 / 0`, object.DivideByZero, "division by zero"},
+		{`'a' * 2`, object.RuntimeError, "unknown char operator: 3"},
+		{`'a' - 98`, object.RuntimeError, "character out of range: -1"},
+		{`2 - 'a'`, object.TypeError, "unsupported types for binary operation: INTEGER CHAR"},
+		{`let f = fn(x) { 10 / x }; f(0)`, object.DivideByZero, "division by zero"},
+		{`1 + "a"`, object.TypeError, "unsupported types for binary operation: INTEGER STRING"},
+		{`-"a"`, object.TypeError, "unsupported type for negation: STRING"},
+		{`1[0]`, object.TypeError, "index operator not supported: INTEGER"},
+		{`{[{}]: 2}`, object.TypeError, "unusable as hash key: ARRAY"},
+		{`fn(a) { a }()`, object.ArgumentError, "wrong number of arguments: want=1 got=0"},
+		{`let x = 5; x()`, object.TypeError, "cannot call object of type INTEGER"},
+		{`"f"(1)`, object.TypeError, "cannot call object of type STRING"},
+		{`let f = fn() { [1](2) }; f()`, object.TypeError, "cannot call object of type ARRAY"},
+		{`assert(false, "no")`, object.AssertionError, "assertion failed: no"},
+		{`each([0], fn(x) { 1 / x })`, object.DivideByZero, "division by zero"},
+		{`1 in 1`, object.TypeError, "operator in not supported for INTEGER"},
+		{`[{}] in {}`, object.TypeError, "unusable as hash key: ARRAY"},
+		{`{} in set()`, object.TypeError, "unusable as hash key: HASH"},
+		{`2 ** 63`, object.RuntimeError, "integer overflow: 2 ** 63"},
+		{`10 ** 19`, object.RuntimeError, "integer overflow: 10 ** 19"},
+		{`let [a, b] = [1]`, object.IndexError, "not enough elements to destructure: want at least 2 got 1"},
+		{`let [a, ...b] = 1`, object.TypeError, "cannot destructure INTEGER"},
+		{`let add = fn(a, b) { a + b }; bind(add, 1)(2, 3)`, object.ArgumentError, "wrong number of arguments to add: want=2 got=3"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+
+		var runtimeErr *object.Error
+		if !errors.As(err, &runtimeErr) {
+			t.Fatalf("expected *object.Error for %q, got=%T (%v)", tt.input, err, err)
+		}
+
+		if runtimeErr.Kind != tt.expectedKind {
+			t.Errorf("wrong kind for %q. want=%s, got=%s", tt.input, tt.expectedKind, runtimeErr.Kind)
+		}
+		if runtimeErr.Message != tt.expectedMsg {
+			t.Errorf("wrong message for %q. want=%q, got=%q", tt.input, tt.expectedMsg, runtimeErr.Message)
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []vmTestCase{
+		{`try { 1 / 0 } catch (e) { e["message"] }`, "division by zero"},
+		{`try { 1 / 0 } catch (e) { e["kind"] }`, "DivideByZero"},
+		{`try { 1 / 0 } catch (e) { e["other"] }`, Null},
+		{`try { 10 } catch (e) { 20 }`, 10},
+		{`try { let x = 1; } catch (e) { 20 }`, Null},
+		{`try { 1 / 0 } catch { 20 }`, 20},
+		{`try { 1 / 0 } catch { }`, Null},
+		{`1 + try { 1 / 0 } catch { 41 }`, 42},
+		{`let f = fn() { 1 / 0 }; try { f() } catch (e) { e["kind"] }`, "DivideByZero"},
+		{`let f = fn(x) { try { 10 / x } catch (e) { -1 } }; [f(2), f(0)]`, []int{5, -1}},
+		{`try { try { 1 / 0 } catch (e) { 1 + "a" } } catch (e) { e["message"] }`,
+			"unsupported types for binary operation: INTEGER STRING"},
+		{`try { each([1, 0], fn(x) { 1 / x }) } catch (e) { e["message"] }`, "division by zero"},
+		{`let n = 0; each([1, 0, 2], fn(x) { n += try { 2 / x } catch { 100 } }); n`, 103},
+		{`try { assert(false, "no") } catch (e) { first([e])["message"] }`, "assertion failed: no"},
+		{`let f = fn() { f(); 1 }; try { f() } catch (e) { e["message"] }`, "stack overflow (depth=1024) in f"},
+		{`let f = fn() { try { return 1; } catch { 2 } }; try { f(); 1 / 0 } catch { "outer" }`, "outer"},
+		{`let f = fn(n) { try { if (n == 0) { 1 / 0 } else { return f(n - 1); } } catch (e) { n } }; f(3)`, 0},
+		{`let i = 0; while (true) { try { i += 1; if (i == 3) { break; } } catch { } } try { 1 / 0 } catch { i }`, 3},
+	}
+
+	runVmTests(t, tests)
+
+	// try bodies that were left must not catch later errors
+	uncaught := []string{
+		`let f = fn() { try { return 1; } catch { 2 } }; f(); 1 / 0`,
+		`let i = 0; while (i < 3) { try { i += 1; continue; } catch { } } 1 / 0`,
+		`let i = 0; while (true) { try { break; } catch { } } 1 / 0`,
+		`try { 1 } catch { 2 }; 1 / 0`,
+		`try { 1 / 0 } catch { 1 / 0 }`,
+	}
+
+	for _, input := range uncaught {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil || err.Error() != "division by zero" {
+			t.Errorf("expected uncaught division by zero for %q, got=%v", input, err)
+		}
+	}
+}
+
+func TestUnhashableKeys(t *testing.T) {
+	tests := []string{
+		`{[{}]: 2}`,
+		`let h = {}; h[[1, [fn() {}]]] = 2;`,
+		`{1: 2}[[{}]]`,
+	}
+
+	for _, input := range tests {
+		program := parse(input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if !errors.Is(err, object.ErrUnhashable) {
+			t.Fatalf("expected ErrUnhashable for %q, got=%v", input, err)
+		}
+
+		if err.Error() != "unusable as hash key: ARRAY" {
+			t.Errorf("wrong error message for %q. got=%q", input, err)
+		}
+	}
+}
+
+func TestArrayHashKeys(t *testing.T) {
+	tests := []vmTestCase{
+		{`let h = {[1, 2]: "a"}; h[[1, 2]]`, "a"},
+		{`let h = {[1, 2]: "a"}; h[[2, 1]]`, Null},
+		{`let h = {}; h[["x", [true]]] = 1; h[["x", [true]]]`, 1},
+		{`let h = {[1]: "a", [1]: "b"}; len(h)`, 1},
+		{`let h = {[]: 1}; h[[]]`, 1},
+		{`let h = {[1]: "a"}; h[["1"]]`, Null},
+		{`let k = [1]; let h = {}; h[k] = 1; h[[1]] += 1; h[k]`, 2},
+		{`unique([[1, 2], [1, 2], [2]])`, []interface{}{[]int{1, 2}, []int{2}}},
+		{`unique([1, 1.0, 2])`, []int{1, 2}},
+		{`len(unique([1.0, 1, [1], [1.0]]))`, 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestEntries(t *testing.T) {
+	tests := []vmTestCase{
+		{`entries({})`, []interface{}{}},
+		{`len(entries({"a": 1, "b": 2, "c": 3}))`, 3},
+		{`entries({1: "one"})`, []interface{}{[]interface{}{1, "one"}}},
+		{`entries({3: "c", 1: "a", 2: "b"})`, []interface{}{[]interface{}{3, "c"}, []interface{}{1, "a"}, []interface{}{2, "b"}}},
+		{`let [pair] = entries({"key": [1]}); let [k, v] = pair; [k, v]`, []interface{}{"key", []int{1}}},
+		{`entries([1])`, &object.Error{Kind: object.TypeError, Message: "argument to `entries` must be HASH, got ARRAY"}},
+		{`entries()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `entries`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashInsertionOrder(t *testing.T) {
+	tests := []vmTestCase{
+		{`let keys = []; hash_each({3: 1, 1: 1, 2: 1}, fn(k, v) { keys = push(keys, k) }); keys`, []int{3, 1, 2}},
+		{`let h = {"b": 1}; h["a"] = 2; h["c"] = 3; str(h)`, `{b: 1, a: 2, c: 3}`},
+		{`let h = {"b": 1, "a": 2}; h["b"] = 3; str(h)`, `{b: 3, a: 2}`},
+		{`str({1: "x", 1: "y", 0: "z"})`, `{1: y, 0: z}`},
+		{`str(merge({"b": 1, "a": 2}, {"c": 3, "b": 4}))`, `{b: 4, a: 2, c: 3}`},
+		{`str(from_entries([[2, 0], [1, 0]]))`, `{2: 0, 1: 0}`},
+		{`str(clone({"z": [1], "y": 2}))`, `{z: [1], y: 2}`},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHeap(t *testing.T) {
+	tests := []vmTestCase{
+		{`let h = heap(); each([5, 1, 4, 2, 3, 1], fn(x) { heap_push(h, x) }); let out = []; while (heap_len(h) > 0) { out = push(out, heap_pop(h)) } out`, []int{1, 1, 2, 3, 4, 5}},
+		{`let h = heap(fn(a, b) { a > b }); each([2, 9, 4], fn(x) { heap_push(h, x) }); [heap_pop(h), heap_pop(h), heap_len(h)]`, []int{9, 4, 1}},
+		{`let h = heap(fn(a, b) { a[0] < b[0] }); heap_push(h, [2, "b"]); heap_push(h, [1, "a"]); heap_pop(h)[1]`, "a"},
+		{`heap_pop(heap())`, Null},
+		{`let h = heap(); heap_push(h, 1); let c = clone(h); heap_pop(c); [heap_len(h), heap_len(c)]`, []int{1, 0}},
+		{`heap_push(heap(), "a")`, &object.Error{Kind: object.TypeError, Message: "heap without a comparator holds only INTEGER, got STRING"}},
+		{`heap(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `heap` must be a function, got INTEGER"}},
+		{`heap_pop([])`, &object.Error{Kind: object.TypeError, Message: "argument to `heap_pop` must be HEAP, got ARRAY"}},
+		{`heap_len()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `heap_len`. got=0, want=1"}},
+		{`try { let h = heap(fn(a, b) { a / b }); heap_push(h, 0); heap_push(h, 1) } catch (e) { e["kind"] }`, "DivideByZero"},
+		// a comparator failing partway through leaves the heap untouched
+		{`let budget = -1; let h = heap(fn(a, b) { if (budget == 0) { 1 / 0 } budget = budget - 1; a < b }); each([4, 2, 7, 1, 5, 3, 6], fn(x) { heap_push(h, x) }); budget = 3; let r = try { heap_pop(h) } catch (e) { e["kind"] }; budget = -1; let out = [r, heap_len(h)]; while (heap_len(h) > 0) { out = push(out, heap_pop(h)) } out`, []interface{}{"DivideByZero", 7, 1, 2, 3, 4, 5, 6, 7}},
+		{`let budget = -1; let h = heap(fn(a, b) { if (budget == 0) { 1 / 0 } budget = budget - 1; a < b }); each([4, 2, 7, 1, 5, 3, 6], fn(x) { heap_push(h, x) }); budget = 1; let r = try { heap_push(h, 0) } catch (e) { e["kind"] }; budget = -1; let out = [r, heap_len(h)]; while (heap_len(h) > 0) { out = push(out, heap_pop(h)) } out`, []interface{}{"DivideByZero", 7, 1, 2, 3, 4, 5, 6, 7}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSet(t *testing.T) {
+	tests := []vmTestCase{
+		{`set_len(set([1, 2, 2, 3, 1]))`, 3},
+		{`set_to_array(set([3, 1, 3, 2, 1]))`, []int{3, 1, 2}},
+		{`set_to_array(set())`, []int{}},
+		{`let s = set(["a"]); set_has(s, "a")`, true},
+		{`let s = set(["a"]); set_has(s, "b")`, false},
+		{`let s = set(["a"]); set_has(s, 1)`, false},
+		{`let s = set([[1, 2]]); set_has(s, [1, 2])`, true},
+		{`let s = set(); set_add(s, 2); set_add(s, 1); set_add(s, 2); set_to_array(s)`, []int{2, 1}},
+		{`let s = set([1, 2, 3]); [set_remove(s, 2), set_remove(s, 2), set_len(s)]`, []interface{}{true, false, 2}},
+		{`let s = set([1, 2]); set_remove(s, 1); set_add(s, 1); set_to_array(s)`, []int{2, 1}},
+		{`str(set([1, "a"]))`, "set([1, a])"},
+		{`let s = set([1]); let c = clone(s); set_add(c, 2); [set_len(s), set_len(c)]`, []int{1, 2}},
+		{`set([{}])`, &object.Error{Kind: object.TypeError, Message: "unusable as hash key: HASH"}},
+		{`set_add(set(), fn() {})`, &object.Error{Kind: object.TypeError, Message: "unusable as hash key: COMPILED_FUNCTION_OBJ"}},
+		{`set(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `set` must be ARRAY, got INTEGER"}},
+		{`set_has([1], 1)`, &object.Error{Kind: object.TypeError, Message: "first argument to `set_has` must be SET, got ARRAY"}},
+		{`set_len({})`, &object.Error{Kind: object.TypeError, Message: "argument to `set_len` must be SET, got HASH"}},
+		{`set_to_array()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `set_to_array`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSize(t *testing.T) {
+	tests := []vmTestCase{
+		{`size("four")`, 4},
+		{`size([1, 2, 3])`, 3},
+		{`size({"a": 1})`, 1},
+		{`size(set([1, 1, 2]))`, 2},
+		{`let h = heap(); heap_push(h, 3); heap_push(h, 1); size(h)`, 2},
+		{`size(0)`, 1},
+		{`size(12345)`, 5},
+		{`size(-987)`, 3},
+		{`size(fn(a, b, c) { a })`, 3},
+		{`size(fn() { 1 })`, 0},
+		{`size(fn(a, rest...) { a })`, 2},
+		{`let f = fn(x) { fn(a, b) { a + b + x } }; size(f(1))`, 2},
+		{`size(true)`, &object.Error{Kind: object.TypeError, Message: "argument to `size` not supported, got=BOOLEAN"}},
+		{`size(1, 2)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `size`. got=2, want=1"}},
+		{`len(set([1]))`, &object.Error{Kind: object.TypeError, Message: "argument to `len` not supported, got=SET"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinsBuiltin(t *testing.T) {
+	tests := []vmTestCase{
+		{`len(builtins()) == size(builtins())`, true},
+		{`"len" in builtins()`, true},
+		{`"puts" in builtins()`, true},
+		{`"builtins" in builtins()`, true},
+		{`"nope" in builtins()`, false},
+		{`builtins()[0]`, "len"},
+		// each call gets an array of its own
+		{`let b = builtins(); b[0] = "x"; builtins()[0]`, "len"},
+		{`builtins(1)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `builtins`. got=1, want=0"}},
+	}
+
+	runVmTests(t, tests)
+
+	program := parse(`builtins()`)
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	names := vm.LastPoppedStackElem().(*object.Array).Elements
+	if len(names) != len(object.Builtins) {
+		t.Fatalf("wrong number of names. want=%d, got=%d", len(object.Builtins), len(names))
+	}
+	for i, b := range object.Builtins {
+		if names[i].(*object.String).Value != b.Name {
+			t.Errorf("wrong name at %d. want=%q, got=%q", i, b.Name, names[i].Inspect())
+		}
+	}
+}
+
+func TestEquals(t *testing.T) {
+	tests := []vmTestCase{
+		{`equals(1, 1)`, true},
+		{`equals("a", "b")`, false},
+		{`equals([1, [2, {"a": [3]}]], [1, [2, {"a": [3]}]])`, true},
+		{`equals([1, [2, {"a": [3]}]], [1, [2, {"a": [4]}]])`, false},
+		{`equals({"a": 1, "b": [2]}, {"b": [2], "a": 1})`, true},
+		{`equals({"a": 1}, {"a": 1, "b": 2})`, false},
+		{`equals(set([1, 2, 3]), set([3, 2, 1]))`, true},
+		{`equals(set([1, 2]), set([1, 2, 3]))`, false},
+		{`equals(1, 1.0)`, true},
+		{`equals([1, 2], [1.0, 2])`, true},
+		{`equals(1, 1.5)`, false},
+		{`equals(1, "1")`, false},
+		{`equals([], {})`, false},
+		{`equals(null, false)`, false},
+		{`equals(null, null)`, true},
+		{`let a = [1]; a[0] = a; let b = [1]; b[0] = b; [a == b, equals(a, b), index_of([b], a)]`, []interface{}{true, true, 0}},
+		{`let f = fn() { 1 }; equals(f, f)`, true},
+		{`let f = fn() { 1 }; equals(f, fn() { 1 })`, false},
+		{`equals(1)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `equals`. got=1, want=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBaseConversion(t *testing.T) {
+	tests := []vmTestCase{
+		{`to_base(255, 16)`, "ff"},
+		{`to_base(5, 2)`, "101"},
+		{`to_base(-35, 36)`, "-z"},
+		{`to_base(0, 8)`, "0"},
+		{`from_base("ff", 16)`, 255},
+		{`from_base("FF", 16)`, 255},
+		{`from_base("-101", 2)`, -5},
+		{`from_base(to_base(123456789, 7), 7)`, 123456789},
+		{`from_base("12", 2)`, &object.Error{Kind: object.ArgumentError, Message: "invalid base 2 integer \"12\""}},
+		{`from_base("", 10)`, &object.Error{Kind: object.ArgumentError, Message: "invalid base 10 integer \"\""}},
+		{`from_base("1_0", 10)`, &object.Error{Kind: object.ArgumentError, Message: "invalid base 10 integer \"1_0\""}},
+		{`from_base("ffffffffffffffffff", 16)`, &object.Error{Kind: object.ArgumentError, Message: "invalid base 16 integer \"ffffffffffffffffff\""}},
+		{`to_base(1, 1)`, &object.Error{Kind: object.ArgumentError, Message: "base of `to_base` must be between 2 and 36, got 1"}},
+		{`from_base("1", 37)`, &object.Error{Kind: object.ArgumentError, Message: "base of `from_base` must be between 2 and 36, got 37"}},
+		{`to_base("1", 2)`, &object.Error{Kind: object.TypeError, Message: "first argument to `to_base` must be INTEGER, got STRING"}},
+		{`from_base(1, 2)`, &object.Error{Kind: object.TypeError, Message: "first argument to `from_base` must be STRING, got INTEGER"}},
+		{`to_base(1, "2")`, &object.Error{Kind: object.TypeError, Message: "second argument to `to_base` must be INTEGER, got STRING"}},
+		{`to_base(1)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `to_base`. got=1, want=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFromEntries(t *testing.T) {
+	tests := []vmTestCase{
+		{`let h = from_entries([[1, 2], [3, 4]]); h[1]`, 2},
+		{`let h = from_entries([[1, 2], [3, 4]]); h[3]`, 4},
+		{`len(from_entries([]))`, 0},
+		{`let h = from_entries([["a", 1], ["a", 2]]); [len(h), h["a"]]`, []int{1, 2}},
+		{`let h = {"x": 1, "y": [2]}; from_entries(entries(h)) == h`, true},
+		{`from_entries([[{}, 1]])`, &object.Error{Kind: object.TypeError, Message: "unusable as hash key: HASH"}},
+		{`from_entries([[1, 2], [3]])`, &object.Error{Kind: object.TypeError, Message: "element 1 of `from_entries` must be a [key, value] ARRAY, got [3]"}},
+		{`from_entries([1])`, &object.Error{Kind: object.TypeError, Message: "element 0 of `from_entries` must be a [key, value] ARRAY, got 1"}},
+		{`from_entries({})`, &object.Error{Kind: object.TypeError, Message: "argument to `from_entries` must be ARRAY, got HASH"}},
+		{`from_entries()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `from_entries`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let countdown = fn(n) { if (n == 0) { return 0; } countdown(n - 1) };
+			countdown(100000);`,
+			expected: 0,
+		},
+		{
+			input: `
+			let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };
+			sum(100000, 0);`,
+			expected: 5000050000,
+		},
+		{
+			input: `
+			let wrapper = fn(x) { len(x) };
+			wrapper([1, 2]);`,
+			expected: 2,
+		},
+		{
+			input: `
+			let inner = fn(a, b) { a - b };
+			let outer = fn(x) { inner(x, 1) };
+			outer(10);`,
+			expected: 9,
+		},
+	}
+
+	runVmTests(t, tests)
+
+	// without the tail call the same depth runs out of frames
+	program := parse(`
+	let countdown = fn(n) { if (n == 0) { return 0; } 0 + countdown(n - 1) };
+	countdown(100000);`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil || !strings.HasSuffix(err.Error(), " in countdown") {
+		t.Fatalf("expected stack overflow, got=%v", err)
+	}
+}
+
+func TestStackOverflowMessage(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// runs out of frames
+		{`let forever = fn() { forever(); 1 }; forever()`, "stack overflow (depth=1024) in forever"},
+		// runs out of stack space first, as every frame holds three values
+		{`let f = fn(g) { 1 + g(g) }; f(f)`, "stack overflow (depth=684) in f"},
+		{`fn(g) { 1 + g(g) }(fn(g) { 1 + g(g) })`, "stack overflow (depth=684)"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestCallingWithWrongNumOfArguments(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			fn() { 5; }(1);`,
+			expected: "wrong number of arguments: want=0 got=1",
+		},
+		{
+			input: `
+			fn(a, b){ a + b}(3)`,
+			expected: "wrong number of arguments: want=2 got=1",
+		},
+		{
+			input: `
+			let sum = fn(a, b) { a + b };
+			sum(1);`,
+			expected: "wrong number of arguments to sum: want=2 got=1",
+		},
+		{
+			input: `
+			let f = fn(a, b, rest...) { rest };
+			f(1);`,
+			expected: "wrong number of arguments to f: want at least 2 got=1",
+		},
+		{
+			input: `
+			let f = fn(a, b = 2) { a + b };
+			f(1, 2, 3);`,
+			expected: "wrong number of arguments to f: want at most 2 got=3",
+		},
+		{
+			input: `
+			let f = fn(a, b = 2) { a + b };
+			f();`,
+			expected: "wrong number of arguments to f: want at least 1 got=0",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Errorf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+
+		if err == nil {
+			t.Errorf("expected vm error but got none")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("expected vm error %s, got %s", tt.expected, err)
+		}
+	}
+
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len([1, 2, 3])`, 3},
+		{`len({1: 2})`, 1},
+		{`len(1)`, &object.Error{Message: "argument to `len` not supported, got=INTEGER"}},
+		{`first([1, 2, 3])`, 1},
+		{`first([])`, Null},
+		{`last([1, 2, 3])`, 3},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`push([], 1)`, []int{1}},
+		{`push([1])`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `push`. got=1, want=2"}},
+		{`push(1, 2)`, &object.Error{Kind: object.TypeError, Message: "first argument to `push` must be ARRAY, got INTEGER"}},
+		{`let a = push(push([1], 2), 3); let b = push(a, 4); let c = push(a, 5); [b, c, a]`,
+			[]interface{}{[]int{1, 2, 3, 4}, []int{1, 2, 3, 5}, []int{1, 2, 3}}},
+		{`range(0, 3)`, []int{0, 1, 2}},
+		{`range(3, 0)`, []int{}},
+		{`range(0, 10, 2)`, []int{0, 2, 4, 6, 8}},
+		{`range(0, 9, 3)`, []int{0, 3, 6}},
+		{`range(5, 0, -1)`, []int{5, 4, 3, 2, 1}},
+		{`range(10, 0, -4)`, []int{10, 6, 2}},
+		{`range(0, 5, -1)`, []int{}},
+		{`range(2, 2, 1)`, []int{}},
+		{`range(0, 9223372036854775807, 9223372036854775807)`, []int{0}},
+		{`range(0, 9223372036854775807, 4611686018427387904)`, []int{0, 4611686018427387904}},
+		{`range(9223372036854775807, -9223372036854775807, -9223372036854775807)`, []int{9223372036854775807, 0}},
+		{`range(0, 3, 0)`, &object.Error{Kind: object.ArgumentError, Message: "step of `range` must not be zero"}},
+		{`range(0)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `range`. got=1, want=2 or 3"}},
+		{`range(0, 3, "1")`, &object.Error{Kind: object.TypeError, Message: "arg must be INTEGERS"}},
+		{`puts("hello")`, Null},
+		{`rand(0)`, &object.Error{Message: "argument to `rand` must be positive, got 0"}},
+		{`rand(1)`, 0},
+		{`sum([1, 2, 3, 4])`, 10},
+		{`sum([])`, 0},
+		{`sum([1, 2.5])`, 3.5},
+		{`sum([0.5, 1, 2])`, 3.5},
+		{`sum([9223372036854775807, -1, 1])`, 9223372036854775807},
+		{`sum([-9223372036854775807, -1])`, -9223372036854775808},
+		{`sum([9223372036854775807, 1])`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `sum` at index 1"}},
+		{`sum([-9223372036854775807, -1, -1])`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `sum` at index 2"}},
+		{`sum([1, "a"])`, &object.Error{Kind: object.TypeError, Message: "`sum` cannot add STRING"}},
+		{`sum()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `sum`. got=0, want=1"}},
+		{`sum(1)`, &object.Error{Message: "argument to `sum` must be ARRAY, got INTEGER"}},
+		{`index_of(["a", "b", "c"], "b")`, 1},
+		{`index_of([1, 2], 9)`, -1},
+		{`index_of([[1], [2, 3]], [2, 3])`, 1},
+		{`index_of([{"a": 1}], {"a": 1})`, 0},
+		{`index_of([1, 2], 2.0)`, 1},
+		{`2.0 in [1, 2]`, true},
+		{`index_of("abc", "b")`, &object.Error{Message: "first argument to `index_of` must be ARRAY, got STRING"}},
+		{`slice([1, 2, 3, 4], 1, 3)`, []int{2, 3}},
+		{`slice([1, 2, 3, 4], 0, 100)`, []int{1, 2, 3, 4}},
+		{`slice([1, 2, 3, 4], -100, 2)`, []int{1, 2}},
+		{`slice([1, 2, 3, 4], -2, 4)`, []int{3, 4}},
+		{`slice([1, 2, 3, 4], 1, -1)`, []int{2, 3}},
+		{`slice([1, 2, 3, 4], 3, 1)`, []int{}},
+		{`let a = [1, 2, 3]; let b = slice(a, 0, 2); b[0] = 9; a`, []int{1, 2, 3}},
+		{`slice("abc", 0, 1)`, &object.Error{Message: "first argument to `slice` must be ARRAY, got STRING"}},
+		{`slice([1], "a", 1)`, &object.Error{Message: "start of `slice` must be INTEGER, got STRING"}},
+		{`let a = [1, [2, 3]]; let b = clone(a); b[1][0] = 9; a`, []interface{}{1, []int{2, 3}}},
+		{`let a = [1, [2, 3]]; let b = clone(a); a[1][0] = 9; b`, []interface{}{1, []int{2, 3}}},
+		{`let h = {"a": [1]}; let c = clone(h); c["a"][0] = 2; c["b"] = 3; [h["a"], len(h)]`, []interface{}{[]int{1}, 1}},
+		{`let a = [1, 2]; a[0] = a; let b = clone(a); b[1] = 9; [a[1], b[0][1]]`, []int{2, 9}},
+		{`let h = {"n": 1}; h["self"] = [h]; let c = clone(h); c["n"] = 2; [h["n"], c["self"][0]["n"]]`, []int{1, 2}},
+		{`clone(5)`, 5},
+		{`let f = fn() { 1 }; clone(f) == f`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestInput(t *testing.T) {
+	input := `let name = input("name? "); let next = input(); [name, next, input()]`
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode(),
+		WithInput(strings.NewReader("monkey\r\nbanana")),
+		WithOutput(&out))
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	result, ok := vm.LastPoppedStackElem().(*object.Array)
+	if !ok || len(result.Elements) != 3 {
+		t.Fatalf("wrong result. got=%s", vm.LastPoppedStackElem().Inspect())
+	}
+	textExpectedObject(t, "monkey", result.Elements[0])
+	textExpectedObject(t, "banana", result.Elements[1])
+	textExpectedObject(t, Null, result.Elements[2])
+
+	if out.String() != "name? " {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+func TestGetGlobal(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+	let x = 42;
+	let name = "monkey";
+	let f = fn() { let local = 1; local };
+	if (false) { let later = 1; }
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode(), WithSymbolTable(comp.SymbolTable()))
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	x, ok := vm.GetGlobal("x")
+	if !ok {
+		t.Fatalf("global x not found")
+	}
+	textExpectedObject(t, 42, x)
+
+	name, ok := vm.GetGlobal("name")
+	if !ok {
+		t.Fatalf("global name not found")
+	}
+	textExpectedObject(t, "monkey", name)
+
+	for _, missing := range []string{"local", "later", "len", "nope"} {
+		if _, ok := vm.GetGlobal(missing); ok {
+			t.Errorf("expected no global %q", missing)
+		}
+	}
+
+	vm = New(comp.Bytecode())
+	if _, ok := vm.GetGlobal("x"); ok {
+		t.Errorf("expected no globals without a symbol table")
+	}
+}
+
+func TestPutsWritesToOutput(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`puts("hello", 1)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode(), WithOutput(&out))
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if out.String() != "hello\n1\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+func TestPrintWritesToOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`print("a", "b")`, "a b"},
+		{`print("a"); print(1, [2]); print()`, "a1 [2]"},
+		{`each([1, 2, 3], fn(x) { print(x, "") })`, "1 2 3 "},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(comp.Bytecode(), WithOutput(&out))
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != tt.expected {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expected, out.String())
+		}
+	}
+}
+
+func TestPrettyPrint(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`pp(1)`, "1\n"},
+		{`pp([], {})`, "[]\n{}\n"},
+		{`pp({"a": [1, {"b": 2}], "c": []})`, `{
+  a: [
+    1,
+    {
+      b: 2
+    }
+  ],
+  c: []
+}
+`},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+		vm := New(comp.Bytecode(), WithOutput(&out))
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != tt.expected {
+			t.Errorf("wrong output for %q. want=%q, got=%q", tt.input, tt.expected, out.String())
+		}
+	}
+}
+
+func TestNowUsesInjectedClock(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let start = now(); [start, now() - start]`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	clock := func() time.Time { return time.UnixMilli(1700000000123) }
+	vm := New(comp.Bytecode(), WithClock(clock))
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	textExpectedObject(t, []interface{}{1700000000123, 0}, vm.LastPoppedStackElem())
+}
+
+func TestMaxArrayLength(t *testing.T) {
+	tests := []struct {
+		input string
+		max   int
+		want  interface{}
+	}{
+		{`range(0, 100000000)`, 0, "array too large: length 100000000 exceeds the maximum of 16777216"},
+		{`range(0, 3)`, 3, []int{0, 1, 2}},
+		{`range(0, 4)`, 3, "array too large: length 4 exceeds the maximum of 3"},
+		{`range(-9223372036854775807, 9223372036854775807)`, 0, "array too large: length 9223372036854775807 exceeds the maximum of 16777216"},
+		{`range(0, 9223372036854775807, 1000000000000000000)`, 3, "array too large: length 10 exceeds the maximum of 3"},
+		{`push([1, 2, 3], 4)`, 3, "array too large: length 4 exceeds the maximum of 3"},
+		{`[1, 2, 3, 4]`, 3, "array too large: length 4 exceeds the maximum of 3"},
+		{`[1, 2, 3, 4]`, -1, []int{1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		opts := []Option{}
+		if tt.max != 0 {
+			opts = append(opts, WithMaxArrayLength(tt.max))
+		}
+		vm := New(comp.Bytecode(), opts...)
+		err = vm.Run()
+
+		msg, ok := tt.want.(string)
+		if !ok {
+			if err != nil {
+				t.Fatalf("vm error for %q: %s", tt.input, err)
+			}
+			textExpectedObject(t, tt.want, vm.LastPoppedStackElem())
+			continue
+		}
+
+		// builtins hand the error to the program, array literals stop the VM
+		got := err
+		if result, isErr := vm.LastPoppedStackElem().(*object.Error); err == nil && isErr {
+			got = result
+		}
+		if !errors.Is(got, object.ErrArrayTooLarge) {
+			t.Fatalf("expected ErrArrayTooLarge for %q, got=%v", tt.input, got)
+		}
+		if got.Error() != msg {
+			t.Errorf("wrong message for %q. want=%q, got=%q", tt.input, msg, got.Error())
+		}
+	}
+}
+
+func TestMaxRecursionDepth(t *testing.T) {
+	const defs = `
+	let sum = fn(n) { if (n == 0) { return 0 } n + sum(n - 1) };
+	let countDown = fn(n) { if (n == 0) { return 0 } countDown(n - 1) };
+	let isOdd = null;
+	let isEven = fn(n) { if (n == 0) { return true } isOdd(n - 1) };
+	isOdd = fn(n) { if (n == 0) { return false } isEven(n - 1) };
+	`
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{`sum(9)`, 45},
+		{`sum(10)`, "maximum recursion depth exceeded (limit=10)"},
+		{`countDown(9)`, 0},
+		// the frame is reused, but every tail call still counts
+		{`countDown(10)`, "maximum recursion depth exceeded (limit=10)"},
+		{`isEven(9)`, false},
+		{`isEven(12)`, "maximum recursion depth exceeded (limit=10)"},
+		{`let r = try { sum(50) } catch (e) { 0 }; r + sum(9)`, 45},
+		{`let gen = fn() { yield sum(8) }; next(gen())`, 36},
+		{`let gen = fn() { yield sum(9) }; next(gen())`, "maximum recursion depth exceeded (limit=10)"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(defs + tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode(), WithMaxRecursionDepth(10))
+		err = vm.Run()
+
+		if msg, ok := tt.want.(string); ok {
+			if err == nil || err.Error() != msg {
+				t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, msg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		textExpectedObject(t, tt.want, vm.LastPoppedStackElem())
+	}
+}
+
+func TestSeededRandIsDeterministic(t *testing.T) {
+	input := `seed(42); let a = [rand(100), rand(100), rand(100)]; seed(42); [a, [rand(100), rand(100), rand(100)]]`
+
+	run := func() *object.Array {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		return vm.LastPoppedStackElem().(*object.Array)
+	}
+
+	first := run()
+	if !object.Equal(first.Elements[0], first.Elements[1]) {
+		t.Errorf("reseeding gave a different sequence: %s", first.Inspect())
+	}
+
+	for _, el := range first.Elements[0].(*object.Array).Elements {
+		n := el.(*object.Integer).Value
+		if n < 0 || n >= 100 {
+			t.Errorf("rand(100) out of range: %d", n)
+		}
+	}
+
+	second := run()
+	if !object.Equal(first, second) {
+		t.Errorf("same seed gave different sequences in separate VMs: %s vs %s", first.Inspect(), second.Inspect())
+	}
+}
+
+func TestAssert(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{`assert(true); 1`, 1},
+		{`assert(1 < 2, "math"); assert([])`, Null},
+		{`assert(1, 2)`, &object.Error{Message: "message of `assert` must be STRING, got INTEGER"}},
+	})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`assert(1 == 2, "oops"); 1`, "assertion failed: oops"},
+		{`let f = fn(x) { assert(x > 0); x }; f(1); f(0); 3`, "assertion failed"},
+		{`assert(if (false) { 1 })`, "assertion failed"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but got none", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestHashEach(t *testing.T) {
+	tests := []vmTestCase{
+		{`let total = 0; hash_each({"a": 1, "b": 2, "c": 3}, fn(k, v) { total += v; }); total`, 6},
+		{`let keys = []; hash_each({1: "a", 2: "b"}, fn(k, v) { keys = push(keys, k) }); keys`, []int{1, 2}},
+		{`hash_each({}, fn(k, v) { assert(false) })`, Null},
+		{`hash_each({"a": 1}, fn(k, v) { len(v) })`, &object.Error{Message: "argument to `len` not supported, got=INTEGER"}},
+		{`hash_each([1], fn(k, v) { v })`, &object.Error{Message: "first argument to `hash_each` must be HASH, got ARRAY"}},
+		{`hash_each({}, 1)`, &object.Error{Message: "second argument to `hash_each` must be a function, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`hash_each({"a": 1}, fn(v) { v }); 1`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = New(comp.Bytecode()).Run()
+	if err == nil || err.Error() != "wrong number of arguments: want=1 got=2" {
+		t.Fatalf("expected callback error to halt the VM, got=%v", err)
+	}
+}
+
+func TestEach(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`each([1, 2, 3], fn(x) { puts(x) })`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode(), WithOutput(&out))
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if out.String() != "1\n2\n3\n" {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+	textExpectedObject(t, Null, vm.LastPoppedStackElem())
+
+	tests := []vmTestCase{
+		{`let n = 0; each(["a", 1, "b"], fn(x) { n += 1; len(x) }); n`, 2},
+		{`each([], 1)`, &object.Error{Message: "second argument to `each` must be a function, got INTEGER"}},
+		{`each(1, fn(x) { x })`, &object.Error{Message: "first argument to `each` must be ARRAY, got INTEGER"}},
+		{`each([[1], [2, 3]], len)`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPowAndSqrt(t *testing.T) {
+	tests := []vmTestCase{
+		{`pow(2, 10)`, 1024},
+		{`pow(-3, 3)`, -27},
+		{`pow(7, 0)`, 1},
+		{`pow(2, -2)`, 0.25},
+		{`pow(-2, 63)`, -9223372036854775808},
+		{`pow(2, 64)`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: 2 ** 64"}},
+		{`pow(10, 19)`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: 10 ** 19"}},
+		{`sqrt(16)`, 4.0},
+		{`sqrt(0)`, 0.0},
+		{`sqrt(-1)`, &object.Error{Kind: object.ArgumentError, Message: "argument to `sqrt` must not be negative, got -1"}},
+		{`sqrt("4")`, &object.Error{Kind: object.TypeError, Message: "argument to `sqrt` must be INTEGER or FLOAT, got STRING"}},
+		{`pow(2)`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `pow`. got=1, want=2"}},
+		{`pow(2, "a")`, &object.Error{Kind: object.TypeError, Message: "second argument to `pow` must be INTEGER, got STRING"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1.5", 1.5},
+		{"1.5 + 2.25", 3.75},
+		{"1.5 * 2", 3.0},
+		{"7 / 2.0", 3.5},
+		{"-0.5 - 1", -1.5},
+		{"2.5 > 2", true},
+		{"1 < 1.5", true},
+		{"2.0 == 2", true},
+		{"0.1 != 0.1", false},
+		{"let x = 1.0; x += 0.5; x", 1.5},
+		{"sqrt(2) * sqrt(2) > 1.99", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRoundingBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`floor(3.7)`, 3},
+		{`ceil(3.2)`, 4},
+		{`round(3.5)`, 4},
+		{`round(3.49)`, 3},
+		{`floor(-3.5)`, -4},
+		{`ceil(-3.5)`, -3},
+		{`round(-3.5)`, -4},
+		{`floor(5)`, 5},
+		{`ceil(sqrt(10))`, 4},
+		{`floor(9223372036854774784.0)`, 9223372036854774784},
+		{`ceil(-9223372036854775808.0)`, -9223372036854775807 - 1},
+		{`floor(100000000000000000000.0)`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `floor` of 1e+20"}},
+		{`round(9223372036854775807.0)`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `round` of 9.223372036854776e+18"}},
+		{`floor(pow(0, -1))`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `floor` of +Inf"}},
+		{`floor(pow(0, -1) - pow(0, -1))`, &object.Error{Kind: object.RuntimeError, Message: "integer overflow: `floor` of NaN"}},
+		{`floor("3")`, &object.Error{Kind: object.TypeError, Message: "argument to `floor` must be INTEGER or FLOAT, got STRING"}},
+		{`round()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `round`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestChars(t *testing.T) {
+	tests := []vmTestCase{
+		{`'a'`, 'a'},
+		{`'\n'`, '\n'},
+		{`'\''`, '\''},
+		{`'é'`, 'é'},
+		{`'a' + 1`, 'b'},
+		{`1 + 'a'`, 'b'},
+		{`'z' - 25`, 'a'},
+		{`'z' - 'a'`, 25},
+		{`'a' == 'a'`, true},
+		{`'a' == 'b'`, false},
+		{`'a' != 'b'`, true},
+		{`'a' < 'b'`, true},
+		{`'b' >= 'c'`, false},
+		{`'a' == "a"`, false},
+		{`ord('A')`, 65},
+		{`chr(ord('a' + 2))`, "c"},
+		{`let h = {'a': 1, "a": 2}; [h['a'], h["a"], len(h)]`, []int{1, 2, 2}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDefined(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; defined("x")`, true},
+		{`defined("y")`, false},
+		{`defined("len")`, true},
+		{`let before = defined("x"); let x = 1; [before, defined("x")]`, []interface{}{false, true}},
+		{`let f = fn(a) { [defined("a"), defined("b")] }; f(1)`, []interface{}{true, false}},
+		{`let defined = fn(name) { name }; defined("x")`, "x"},
+		{`let name = "x"; defined(name)`, &object.Error{Kind: object.ArgumentError, Message: "argument to `defined` must be a string literal"}},
+		{`defined()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `defined`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMemoize(t *testing.T) {
+	tests := []vmTestCase{
+		{`let n = 0; let f = memoize(fn(x) { n += 1; x * 2 }); [f(1), f(1), f(2), f(1), n]`, []interface{}{2, 2, 4, 2, 2}},
+		{`let n = 0; let f = memoize(fn(x) { n += 1; x }); f(1); f("1"); n`, 2},
+		{`let m = memoize(fn(x) { x }); m([1]); m(["1"])[0] + "!"`, "1!"},
+		{`let n = 0; let f = memoize(fn(x) { n += 1; x }); f([[1, 2]]); f([["1", 2]]); f([[1, "2"]]); f([[1, 2]]); n`, 3},
+		{`let n = 0; let f = memoize(fn(x) { n += 1; x }); f({"a": [1]}); f({"a": ["1"]}); f({"a": [1]}); n`, 2},
+		{`let n = 0; let f = memoize(fn(a, b) { n += 1; a + b }); f(1, 2); f(2, 1); f(1, 2); n`, 2},
+		{`let fib = 0; fib = memoize(fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }); fib(80)`, 23416728348467685},
+		{`let n = 0; each([1, 2, 1], memoize(fn(x) { n += 1 })); n`, 2},
+		{`memoize(len)("abc")`, 3},
+		{`memoize(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `memoize` must be a function, got INTEGER"}},
+		{`memoize()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `memoize`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestPostfixOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{`let i = 0; i++; i++; i`, 2},
+		{`let i = 5; i--; i`, 4},
+		{`let a = [5]; a[0]++; a[0]`, 6},
+		{`let h = {"n": 1}; h["n"]--; h["n"]`, 0},
+		{`let i = 1; let j = i++; [i, j]`, []interface{}{2, 2}},
+		{`let f = fn() { let n = 0; n++; n++ }; f()`, 2},
+		{`let i = 0; while (i < 5) { i++; } i`, 5},
+		{`let x = 1.5; x++; x`, 2.5},
+		{`let c = 'a'; c++; c`, 'b'},
+		{`let calls = 0; let a = [1, 2]; let at = fn() { calls += 1; 1 }; a[at()]++; [a, calls]`, []interface{}{[]interface{}{1, 3}, 1}},
+		// -- in front of an operand is two minus signs
+		{`1--1`, 2},
+		{`--5`, 5},
+		{`let a = 3; let b = 1; a--b`, 4},
+		{`let a = 3; let b = 1; a--b; a`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGenerators(t *testing.T) {
+	tests := []vmTestCase{
+		{`let count = fn() { yield 1; yield 2; yield 3; }; let g = count(); [next(g), next(g), next(g), next(g), next(g)]`,
+			[]interface{}{1, 2, 3, Null, Null}},
+		{`let upto = fn(n) { let i = 0; while (i < n) { yield i; i++; } }; let g = upto(3); [next(g), next(g), next(g), next(g)]`,
+			[]interface{}{0, 1, 2, Null}},
+		{`let g = fn() { yield 1; 99 }(); [next(g), next(g), next(g)]`, []interface{}{1, Null, Null}},
+		{`let g = fn() { yield; }(); next(g)`, Null},
+		{`let n = 0; let g = fn() { n = 1; yield n; }(); [n, next(g), n]`, []interface{}{0, 1, 1}},
+		{`let gen = fn(a, b) { yield a + b; yield a * b; }; let x = gen(2, 3); let y = gen(4, 5); [next(x), next(y), next(x), next(y)]`,
+			[]interface{}{5, 9, 6, 20}},
+		{`let inner = fn() { yield 1; yield 2; }; let outer = fn() { let g = inner(); yield next(g) + 10; yield next(g) + 20; }; let g = outer(); [next(g), next(g)]`,
+			[]interface{}{11, 22}},
+		{`let g = fn(xs...) { let i = 0; while (i < len(xs)) { yield xs[i] * 2; i++; } }(1, 2); [next(g), next(g), next(g)]`,
+			[]interface{}{2, 4, Null}},
+		{`let nat = fn() { let i = 0; while (true) { yield i; i++; } }; let g = nat(); let sum = 0; let k = 0; while (k < 100) { sum += next(g); k++; } sum`, 4950},
+		{`let g = fn() { yield 1; 1 / 0; }(); next(g); let r = try { next(g) } catch (e) { e["kind"] }; [r, next(g)]`,
+			[]interface{}{"DivideByZero", Null}},
+		{`let g = 0; g = fn() { yield next(g); }(); try { next(g) } catch (e) { e["message"] }`, "generator is already running"},
+		{`next(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `next` must be GENERATOR, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTemplateLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"let name = \"Ann\"; let age = 30; `hello ${name}, you are ${age}`", "hello Ann, you are 30"},
+		{"`${1 + 2}`", "3"},
+		{"`sum: ${[1, 2][0] + len(\"abc\")}!`", "sum: 4!"},
+		{"`${ {\"a\": [1, 2]}[\"a\"] }`", "[1, 2]"},
+		{"`${\"}\"}`", "}"},
+		{"`a\\${b}`", "a${b}"},
+		{"`line\\n`", "line\n"},
+		{"``", ""},
+		{"`${1.5} ${'c'} ${true} ${null}`", "1.5 c true null"},
+		{"let x = 2; `${`${x}`}`", "2"},
+		{"let str = fn(x) { \"shadowed\" }; `${1}`", "1"},
+		{"`// not a comment`", "// not a comment"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStr(t *testing.T) {
+	tests := []vmTestCase{
+		{`str(1)`, "1"},
+		{`str("a")`, "a"},
+		{`str([1, "a"])`, "[1, a]"},
+		{`str(null)`, "null"},
+		{`str()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `str`. got=0, want=1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCount(t *testing.T) {
+	tests := []vmTestCase{
+		{`count([1, 2, 3, 4], fn(x) { x > 2 })`, 2},
+		{`count([1, 1, 2], 1)`, 2},
+		{`count([[1], [2], [1]], [1])`, 2},
+		{`count([], fn(x) { true })`, 0},
+		{`count([1, "1", 1.0], 1)`, 2},
+		{`count([0, null, false, 1], fn(x) { x })`, 2},
+		{`count(["a", "bb"], len)`, 2},
+		{`count({}, 1)`, &object.Error{Kind: object.TypeError, Message: "first argument to `count` must be ARRAY, got HASH"}},
+		{`count([1])`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `count`. got=1, want=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAnyAndAll(t *testing.T) {
+	tests := []vmTestCase{
+		{`any([1, 2, 3], fn(x) { x > 2 })`, true},
+		{`any([1, 2, 3], fn(x) { x > 3 })`, false},
+		{`any([], fn(x) { true })`, false},
+		{`all([2, 4], fn(x) { x / 2 * 2 == x })`, true},
+		{`all([2, 3], fn(x) { x / 2 * 2 == x })`, false},
+		{`all([], fn(x) { false })`, true},
+		{`let calls = 0; any([1, 2, 3], fn(x) { calls += 1; x == 2 }); calls`, 2},
+		{`let calls = 0; all([1, 2, 3], fn(x) { calls += 1; x < 2 }); calls`, 2},
+		{`try { any([0], fn(x) { 1 / x }) } catch (e) { e["kind"] }`, "DivideByZero"},
+		{`any(1, len)`, &object.Error{Kind: object.TypeError, Message: "first argument to `any` must be ARRAY, got INTEGER"}},
+		{`all([1], 1)`, &object.Error{Kind: object.TypeError, Message: "second argument to `all` must be a function, got INTEGER"}},
+		{`all([1])`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `all`. got=1, want=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBind(t *testing.T) {
+	tests := []vmTestCase{
+		{`let add = fn(a, b) { a + b }; let add5 = bind(add, 5); add5(3)`, 8},
+		{`let add = fn(a, b) { a + b }; bind(add, 1, 2)()`, 3},
+		{`let add = fn(a, b) { a + b }; bind(add)(1, 2)`, 3},
+		{`let sub = fn(a, b, c) { a - b - c }; bind(bind(sub, 10), 3)(2)`, 5},
+		{`let push1 = bind(push, [1]); push1(2)`, []interface{}{1, 2}},
+		{`let all = fn(first, rest...) { [first, rest] }; bind(all, 1, 2)(3)`, []interface{}{1, []interface{}{2, 3}}},
+		{`let add5 = bind(fn(a, b) { a + b }, 5); add5(1); add5(2)`, 7},
+		{`bind(1, 2)`, &object.Error{Kind: object.TypeError, Message: "first argument to `bind` must be a function, got INTEGER"}},
+		{`bind()`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `bind`. got=0, want at least 1"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestOrdAndChr(t *testing.T) {
+	tests := []vmTestCase{
+		{`ord("A")`, 65},
+		{`ord("é")`, 233},
+		{`chr(65)`, "A"},
+		{`chr(0x1F600)`, "😀"},
+		{`chr(ord("a") + 1)`, "b"},
+		{`ord("")`, &object.Error{Kind: object.ArgumentError, Message: "argument to `ord` must be a single character, got \"\""}},
+		{`ord("ab")`, &object.Error{Kind: object.ArgumentError, Message: "argument to `ord` must be a single character, got \"ab\""}},
+		{`ord(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `ord` must be STRING or CHAR, got INTEGER"}},
+		{`chr(-1)`, &object.Error{Kind: object.ArgumentError, Message: "argument to `chr` is not a valid code point: -1"}},
+		{`chr(0x110000)`, &object.Error{Kind: object.ArgumentError, Message: "argument to `chr` is not a valid code point: 1114112"}},
+		{`chr(0xD800)`, &object.Error{Kind: object.ArgumentError, Message: "argument to `chr` is not a valid code point: 55296"}},
+		{`chr("A")`, &object.Error{Kind: object.TypeError, Message: "argument to `chr` must be INTEGER, got STRING"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStringPredicates(t *testing.T) {
+	tests := []vmTestCase{
+		{`starts_with("hello", "he")`, true},
+		{`starts_with("hello", "lo")`, false},
+		{`starts_with("hello", "")`, true},
+		{`ends_with("hello", "lo")`, true},
+		{`ends_with("hello", "he")`, false},
+		{`contains_str("hello", "ell")`, true},
+		{`contains_str("hello", "xyz")`, false},
+		{`starts_with("hello")`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `starts_with`. got=1, want=2"}},
+		{`ends_with(1, "a")`, &object.Error{Kind: object.TypeError, Message: "first argument to `ends_with` must be STRING, got INTEGER"}},
+		{`contains_str("a", [])`, &object.Error{Kind: object.TypeError, Message: "second argument to `contains_str` must be STRING, got ARRAY"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestZip(t *testing.T) {
+	tests := []vmTestCase{
+		{`zip([1, 2, 3], ["a", "b"])`, []interface{}{[]interface{}{1, "a"}, []interface{}{2, "b"}}},
+		{`zip([1], [2, 3])`, []interface{}{[]int{1, 2}}},
+		{`zip([], [1])`, []int{}},
+		{`zip([1], 2)`, &object.Error{Kind: object.TypeError, Message: "second argument to `zip` must be ARRAY, got INTEGER"}},
+		{`zip("a", [])`, &object.Error{Kind: object.TypeError, Message: "first argument to `zip` must be ARRAY, got STRING"}},
+		{`zip([])`, &object.Error{Kind: object.ArgumentError, Message: "wrong number of arguments to `zip`. got=1, want=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUnique(t *testing.T) {
+	tests := []vmTestCase{
+		{`unique([1, 2, 2, 3, 1])`, []int{1, 2, 3}},
+		{`unique([])`, []int{}},
+		{`unique(["a", "b", "a", true, true, 1])`, []interface{}{"a", "b", true, 1}},
+		{`unique([[1, 2], [1, 2], [2, 1], [1]])`, []interface{}{[]int{1, 2}, []int{2, 1}, []int{1}}},
+		{`let a = [3, 3]; unique(a); a`, []int{3, 3}},
+		{`unique(1)`, &object.Error{Kind: object.TypeError, Message: "argument to `unique` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMerge(t *testing.T) {
+	tests := []vmTestCase{
+		{`let m = merge({"a": 1, "b": 2}, {"b": 20, "c": 30}); [m["a"], m["b"], m["c"], len(m)]`, []int{1, 20, 30, 3}},
+		{`let a = {"a": 1}; let b = {"a": 2, 1: 3}; merge(a, b); [a["a"], len(a), b["a"], len(b)]`, []int{1, 1, 2, 2}},
+		{`let a = {"a": 1}; let m = merge(a, {}); m["a"] = 5; a["a"]`, 1},
+		{`len(merge({}, {}))`, 0},
+		{`merge({}, [])`, &object.Error{Kind: object.TypeError, Message: "second argument to `merge` must be HASH, got ARRAY"}},
+		{`merge(1, {})`, &object.Error{Kind: object.TypeError, Message: "first argument to `merge` must be HASH, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTakeAndDrop(t *testing.T) {
+	tests := []vmTestCase{
+		{`take([1, 2, 3, 4], 2)`, []int{1, 2}},
+		{`drop([1, 2, 3, 4], 2)`, []int{3, 4}},
+		{`take([1, 2], 5)`, []int{1, 2}},
+		{`drop([1, 2], 5)`, []int{}},
+		{`take([1, 2], 0)`, []int{}},
+		{`drop([1, 2], 0)`, []int{1, 2}},
+		{`let a = [1, 2]; let b = drop(a, 0); b[0] = 9; a`, []int{1, 2}},
+		{`take([1], -1)`, &object.Error{Kind: object.ArgumentError, Message: "second argument to `take` must not be negative, got -1"}},
+		{`drop("ab", 1)`, &object.Error{Kind: object.TypeError, Message: "first argument to `drop` must be ARRAY, got STRING"}},
+		{`take([1], "1")`, &object.Error{Kind: object.TypeError, Message: "second argument to `take` must be INTEGER, got STRING"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestParseJSON(t *testing.T) {
+	tests := []vmTestCase{
+		{`parse_json("[1,2,3]")`, []int{1, 2, 3}},
+		{`parse_json("42")`, 42},
+		{`parse_json("\"hi\"")`, "hi"},
+		{`parse_json("true")`, true},
+		{`parse_json("null")`, Null},
+		{`parse_json("[]")`, []int{}},
+		{`parse_json("{\"a\": [1, 2], \"b\": {\"c\": 3}}")["b"]["c"]`, 3},
+		{`len(parse_json("{\"a\": 1, \"b\": 2}"))`, 2},
+		{`parse_json("[1, [2, 3]]") == [1, [2, 3]]`, true},
+		{`str(parse_json("{\"b\": 1, \"a\": 2, \"c\": {\"z\": [], \"y\": null}}"))`, `{b: 1, a: 2, c: {z: [], y: null}}`},
+		{`str(parse_json("{\"b\": 1, \"a\": 2, \"b\": 3}"))`, `{b: 3, a: 2}`},
+		{`parse_json("[1, \"2\", [true, {}]]")`, []interface{}{1, "2", []interface{}{true, map[object.HashKey]int64{}}}},
+		{`parse_json("{invalid")`, &object.Error{Message: "invalid JSON: invalid character 'i' looking for beginning of object key string"}},
+		{`parse_json("[1] [2]")`, &object.Error{Message: "invalid JSON: unexpected data after top-level value"}},
+		{`parse_json("1.5")`, 1.5},
+		{`parse_json("[1, -2.5e3]")[1]`, -2500.0},
+		{`parse_json("1e400")`, &object.Error{Message: "invalid JSON: number 1e400 is out of range"}},
+		{`parse_json(1)`, &object.Error{Message: "argument to `parse_json` must be STRING, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMarshalledBytecodeRuns(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 + 2 * 3", 7},
+		{`"mon" + "key"`, "monkey"},
+		{"let sum = fn(a, b) { let c = a + b; c }; sum(3, 4)", 7},
+		{"let i = 0; while (i < 10) { i = i + 1; } [i, -i]", []int{10, -10}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var buf bytes.Buffer
+		err = comp.Bytecode().Marshal(&buf)
+		if err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+
+		bytecode, err := compiler.LoadBytecode(&buf)
+		if err != nil {
+			t.Fatalf("load error: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		textExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func BenchmarkSmallIntegerArithmetic(b *testing.B) {
+	program := parse(`
+	let i = 0;
+	let sum = 0;
+	while (i < 1000) {
+		sum = (sum + i * 3) / 2 - 7;
+		i = i + 1;
+	}
+	sum`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vm := New(bytecode)
+		err := vm.Run()
+		if err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+func BenchmarkRecursiveFibonacci(b *testing.B) {
+	program := parse(`
+	let fibonacci = fn(x) {
+		if (x < 2) {
+			return x;
+		}
+		fibonacci(x - 1) + fibonacci(x - 2)
+	};
+	fibonacci(20);`)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vm := New(bytecode)
+		err := vm.Run()
+		if err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let x = 1; let arr = [1, 2]; x + 1"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	snapshot := vm.Snapshot()
+
+	vm.globals[0] = object.NewInteger(99)
+	vm.globals[1] = Null
+	vm.globals[2] = object.NewInteger(7)
+	vm.globalsHigh = 3
+	vm.sp = 5
+
+	vm.Restore(snapshot)
+
+	err = testIntegerObject(1, vm.globals[0])
+	if err != nil {
+		t.Fatalf("global x not restored: %s", err)
+	}
+	if _, ok := vm.globals[1].(*object.Array); !ok {
+		t.Fatalf("global arr not restored. got=%T", vm.globals[1])
+	}
+	if vm.globals[2] != nil {
+		t.Fatalf("global defined after snapshot not cleared. got=%+v", vm.globals[2])
+	}
+	if vm.sp != 0 {
+		t.Fatalf("sp not restored. got=%d", vm.sp)
+	}
+
+	// mutating the VM after a restore must not leak into the snapshot
+	vm.globals[0] = object.NewInteger(42)
+	vm.Restore(snapshot)
+
+	err = testIntegerObject(1, vm.globals[0])
+	if err != nil {
+		t.Fatalf("snapshot corrupted by later mutation: %s", err)
+	}
+}
+
+func TestSnapshotMidRun(t *testing.T) {
+	tests := []struct {
+		input string
+		// the snapshot is taken after this many OpSetupTry have run, and
+		// the program then stepped until the next OpSetupTry or the end
+		tries    int
+		expected interface{}
+	}{
+		// restored inside the try body, the catch still gets the error
+		{`let z = 0; let r = try { 1 / z } catch (e) { 7 }; r`, 1, 7},
+		// restored in front of the try, the handler it set up is gone
+		{`let z = 0; let r = try { 1 } catch (e) { 7 }; r / z`, 0,
+			&object.Error{Kind: object.DivideByZero, Message: "division by zero"}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+
+		vm := New(bytecode)
+		stepToTry := func() {
+			for {
+				next := vm.IP() + 1
+				setupTry := vm.FrameIndex() == 0 && next < len(bytecode.Instructions) &&
+					code.Opcode(bytecode.Instructions[next]) == code.OpSetupTry
+
+				done, err := vm.Step()
+				if err != nil {
+					t.Fatalf("vm error for %q: %s", tt.input, err)
+				}
+				if done || setupTry {
+					return
+				}
+			}
+		}
+
+		for i := 0; i < tt.tries; i++ {
+			stepToTry()
+		}
+		snapshot := vm.Snapshot()
+		stepToTry()
+		vm.Restore(snapshot)
+
+		err = vm.Run()
+		if expected, ok := tt.expected.(*object.Error); ok {
+			if err == nil || err.Error() != expected.Message {
+				t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, expected.Message, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		textExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestSnapshotWithSharedGlobalsStore(t *testing.T) {
+	globals := make([]object.Object, GlobalsSize)
+	globals[3] = object.NewInteger(3)
+
+	comp := compiler.New()
+	err := comp.Compile(parse("1"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithGlobalsStore(comp.Bytecode(), globals)
+	snapshot := vm.Snapshot()
+	globals[3] = nil
+	vm.Restore(snapshot)
+
+	err = testIntegerObject(3, globals[3])
+	if err != nil {
+		t.Fatalf("pre-existing global not restored: %s", err)
+	}
+}
+
+func TestRunWithStats(t *testing.T) {
+	tests := []struct {
+		input                string
+		expectedInstructions uint64
+		expectedFrames       uint64
+	}{
+		{"1 + 2", 4, 0},
+		{"let f = fn(x) { x }; f(1); f(2)", 14, 2},
+		// the tail call reuses its frame
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(3)", 40, 1},
+		// callbacks from builtins count too
+		{"each([1, 2], fn(x) { x })", 11, 2},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		stats, err := New(comp.Bytecode()).RunWithStats()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if stats.Instructions != tt.expectedInstructions {
+			t.Errorf("wrong instruction count for %q. want=%d, got=%d", tt.input, tt.expectedInstructions, stats.Instructions)
+		}
+		if stats.FramesPushed != tt.expectedFrames {
+			t.Errorf("wrong frame count for %q. want=%d, got=%d", tt.input, tt.expectedFrames, stats.FramesPushed)
+		}
+		if stats.Duration <= 0 {
+			t.Errorf("expected a positive duration for %q, got=%s", tt.input, stats.Duration)
+		}
+	}
+}
+
+func TestOpcodeCounts(t *testing.T) {
+	tests := []struct {
+		input     string
+		profiling bool
+		expected  map[code.Opcode]uint64
+	}{
+		{
+			input:     "1 + 2",
+			profiling: true,
+			expected: map[code.Opcode]uint64{
+				code.OpConstant: 2,
+				code.OpAdd:      1,
+				code.OpPop:      1,
+			},
+		},
+		{
+			input:     "let i = 0; while (i < 3) { i = i + 1; }",
+			profiling: true,
+			expected: map[code.Opcode]uint64{
+				code.OpConstant:      8,
+				code.OpSetGlobal:     4,
+				code.OpGetGlobal:     7,
+				code.OpLessThan:      4,
+				code.OpJumpNotTruthy: 4,
+				code.OpAdd:           3,
+				code.OpJump:          3,
+			},
+		},
+		{
+			input:     "1 + 2",
+			profiling: false,
+			expected:  map[code.Opcode]uint64{},
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var vm *VM
+		if tt.profiling {
+			vm = New(comp.Bytecode(), WithProfiling())
+		} else {
+			vm = New(comp.Bytecode())
+		}
+
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		counts := vm.OpcodeCounts()
+		if len(counts) != len(tt.expected) {
+			t.Errorf("wrong number of opcodes counted for %q. want=%v, got=%v", tt.input, tt.expected, counts)
+		}
+
+		for op, n := range tt.expected {
+			if counts[op] != n {
+				t.Errorf("wrong count for opcode %d in %q. want=%d, got=%d", op, tt.input, n, counts[op])
+			}
+		}
+	}
+}
+
+func TestStepMatchesRun(t *testing.T) {
+	input := `
+	let sum = fn(a, b) { a + b };
+	let i = 0;
+	let total = 0;
+	while (i < 4) { total = sum(total, i); i = i + 1; }
+	[total, len("abc")]`
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	runner := New(bytecode, WithProfiling())
+	err = runner.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	var executed uint64
+	for _, n := range runner.OpcodeCounts() {
+		executed += n
+	}
+
+	stepper := New(bytecode)
+	if stepper.IP() != -1 || stepper.FrameIndex() != 0 || stepper.StackTop() != nil {
+		t.Fatalf("unexpected initial state. ip=%d frame=%d top=%v",
+			stepper.IP(), stepper.FrameIndex(), stepper.StackTop())
+	}
+
+	var steps uint64
+	enteredFunction := false
+	for {
+		done, err := stepper.Step()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		steps++
+
+		if stepper.FrameIndex() > 0 {
+			enteredFunction = true
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if steps != executed {
+		t.Errorf("wrong number of steps. want=%d, got=%d", executed, steps)
+	}
+
+	// without profiling Run takes its inlined path
+	fast := New(bytecode)
+	stats, err := fast.RunWithStats()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if stats.Instructions != executed {
+		t.Errorf("wrong number of instructions. want=%d, got=%d", executed, stats.Instructions)
+	}
+	textExpectedObject(t, []int{6, 3}, fast.LastPoppedStackElem())
+
+	if !enteredFunction {
+		t.Errorf("stepping never entered the function frame")
+	}
+
+	done, err := stepper.Step()
+	if !done || err != nil {
+		t.Errorf("stepping a finished VM should be a no-op. done=%t err=%v", done, err)
+	}
+
+	textExpectedObject(t, []int{6, 3}, stepper.LastPoppedStackElem())
+	textExpectedObject(t, []int{6, 3}, runner.LastPoppedStackElem())
+}
+
+func TestRunBytecode(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(x) { x * 2 }; f(21)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	result, err := RunBytecode(comp.Bytecode())
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	err = testIntegerObject(42, result)
+	if err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	_, err = RunBytecode(&compiler.Bytecode{Instructions: code.Instructions{255}})
+	if err == nil || err.Error() != "main: offset 0: opcode 255 undefined" {
+		t.Errorf("wrong error for unverifiable bytecode. got=%v", err)
+	}
+
+	_, err = RunBytecode(&compiler.Bytecode{Instructions: code.Make(code.OpPopTry)})
+	if err == nil || err.Error() != "no try block to leave" {
+		t.Errorf("wrong error for OpPopTry without a try. got=%v", err)
+	}
+
+	comp = compiler.New()
+	err = comp.Compile(parse(`while (true) { 1 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	_, err = RunBytecode(comp.Bytecode(), WithMaxInstructions(100))
+	if err == nil || err.Error() != "instruction limit exceeded (limit=100)" {
+		t.Errorf("wrong error for endless loop. got=%v", err)
+	}
+}
+
+func TestLetShadowing(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; let x = x + 1; x`, 2},
+		{`let x = 5; if (true) { let x = x + 1; x }`, 6},
+		{`let x = 5; if (true) { let x = x + 1; x }; x`, 5},
+		{`let a = [1]; let a = push(a, 2); len(a)`, 2},
+		{`let f = fn() { let y = 1; let y = y * 10; y }; f()`, 10},
+		{`let f = fn(n) { if (n == 0) { 0 } else { n + f(n - 1) } }; f(4)`, 10},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUnsetVariable(t *testing.T) {
+	bytecode := &compiler.Bytecode{
+		Instructions: append(code.Make(code.OpGetGlobal, 0), code.Make(code.OpPop)...),
+	}
+
+	_, err := RunBytecode(bytecode)
+	if err == nil || err.Error() != "variable read before it was assigned" {
+		t.Fatalf("wrong error. got=%v", err)
+	}
+}
+
+// fuzzSeeds are the programs FuzzVM starts from. Their constants are reused
+// for the instructions the fuzzer derives from them.
+var fuzzSeeds = []string{
+	`1 + 2 * 3`,
+	`let a = [1, 2, 3]; a[1] = {"x": a}; len(a)`,
+	`let f = fn(x, y = 2) { if (x > y) { x } else { y } }; f(1) + f(5, 1)`,
+	`let counter = fn() { let n = 0; fn() { n + 1 } }; counter()()`,
+	`let r = try { 1 / 0 } catch (e) { e["kind"] }; r`,
+	`let i = 0; while (i < 3) { i++ } i`,
+	`let g = fn() { yield 1; yield 2 }; let it = g(); next(it)`,
+	`let [x, ...rest] = [1, 2, 3]; 2 ** x in rest`,
+}
+
+func FuzzVM(f *testing.F) {
+	bytecodes := make([]*compiler.Bytecode, len(fuzzSeeds))
+	for i, input := range fuzzSeeds {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			f.Fatalf("compiler error for %q: %s", input, err)
+		}
+		bytecodes[i] = comp.Bytecode()
+		f.Add(uint8(i), []byte(bytecodes[i].Instructions))
+	}
+
+	f.Fuzz(func(t *testing.T, seed uint8, ins []byte) {
+		bytecode := &compiler.Bytecode{
+			Instructions: ins,
+			Constants:    bytecodes[int(seed)%len(bytecodes)].Constants,
+		}
 
+		// any outcome but a panic is fine
+		RunBytecode(bytecode,
+			WithMaxInstructions(10000),
+			WithMaxArrayLength(1<<16),
+			WithOutput(io.Discard),
+			WithInput(strings.NewReader("")),
+		)
+	})
 }